@@ -0,0 +1,262 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+	"time"
+	"todo-consumer/db"
+)
+
+// Task statuses, in workflow order.
+const (
+	StatusNew        = "New"
+	StatusBacklog    = "Backlog"
+	StatusInProgress = "In Progress"
+	StatusCompleted  = "Completed"
+	StatusApproved   = "Approved"
+)
+
+// TaskLifecycle is the status history of one task summarised into durations.
+type TaskLifecycle struct {
+	TaskID  string `json:"taskId"`
+	GroupID string `json:"groupId"`
+	Status  string `json:"status"`
+	Deleted bool   `json:"deleted"`
+
+	// TimeInStatus is the total time spent in each status, in seconds. The
+	// current status accrues until the time the metrics were computed.
+	TimeInStatus map[string]float64 `json:"timeInStatus"`
+
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`   // first In Progress
+	CompletedAt *time.Time `json:"completedAt,omitempty"` // first Completed
+
+	// LeadTime is created -> completed and CycleTime is started ->
+	// completed, in seconds; nil until the task has been completed.
+	LeadTime  *float64 `json:"leadTime,omitempty"`
+	CycleTime *float64 `json:"cycleTime,omitempty"`
+}
+
+// Distribution summarises a set of durations in seconds.
+type Distribution struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P75   float64 `json:"p75"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	Max   float64 `json:"max"`
+}
+
+// WeeklyThroughput counts tasks first completed in the week starting Week
+// (Monday, UTC).
+type WeeklyThroughput struct {
+	Week      time.Time `json:"week"`
+	Completed int       `json:"completed"`
+}
+
+// GroupLifecycle holds lead/cycle time distributions and throughput for the
+// tasks of a group.
+type GroupLifecycle struct {
+	Workspace    string                  `json:"workspace"`
+	GroupID      string                  `json:"groupId"`
+	Tasks        int                     `json:"tasks"`
+	LeadTime     Distribution            `json:"leadTime"`
+	CycleTime    Distribution            `json:"cycleTime"`
+	TimeInStatus map[string]Distribution `json:"timeInStatus"`
+	Throughput   []WeeklyThroughput      `json:"throughput"`
+}
+
+// TaskMetrics computes the lifecycle of one task of a workspace as of now.
+// It returns nil when the task has no recorded history.
+func TaskMetrics(workspace, taskId string) (*TaskLifecycle, error) {
+	now := time.Now().UTC()
+	transitions, err := db.GetStatusTransitions(workspace, "", taskId, now)
+	if err != nil {
+		return nil, err
+	}
+	lifecycles := Lifecycles(transitions, now)
+	if len(lifecycles) == 0 {
+		return nil, nil
+	}
+	return &lifecycles[0], nil
+}
+
+// GroupMetrics computes lifecycle distributions and weekly throughput over
+// the last `weeks` weeks for a group; an empty groupId covers all groups of
+// the workspace.
+func GroupMetrics(workspace, groupId string, weeks int) (*GroupLifecycle, error) {
+	now := time.Now().UTC()
+	transitions, err := db.GetStatusTransitions(workspace, groupId, "", now)
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycles := Lifecycles(transitions, now)
+	result := &GroupLifecycle{
+		Workspace:    workspace,
+		GroupID:      groupId,
+		Tasks:        len(lifecycles),
+		TimeInStatus: map[string]Distribution{},
+		Throughput:   Throughput(lifecycles, weeks, now),
+	}
+
+	var lead, cycle []float64
+	perStatus := map[string][]float64{}
+	for _, l := range lifecycles {
+		if l.LeadTime != nil {
+			lead = append(lead, *l.LeadTime)
+		}
+		if l.CycleTime != nil {
+			cycle = append(cycle, *l.CycleTime)
+		}
+		for status, seconds := range l.TimeInStatus {
+			perStatus[status] = append(perStatus[status], seconds)
+		}
+	}
+
+	result.LeadTime = Summarise(lead)
+	result.CycleTime = Summarise(cycle)
+	for status, values := range perStatus {
+		result.TimeInStatus[status] = Summarise(values)
+	}
+	return result, nil
+}
+
+// Lifecycles folds status transitions (ordered by task, then time) into one
+// TaskLifecycle per task. Open intervals end at now.
+func Lifecycles(transitions []db.StatusTransition, now time.Time) []TaskLifecycle {
+	var result []TaskLifecycle
+	var current *TaskLifecycle
+	var since time.Time
+
+	closeInterval := func(end time.Time) {
+		if current != nil && current.Status != "" && !current.Deleted {
+			current.TimeInStatus[current.Status] += end.Sub(since).Seconds()
+		}
+	}
+
+	for _, t := range transitions {
+		if current == nil || current.TaskID != t.TaskID {
+			closeInterval(now)
+			result = append(result, TaskLifecycle{
+				TaskID:       t.TaskID,
+				GroupID:      t.GroupID,
+				TimeInStatus: map[string]float64{},
+			})
+			current = &result[len(result)-1]
+		}
+
+		closeInterval(t.Timestamp)
+		since = t.Timestamp
+		ts := t.Timestamp
+
+		if t.Deleted {
+			current.Deleted = true
+			continue
+		}
+		if t.Status == "" {
+			continue
+		}
+
+		if current.CreatedAt == nil {
+			current.CreatedAt = &ts
+		}
+		if t.Status == StatusInProgress && current.StartedAt == nil {
+			current.StartedAt = &ts
+		}
+		if (t.Status == StatusCompleted || t.Status == StatusApproved) && current.CompletedAt == nil {
+			current.CompletedAt = &ts
+		}
+		current.Status = t.Status
+	}
+	closeInterval(now)
+
+	for i := range result {
+		l := &result[i]
+		if l.CompletedAt == nil {
+			continue
+		}
+		if l.CreatedAt != nil {
+			lead := l.CompletedAt.Sub(*l.CreatedAt).Seconds()
+			l.LeadTime = &lead
+		}
+		if l.StartedAt != nil && !l.StartedAt.After(*l.CompletedAt) {
+			cycle := l.CompletedAt.Sub(*l.StartedAt).Seconds()
+			l.CycleTime = &cycle
+		}
+	}
+	return result
+}
+
+// Throughput counts first completions per week for the last `weeks` weeks,
+// oldest first, including weeks with no completions.
+func Throughput(lifecycles []TaskLifecycle, weeks int, now time.Time) []WeeklyThroughput {
+	if weeks <= 0 {
+		weeks = 12
+	}
+
+	thisWeek := weekStart(now)
+	counts := make([]WeeklyThroughput, weeks)
+	for i := range counts {
+		counts[i].Week = thisWeek.AddDate(0, 0, -7*(weeks-1-i))
+	}
+
+	for _, l := range lifecycles {
+		if l.CompletedAt == nil {
+			continue
+		}
+		offset := int(thisWeek.Sub(weekStart(*l.CompletedAt)).Hours() / (24 * 7))
+		if offset >= 0 && offset < weeks {
+			counts[weeks-1-offset].Completed++
+		}
+	}
+	return counts
+}
+
+// weekStart returns midnight UTC on the Monday of t's week.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+}
+
+// Summarise computes count, mean, max and percentiles (linear interpolation
+// between closest ranks) of values.
+func Summarise(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return Distribution{
+		Count: len(sorted),
+		Mean:  sum / float64(len(sorted)),
+		P50:   Percentile(sorted, 50),
+		P75:   Percentile(sorted, 75),
+		P90:   Percentile(sorted, 90),
+		P95:   Percentile(sorted, 95),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// Percentile returns the p-th percentile of already sorted values.
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
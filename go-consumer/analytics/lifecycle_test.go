@@ -0,0 +1,159 @@
+package analytics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+	"todo-consumer/db"
+)
+
+// base is 09:00 on a Monday, so throughput weeks start nine hours earlier.
+var base = time.Date(2025, 11, 3, 9, 0, 0, 0, time.UTC)
+
+func at(hours float64) time.Time {
+	return base.Add(time.Duration(hours * float64(time.Hour)))
+}
+
+// testTransitions returns status histories ordered by task then time, as
+// db.GetStatusTransitions returns them:
+//
+//	a: New, Backlog at 1h, In Progress at 3h, Completed at 6h, Approved at 8h
+//	b: New, deleted at 2h
+//	c: New at 1h, an unparsable legacy status at 1.5h, In Progress at 2h
+//	d: New a week earlier, Completed an hour later
+func testTransitions() []db.StatusTransition {
+	return []db.StatusTransition{
+		{TaskID: "a", GroupID: "g1", Status: StatusNew, Timestamp: at(0)},
+		{TaskID: "a", GroupID: "g1", Status: StatusBacklog, Timestamp: at(1)},
+		{TaskID: "a", GroupID: "g1", Status: StatusInProgress, Timestamp: at(3)},
+		{TaskID: "a", GroupID: "g1", Status: StatusCompleted, Timestamp: at(6)},
+		{TaskID: "a", GroupID: "g1", Status: StatusApproved, Timestamp: at(8)},
+		{TaskID: "b", GroupID: "g1", Status: StatusNew, Timestamp: at(0)},
+		{TaskID: "b", GroupID: "g1", Deleted: true, Timestamp: at(2)},
+		{TaskID: "c", GroupID: "g2", Status: StatusNew, Timestamp: at(1)},
+		{TaskID: "c", GroupID: "g2", Status: "", Timestamp: at(1.5)},
+		{TaskID: "c", GroupID: "g2", Status: StatusInProgress, Timestamp: at(2)},
+		{TaskID: "d", GroupID: "g2", Status: StatusNew, Timestamp: at(-7 * 24)},
+		{TaskID: "d", GroupID: "g2", Status: StatusCompleted, Timestamp: at(-7*24 + 1)},
+	}
+}
+
+func TestLifecycles(t *testing.T) {
+	now := at(10)
+	lifecycles := Lifecycles(testTransitions(), now)
+	if len(lifecycles) != 4 {
+		t.Fatalf("got %d lifecycles, want 4", len(lifecycles))
+	}
+	byID := map[string]TaskLifecycle{}
+	for _, l := range lifecycles {
+		byID[l.TaskID] = l
+	}
+
+	a := byID["a"]
+	wantTime := map[string]float64{
+		StatusNew:        1 * 3600,
+		StatusBacklog:    2 * 3600,
+		StatusInProgress: 3 * 3600,
+		StatusCompleted:  2 * 3600,
+		StatusApproved:   2 * 3600, // open until now
+	}
+	if !reflect.DeepEqual(a.TimeInStatus, wantTime) {
+		t.Errorf("a: time in status = %v, want %v", a.TimeInStatus, wantTime)
+	}
+	if a.Status != StatusApproved || a.Deleted {
+		t.Errorf("a: status %q deleted %v", a.Status, a.Deleted)
+	}
+	if a.LeadTime == nil || *a.LeadTime != 6*3600 {
+		t.Errorf("a: lead time = %v, want 6h", a.LeadTime)
+	}
+	if a.CycleTime == nil || *a.CycleTime != 3*3600 {
+		t.Errorf("a: cycle time = %v, want 3h", a.CycleTime)
+	}
+	if a.CompletedAt == nil || !a.CompletedAt.Equal(at(6)) {
+		t.Errorf("a: completed at %v, want the first completion", a.CompletedAt)
+	}
+
+	// A deleted task stops accruing time when it is deleted
+	b := byID["b"]
+	if !b.Deleted || !reflect.DeepEqual(b.TimeInStatus, map[string]float64{StatusNew: 2 * 3600}) {
+		t.Errorf("b: deleted %v, time in status %v", b.Deleted, b.TimeInStatus)
+	}
+	if b.LeadTime != nil {
+		t.Errorf("b: lead time %v for an uncompleted task", *b.LeadTime)
+	}
+
+	// A transition without a status leaves the task in its status
+	c := byID["c"]
+	wantTime = map[string]float64{StatusNew: 1 * 3600, StatusInProgress: 8 * 3600}
+	if !reflect.DeepEqual(c.TimeInStatus, wantTime) {
+		t.Errorf("c: time in status = %v, want %v", c.TimeInStatus, wantTime)
+	}
+	if c.Status != StatusInProgress || c.CompletedAt != nil || c.CycleTime != nil {
+		t.Errorf("c: status %q, completed %v, cycle time %v", c.Status, c.CompletedAt, c.CycleTime)
+	}
+
+	// Completed without being started: a lead time but no cycle time
+	d := byID["d"]
+	if d.LeadTime == nil || *d.LeadTime != 3600 || d.CycleTime != nil {
+		t.Errorf("d: lead time %v, cycle time %v", d.LeadTime, d.CycleTime)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	now := at(10)
+	counts := Throughput(Lifecycles(testTransitions(), now), 3, now)
+
+	want := []WeeklyThroughput{
+		{Week: time.Date(2025, 10, 20, 0, 0, 0, 0, time.UTC), Completed: 0},
+		{Week: time.Date(2025, 10, 27, 0, 0, 0, 0, time.UTC), Completed: 1}, // d
+		{Week: time.Date(2025, 11, 3, 0, 0, 0, 0, time.UTC), Completed: 1},  // a
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("throughput = %v, want %v", counts, want)
+	}
+
+	if counts := Throughput(nil, 0, now); len(counts) != 12 {
+		t.Errorf("default throughput covers %d weeks, want 12", len(counts))
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{50, 2.5},
+		{75, 3.25},
+		{100, 4},
+	}
+	for _, tt := range tests {
+		if got := Percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("Percentile(%v, %v) = %v, want %v", sorted, tt.p, got, tt.want)
+		}
+	}
+
+	if got := Percentile(nil, 50); got != 0 {
+		t.Errorf("Percentile of nothing = %v, want 0", got)
+	}
+	if got := Percentile([]float64{7}, 90); got != 7 {
+		t.Errorf("Percentile of one value = %v, want 7", got)
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	got := Summarise([]float64{4, 1, 3, 2})
+	want := Distribution{Count: 4, Mean: 2.5, P50: 2.5, P75: 3.25, P90: 3.7, P95: 3.85, Max: 4}
+	const epsilon = 1e-9
+	if got.Count != want.Count || got.Mean != want.Mean || got.Max != want.Max ||
+		got.P50 != want.P50 || got.P75 != want.P75 ||
+		math.Abs(got.P90-want.P90) > epsilon || math.Abs(got.P95-want.P95) > epsilon {
+		t.Errorf("Summarise = %+v, want %+v", got, want)
+	}
+
+	if got := Summarise(nil); got != (Distribution{}) {
+		t.Errorf("Summarise of nothing = %+v", got)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"todo-consumer/analytics"
+)
+
+// getTaskLifecycle handles GET /api/analytics/task/{taskId}: time spent in
+// each status plus lead and cycle time for one task.
+func getTaskLifecycle(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	taskId := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/analytics/task/"), "/")[0]
+	if taskId == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Task ID required"})
+		return
+	}
+
+	log.Printf("📥 Received lifecycle request for taskId: %s\n", taskId)
+
+	metrics, err := analytics.TaskMetrics(workspace, taskId)
+	if err != nil {
+		log.Printf("❌ Error computing lifecycle for task %s: %v\n", taskId, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error computing lifecycle: %v", err)})
+		return
+	}
+	if metrics == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No status history for task"})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    metrics,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getGroupLifecycle handles GET /api/analytics/lifecycle?groupId=&weeks=:
+// lead/cycle time and time-in-status percentiles plus weekly throughput for
+// a group, or for all groups when groupId is omitted.
+func getGroupLifecycle(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	groupId := r.URL.Query().Get("groupId")
+	weeks := 12
+	if raw := r.URL.Query().Get("weeks"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 520 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "weeks must be between 1 and 520"})
+			return
+		}
+		weeks = n
+	}
+
+	log.Printf("📥 Received lifecycle request for groupId: %s\n", groupId)
+
+	metrics, err := analytics.GroupMetrics(workspace, groupId, weeks)
+	if err != nil {
+		log.Printf("❌ Error computing lifecycle for group %s: %v\n", groupId, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error computing lifecycle: %v", err)})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    metrics,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"todo-consumer/kafka"
+)
+
+// getConsumerAssignments handles GET /api/admin/consumers, listing the
+// partitions this instance's consumers own and how far they have handled
+// and committed each one. Query every replica to see the whole group. Only
+// the operator scope may list them.
+func getConsumerAssignments(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireOperator(w, r) {
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    kafka.Assignments(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"todo-consumer/db"
+	"todo-consumer/export"
+)
+
+// exportLogs handles GET /api/logs/export?format=csv|ndjson|parquet with
+// optional gzip=true, groupId, taskId, user, eventType (comma separated) and
+// from/to (RFC3339). Rows are streamed oldest first as a download, or with
+// upload=true written to the object store and the URI returned.
+func exportLogs(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	opts := export.Options{Format: params.Get("format"), Gzip: params.Get("gzip") == "true"}
+	if opts.Format == "" {
+		opts.Format = export.CSV
+	}
+
+	q := db.NewLogQuery(workspace).
+		Group(params.Get("groupId")).
+		Task(params.Get("taskId")).
+		User(params.Get("user")).
+		Ascending()
+	if raw := params.Get("eventType"); raw != "" {
+		q.EventTypes(strings.Split(raw, ",")...)
+	}
+
+	var badParam string
+	if raw := params.Get("from"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "from"
+		}
+		q.Since(t)
+	}
+	if raw := params.Get("to"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "to"
+		}
+		q.Until(t)
+	}
+
+	err := opts.Validate()
+	if err == nil && badParam != "" {
+		err = fmt.Errorf("Invalid %s parameter", badParam)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	name := fmt.Sprintf("%s_%s", workspace, time.Now().UTC().Format("20060102T150405Z"))
+	log.Printf("📥 Received %s export request for workspace %s\n", opts.Format, workspace)
+
+	if params.Get("upload") == "true" {
+		uri, rows, err := export.Upload(q, opts, name)
+		if err != nil {
+			log.Printf("❌ Error exporting logs: %v\n", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error exporting logs: %v", err)})
+			return
+		}
+
+		response := map[string]interface{}{
+			"success": true,
+			"data":    map[string]interface{}{"uri": uri, "rows": rows},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Gzipped exports are served as .gz files rather than with
+	// Content-Encoding, so browsers save them compressed.
+	w.Header().Set("Content-Type", opts.ContentType())
+	if opts.Gzip {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="todo_event_logs_%s%s"`, name, opts.Extension()))
+
+	// Headers are already sent once rows stream, so a failure part-way can
+	// only be logged; the client sees a truncated download.
+	rows, err := export.Write(w, q, opts)
+	if err != nil {
+		log.Printf("❌ Export aborted after %d rows: %v\n", rows, err)
+		return
+	}
+	log.Printf("📤 Exported %d rows\n", rows)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo-consumer/db"
+)
+
+// searchLogs handles GET /api/logs/search?q=<text> within the request's
+// workspace, with optional groupId, taskId, user, eventType (comma separated), from/to (RFC3339),
+// limit and offset.
+func searchLogs(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	q := db.SearchQuery{
+		Text:      params.Get("q"),
+		GroupID:   params.Get("groupId"),
+		TaskID:    params.Get("taskId"),
+		User:      params.Get("user"),
+		Workspace: workspace,
+	}
+	if raw := params.Get("eventType"); raw != "" {
+		q.EventTypes = strings.Split(raw, ",")
+	}
+
+	var badParam string
+	if raw := params.Get("from"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "from"
+		}
+		q.From = t
+	}
+	if raw := params.Get("to"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "to"
+		}
+		q.To = t
+	}
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			badParam = "limit"
+		}
+		q.Limit = n
+	}
+	if raw := params.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			badParam = "offset"
+		}
+		q.Offset = n
+	}
+
+	if strings.TrimSpace(q.Text) == "" || badParam != "" {
+		msg := "Search text (q) required"
+		if badParam != "" {
+			msg = fmt.Sprintf("Invalid %s parameter", badParam)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	log.Printf("📥 Received log search: %q\n", q.Text)
+
+	results, total, err := db.SearchLogs(q)
+	if err != nil {
+		log.Printf("❌ Error searching logs for %q: %v\n", q.Text, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error searching logs: %v", err)})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    results,
+		"total":   total,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,42 +1,67 @@
 package api
 
 // =====================================================================
-// NOTE: This API server is NO LONGER USED
+// NOTE: The history logs routes below are NO LONGER USED by the frontend
 // =====================================================================
 // The history logs API functionality has been migrated to the Express.js
-// backend (todo_serer/routes/logs.js) running on port 3001.
-//
-// The Go consumer now only handles:
-// - Kafka message consumption
-// - TimescaleDB insertions
-//
-// The Express.js backend provides the same REST API endpoints:
+// backend (todo_serer/routes/logs.js) running on port 3001:
 // - GET /api/logs/groups
 // - GET /api/logs/group/:groupId
 // - GET /api/logs/group/:groupId/tasks
 // - GET /api/logs/task/:taskId
 //
-// Frontend now calls Express.js API (port 3001) instead of Go API (port 7250)
+// This server still hosts Go-only endpoints that have no Express
+// counterpart, and is started from main.go when GO_API_ENABLED=true.
+// Every route is scoped to the workspace given in the X-Workspace header or
+// ?workspace= parameter. The system workspace is the operator scope: it
+// diffs whole-database snapshots and is the only scope that lists consumer
+// assignments; any other workspace diffs only its own snapshots.
+//
+// The API does not authenticate callers: whoever names a workspace reads
+// its history. It must only be reachable through a trusted proxy that
+// authenticates the user and sets X-Workspace itself. Setting
+// API_PROXY_SECRET makes that enforceable: scoped requests must then carry the
+// same value in X-Proxy-Secret, and the workspace comes from X-Workspace only.
 //
-// This file is kept for reference only and may be deleted in the future.
+// Go-only routes:
+// - GET /api/snapshots/diff?from=<id>&to=<id>[&format=text]
+// - GET /api/admin/consumers
+// - GET /api/state/{group|task|comment}/{id}[?asOf=<RFC3339>]
+// - GET /api/analytics/task/:taskId
+// - GET /api/analytics/lifecycle[?groupId=<id>&weeks=<n>]
+// - GET /api/logs/search?q=<text>[&groupId&taskId&user&eventType&from&to&limit&offset]
+// - GET /api/users/:user/timeline[?from&to&limit&cursor]
+// - GET /api/users/:user/summary[?from&to]
+// - GET /api/logs/export?format=csv|ndjson|parquet[&gzip=true&upload=true&groupId&taskId&user&eventType&from&to]
 // =====================================================================
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"todo-consumer/db"
 )
 
-// StartServer starts the HTTP API for logs and health checks.
-// DEPRECATED: This function is no longer called from main.go
+// StartServer starts the HTTP API for logs, snapshots and health checks.
 func StartServer() {
 	// Routes
 	http.HandleFunc("/api/logs/groups", getGroupsSummary)
 	http.HandleFunc("/api/logs/group/", handleGroupRoutes)
 	http.HandleFunc("/api/logs/task/", getTaskLogs)
+	http.HandleFunc("/api/logs/search", searchLogs)
+	http.HandleFunc("/api/logs/export", exportLogs)
+	http.HandleFunc("/api/users/", handleUserRoutes)
+	http.HandleFunc("/api/snapshots/diff", diffSnapshots)
+	http.HandleFunc("/api/admin/consumers", getConsumerAssignments)
+	http.HandleFunc("/api/state/", getEntityState)
+	http.HandleFunc("/api/analytics/task/", getTaskLifecycle)
+	http.HandleFunc("/api/analytics/lifecycle", getGroupLifecycle)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
@@ -44,6 +69,9 @@ func StartServer() {
 	})
 
 	log.Println("🌐 Go API server started on :7250")
+	if os.Getenv("API_PROXY_SECRET") == "" {
+		log.Println("⚠️ API_PROXY_SECRET not set: the API trusts the workspace callers name, so it must only be reachable through an authenticating proxy")
+	}
 
 	// Start the HTTP server (non-blocking if called as a goroutine)
 	if err := http.ListenAndServe(":7250", nil); err != nil {
@@ -65,7 +93,12 @@ func getGroupsSummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	summary, err := db.GetGroupsSummary()
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := db.GetGroupsSummary(workspace)
 	if err != nil {
 		log.Printf("❌ Error fetching groups summary: %v\n", err)
 		w.Header().Set("Content-Type", "application/json")
@@ -97,6 +130,11 @@ func handleGroupRoutes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
 	// Extract path after /api/logs/group/
 	path := strings.TrimPrefix(r.URL.Path, "/api/logs/group/")
 	parts := strings.Split(path, "/")
@@ -111,30 +149,29 @@ func handleGroupRoutes(w http.ResponseWriter, r *http.Request) {
 
 	// Check if requesting tasks summary
 	if len(parts) > 1 && parts[1] == "tasks" {
-		getGroupTasksSummary(w, groupId)
+		getGroupTasksSummary(w, workspace, groupId)
 		return
 	}
 
 	// Otherwise, return group logs
-	getGroupLogsHandler(w, groupId)
+	getGroupLogsHandler(w, r, workspace, groupId)
 }
 
 // getGroupLogsHandler handles fetching logs for a specific group
-func getGroupLogsHandler(w http.ResponseWriter, groupId string) {
+func getGroupLogsHandler(w http.ResponseWriter, r *http.Request, workspace, groupId string) {
 	log.Printf("📥 Received logs request for groupId: %s\n", groupId)
 
-	logs, err := db.GetGroupLogs(groupId)
+	logs, next, err := pageLogs(r, db.NewLogQuery(workspace).Group(groupId))
 	if err != nil {
 		log.Printf("❌ Error fetching logs for group %s: %v\n", groupId, err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error fetching logs: %v", err)})
+		writePageError(w, err, "logs")
 		return
 	}
 
 	response := map[string]interface{}{
-		"success": true,
-		"data":    logs,
+		"success":    true,
+		"data":       logs,
+		"nextCursor": next,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -142,10 +179,10 @@ func getGroupLogsHandler(w http.ResponseWriter, groupId string) {
 }
 
 // getGroupTasksSummary handles fetching tasks summary for a group
-func getGroupTasksSummary(w http.ResponseWriter, groupId string) {
+func getGroupTasksSummary(w http.ResponseWriter, workspace, groupId string) {
 	log.Printf("📥 Received tasks summary request for groupId: %s\n", groupId)
 
-	summary, err := db.GetGroupTasksSummary(groupId)
+	summary, err := db.GetGroupTasksSummary(workspace, groupId)
 	if err != nil {
 		log.Printf("❌ Error fetching tasks summary for group %s: %v\n", groupId, err)
 		w.Header().Set("Content-Type", "application/json")
@@ -177,6 +214,11 @@ func getTaskLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/api/logs/task/")
 	taskId := strings.Split(path, "/")[0]
 
@@ -189,27 +231,114 @@ func getTaskLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logs, err := db.GetTaskLogs(taskId)
+	logs, next, err := pageLogs(r, db.NewLogQuery(workspace).Task(taskId))
 	if err != nil {
 		log.Printf("❌ Error fetching logs for task %s: %v\n", taskId, err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error fetching logs: %v", err)})
+		writePageError(w, err, "logs")
 		return
 	}
 
 	response := map[string]interface{}{
-		"success": true,
-		"data":    logs,
+		"success":    true,
+		"data":       logs,
+		"nextCursor": next,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// paramError is a malformed request parameter, answered with 400 rather
+// than as a server error.
+type paramError struct {
+	param string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("Invalid %s parameter", e.param)
+}
+
+// pageLogs applies the optional ?limit=<n>&cursor=<nextCursor> paging
+// parameters to q and fetches the page. A malformed limit or cursor is
+// returned as a *paramError.
+func pageLogs(r *http.Request, q *db.LogQuery) ([]db.LogEntry, string, error) {
+	params := r.URL.Query()
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return nil, "", &paramError{param: "limit"}
+		}
+		q.Limit(limit)
+	}
+	logs, next, err := q.After(params.Get("cursor")).Fetch()
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return nil, "", &paramError{param: "cursor"}
+	}
+	return logs, next, err
+}
+
+// writePageError responds to a failed pageLogs: 400 for a malformed
+// parameter, 500 otherwise.
+func writePageError(w http.ResponseWriter, err error, what string) {
+	status, msg := http.StatusInternalServerError, fmt.Sprintf("Error fetching %s: %v", what, err)
+	var bad *paramError
+	if errors.As(err, &bad) {
+		status, msg = http.StatusBadRequest, bad.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// requireWorkspace returns the workspace a request is scoped to, taken from
+// the X-Workspace header or the ?workspace= parameter. History is isolated
+// per workspace, so requests without one are rejected with 400.
+//
+// The workspace is trusted as given; see the note at the top of this file.
+// With API_PROXY_SECRET set, only requests presenting it in X-Proxy-Secret
+// are served (401 otherwise) and ?workspace= is ignored, so the workspace is
+// always the one the proxy vouched for.
+func requireWorkspace(w http.ResponseWriter, r *http.Request) (string, bool) {
+	secret := os.Getenv("API_PROXY_SECRET")
+	if secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Proxy-Secret")), []byte(secret)) != 1 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Requests must come through the authenticating proxy"})
+		return "", false
+	}
+
+	workspace := r.Header.Get("X-Workspace")
+	if workspace == "" && secret == "" {
+		workspace = r.URL.Query().Get("workspace")
+	}
+	if workspace == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Workspace required (X-Workspace header or ?workspace=)"})
+		return "", false
+	}
+	return workspace, true
+}
+
+// requireOperator accepts only requests scoped to the system workspace,
+// answering 403 for any other workspace.
+func requireOperator(w http.ResponseWriter, r *http.Request) bool {
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return false
+	}
+	if workspace != db.SystemWorkspace {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Operator scope required (X-Workspace: " + db.SystemWorkspace + ")"})
+		return false
+	}
+	return true
+}
+
 // setCORSHeaders sets common CORS headers
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Workspace")
 }
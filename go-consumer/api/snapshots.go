@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"todo-consumer/db"
+	"todo-consumer/snapshot"
+)
+
+// diffSnapshots handles GET /api/snapshots/diff?from=<id>&to=<id>, reporting
+// what restoring "to" over "from" would change. format=text returns the
+// human-readable report instead of JSON. Both snapshots must belong to the
+// caller's workspace; the operator scope diffs whole-database snapshots.
+func diffSnapshots(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+	if workspace == db.SystemWorkspace {
+		workspace = "" // whole-database snapshots
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Both from and to snapshot IDs are required"})
+		return
+	}
+
+	log.Printf("📥 Received snapshot diff request: %s -> %s\n", from, to)
+
+	report, err := loadAndDiff(from, to, workspace)
+	if errors.Is(err, errSnapshotNotFound) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Error diffing snapshots %s -> %s: %v\n", from, to, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error diffing snapshots: %v", err)})
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, report.Text())
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    report,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// errSnapshotNotFound is returned for snapshots of another workspace, which
+// are reported as missing rather than forbidden so their IDs reveal nothing.
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// loadAndDiff diffs two snapshots of workspace ("" for whole-database
+// snapshots).
+func loadAndDiff(from, to, workspace string) (*snapshot.DiffReport, error) {
+	a, err := snapshot.LoadSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := snapshot.LoadSnapshot(to)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range []*snapshot.SnapshotData{a, b} {
+		if s.Workspace != workspace {
+			return nil, fmt.Errorf("%w: %s", errSnapshotNotFound, s.SnapshotID)
+		}
+	}
+	return snapshot.Diff(a, b)
+}
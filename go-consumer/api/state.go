@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"todo-consumer/projection"
+)
+
+// entityNames maps route segments to the entity names stored in the logs.
+var entityNames = map[string]string{
+	"group":   "Group",
+	"task":    "Task",
+	"comment": "Comment",
+}
+
+// getEntityState handles GET /api/state/{group|task|comment}/{id}?asOf=<RFC3339>,
+// returning the entity rebuilt from its history. asOf defaults to now.
+func getEntityState(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/state/"), "/")
+	entity, ok := entityNames[parts[0]]
+	if !ok || len(parts) < 2 || parts[1] == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected /api/state/{group|task|comment}/{id}"})
+		return
+	}
+	entityId := parts[1]
+
+	asOf := time.Now().UTC()
+	if raw := r.URL.Query().Get("asOf"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "asOf must be an RFC3339 timestamp"})
+			return
+		}
+		asOf = parsed
+	}
+
+	log.Printf("📥 Received state request for %s %s as of %s\n", entity, entityId, asOf.Format(time.RFC3339))
+
+	state, err := projection.Rebuild(workspace, entity, entityId, asOf)
+	if err != nil {
+		log.Printf("❌ Error rebuilding %s %s: %v\n", entity, entityId, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error rebuilding state: %v", err)})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    state,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"todo-consumer/db"
+)
+
+// handleUserRoutes handles GET /api/users/{user}/timeline and
+// GET /api/users/{user}/summary, both with optional from/to (RFC3339).
+func handleUserRoutes(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workspace, ok := requireWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "timeline" && parts[1] != "summary") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected /api/users/{user}/timeline or /api/users/{user}/summary"})
+		return
+	}
+	user := parts[0]
+
+	var from, to time.Time
+	var badParam string
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "from"
+		}
+		from = t
+	}
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			badParam = "to"
+		}
+		to = t
+	}
+	if badParam != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Invalid %s parameter", badParam)})
+		return
+	}
+
+	if parts[1] == "summary" {
+		getUserSummary(w, workspace, user, from, to)
+		return
+	}
+	getUserTimeline(w, r, workspace, user, from, to)
+}
+
+// getUserTimeline returns a user's events across groups and tasks, newest
+// first, paged with ?limit=<n>&cursor=<nextCursor>.
+func getUserTimeline(w http.ResponseWriter, r *http.Request, workspace, user string, from, to time.Time) {
+	log.Printf("📥 Received timeline request for user: %s\n", user)
+
+	logs, next, err := pageLogs(r, db.NewLogQuery(workspace).User(user).Since(from).Until(to))
+	if err != nil {
+		log.Printf("❌ Error fetching timeline for user %s: %v\n", user, err)
+		writePageError(w, err, "timeline")
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"data":       logs,
+		"nextCursor": next,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getUserSummary returns a user's event counts by type and by day.
+func getUserSummary(w http.ResponseWriter, workspace, user string, from, to time.Time) {
+	log.Printf("📥 Received activity summary request for user: %s\n", user)
+
+	summary, err := db.GetUserSummary(workspace, user, from, to)
+	if err != nil {
+		log.Printf("❌ Error summarising activity for user %s: %v\n", user, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Error summarising activity: %v", err)})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"data":    summary,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
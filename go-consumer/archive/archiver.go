@@ -0,0 +1,123 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"todo-consumer/db"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// checkInterval is how often expired chunks are looked for.
+const checkInterval = time.Hour
+
+// archiverLockKey is the Postgres advisory lock key that elects the single
+// replica allowed to archive and drop chunks.
+const archiverLockKey int64 = 0x61726368 // "arch"
+
+// StartArchiver exports todo_event_logs chunks older than EVENT_LOG_RETENTION
+// to the S3 bucket as gzipped NDJSON and drops them once uploaded. It is the
+// archive-first alternative to a Timescale retention policy and blocks, so
+// run it in a goroutine. Only the replica holding the archiver lock archives,
+// so chunks are uploaded and dropped once.
+func StartArchiver() {
+	cfg := db.LoadPolicyConfig()
+	if cfg.Retention == "" {
+		fmt.Println("⚠️ EVENT_LOG_ARCHIVE is set but EVENT_LOG_RETENTION is not - archiver disabled")
+		return
+	}
+
+	retention, err := db.IntervalDuration(cfg.Retention)
+	if err != nil {
+		fmt.Printf("❌ Archiver config error: %v\n", err)
+		return
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		fmt.Printf("❌ AWS session error: %v\n", err)
+		return
+	}
+	uploader := s3manager.NewUploader(sess)
+	bucketName := os.Getenv("S3_BUCKET_NAME")
+
+	fmt.Printf("🗄️ Event log archiver started (retention %s -> s3://%s/archives/)\n", cfg.Retention, bucketName)
+
+	leader := db.NewLeader("Event log archiver", archiverLockKey)
+	for {
+		if leader.Acquire() {
+			if err := archiveExpired(uploader, bucketName, time.Now().Add(-retention)); err != nil {
+				fmt.Printf("❌ Archive error: %v\n", err)
+			}
+		}
+		time.Sleep(checkInterval)
+	}
+}
+
+// archiveExpired uploads and drops expired chunks oldest first, stopping at
+// the first failure so nothing is dropped before it is archived.
+func archiveExpired(uploader *s3manager.Uploader, bucketName string, cutoff time.Time) error {
+	chunks, err := db.GetExpiredChunks(cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		key := fmt.Sprintf("archives/todo_event_logs/%s_%s.ndjson.gz",
+			chunk.RangeStart.UTC().Format("20060102T150405Z"),
+			chunk.RangeEnd.UTC().Format("20060102T150405Z"))
+
+		rows, err := uploadChunk(uploader, bucketName, key, chunk)
+		if err != nil {
+			return fmt.Errorf("archive chunk %s: %w", chunk.Name, err)
+		}
+
+		if err := db.DropChunksBefore(chunk.RangeEnd); err != nil {
+			return fmt.Errorf("drop chunk %s: %w", chunk.Name, err)
+		}
+
+		fmt.Printf("🗄️ Archived %d rows from %s -> s3://%s/%s\n", rows, chunk.Name, bucketName, key)
+	}
+	return nil
+}
+
+// uploadChunk streams a chunk's rows through gzip straight into a multipart
+// upload, so large chunks are never held in memory.
+func uploadChunk(uploader *s3manager.Uploader, bucketName, key string, chunk db.Chunk) (int, error) {
+	pr, pw := io.Pipe()
+
+	written := make(chan int, 1)
+	go func() {
+		gz := gzip.NewWriter(pw)
+		encoder := json.NewEncoder(gz)
+		n, err := db.StreamRange(chunk.RangeStart, chunk.RangeEnd, func(row map[string]interface{}) error {
+			return encoder.Encode(row)
+		})
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+		written <- n
+	}()
+
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(key),
+		Body:            pr,
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		// Unblock the writer if the upload gave up early
+		pr.CloseWithError(err)
+	}
+	return <-written, err
+}
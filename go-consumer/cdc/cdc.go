@@ -0,0 +1,442 @@
+// Package cdc turns MongoDB change streams on groups, tasks and comments into
+// history events, so changes the Express routes do not publish (direct
+// database edits, restores) reach todo_event_logs too. Every insert, update,
+// replace and delete is published to the history topic as a kafka.Event with
+// the full before and after documents, typed CDC_<ENTITY>_CREATED, _UPDATED
+// or _DELETED so it folds into entity state like route events while staying
+// distinguishable from them.
+//
+// Every replica may enable the ingester; a Postgres advisory lock elects the
+// one that watches, so each change is published once rather than once per
+// replica. The resume token of the last published change is saved in
+// TimescaleDB, so a restarted ingester or a new leader continues where the
+// last one stopped. Delivery is at least once: a change published but not
+// yet saved is published again and logged twice. The copies carry the same
+// event-id header, but nothing downstream drops them.
+//
+// Before documents need MongoDB 6.0 pre-images; the ingester enables them on
+// the watched collections and publishes deletes and updates without a
+// before document where they are unavailable. Change streams need a replica
+// set.
+//
+// MongoDB documents do not record their tenant, so the workspace of a change
+// is the one the entity's (or, failing that, its group's or task's) events
+// were logged in. A change whose workspace cannot be determined, such as a
+// group inserted directly into MongoDB, is parked on the dead-letter topic
+// rather than logged under a guessed tenant.
+//
+// Configuration (environment):
+//
+//	CDC_TOPIC topic to publish to, default todo-history-events
+package cdc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"todo-consumer/db"
+	"todo-consumer/kafka"
+	"todo-consumer/message"
+	"todo-consumer/producer"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// stream names the resume token saved for this ingester.
+const stream = "todo_manager"
+
+// source is the source header of CDC events.
+const source = "todo-cdc"
+
+// user is recorded as the author of CDC events; the database does not know
+// who made a change.
+const user = "mongodb-cdc"
+
+// cdcLockKey is the advisory lock the ingester leader holds.
+const cdcLockKey int64 = 0x6364635f // "cdc_"
+
+// standbyInterval is how often a replica that is not the ingester leader
+// contests leadership.
+const standbyInterval = 10 * time.Second
+
+// workspaceWait is how long a change waits for its entity's workspace to be
+// logged. The route event of the same change travels through Kafka (or the
+// outbox) and usually lands shortly after the change stream sees it.
+const workspaceWait = 10 * time.Second
+
+// maxBackoff caps the wait before reopening a failed change stream.
+const maxBackoff = 30 * time.Second
+
+// entities maps the watched collections to the entity of their documents.
+var entities = map[string]string{
+	"groups":   "Group",
+	"tasks":    "Task",
+	"comments": "Comment",
+}
+
+// changeEvent is the part of a change stream event the ingester reads.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	NS            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument             bson.M `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.M `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        *struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+	ClusterTime primitive.Timestamp `bson:"clusterTime"`
+	WallTime    time.Time           `bson:"wallTime"`
+}
+
+// Start watches the collections and publishes their changes until the
+// process exits, while this replica is the ingester leader, reopening the
+// stream from the saved resume token after errors. It blocks, so run it in
+// a goroutine after db.Init and producer.Init.
+func Start() {
+	if producer.Default == nil {
+		fmt.Println("❌ CDC ingester needs the Kafka producer (producer.Init)")
+		return
+	}
+
+	db.NewLeader("CDC ingester", cdcLockKey).Run(standbyInterval, ingest)
+}
+
+// ingest publishes changes until ctx is cancelled.
+func ingest(ctx context.Context) {
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017/todo_manager"
+	}
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		fmt.Printf("❌ CDC MongoDB connection failed: %v\n", err)
+		return
+	}
+	defer client.Disconnect(context.Background())
+
+	database := client.Database("todo_manager")
+	preImages := enablePreImages(ctx, database)
+
+	fmt.Println("🛰️ CDC ingester watching groups, tasks and comments")
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := watch(ctx, database, preImages)
+		if ctx.Err() != nil {
+			fmt.Println("🛰️ CDC ingester stopped")
+			return
+		}
+		if time.Since(started) > maxBackoff {
+			backoff = time.Second
+		}
+		fmt.Printf("❌ CDC change stream error (reopening in %s): %v\n", backoff, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// enablePreImages turns on change stream pre-images for the watched
+// collections, which before documents of updates and deletes come from, and
+// reports whether the server supports them.
+func enablePreImages(ctx context.Context, database *mongo.Database) bool {
+	enabled := false
+	for coll := range entities {
+		err := database.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll},
+			{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+		}).Err()
+		if err != nil {
+			fmt.Printf("⚠️ CDC pre-images unavailable for %s (updates and deletes will lack before documents): %v\n", coll, err)
+			continue
+		}
+		enabled = true
+	}
+	return enabled
+}
+
+// watch opens the change stream after the saved resume token and publishes
+// changes until the stream fails. Servers without pre-images reject the
+// before document option, so it is only asked for when they are enabled.
+func watch(ctx context.Context, database *mongo.Database, preImages bool) error {
+	collections := make([]string, 0, len(entities))
+	for coll := range entities {
+		collections = append(collections, coll)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"ns.coll":       bson.M{"$in": collections},
+		"operationType": bson.M{"$in": []string{"insert", "update", "replace", "delete"}},
+	}}}}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if preImages {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+
+	token, err := db.GetResumeToken(stream)
+	if err != nil {
+		return fmt.Errorf("resume token lookup failed: %w", err)
+	}
+	if token != nil {
+		opts.SetStartAfter(bson.Raw(token))
+		fmt.Println("🛰️ CDC resuming after the saved resume token")
+	}
+
+	cs, err := database.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(ctx)
+
+	for cs.Next(ctx) {
+		var change changeEvent
+		if err := cs.Decode(&change); err != nil {
+			return fmt.Errorf("change decode failed: %w", err)
+		}
+
+		workspace, err := change.workspace(ctx)
+		if err != nil {
+			return fmt.Errorf("workspace lookup failed: %w", err)
+		}
+
+		m, err := change.message(cs.ResumeToken(), workspace)
+		if err != nil {
+			return err
+		}
+		if workspace == "" {
+			fmt.Printf("⚠️ CDC %s %s %v has no known workspace, parking it on the DLQ\n",
+				change.OperationType, change.NS.Coll, change.DocumentKey.ID)
+			m = deadLetter(m, "no workspace")
+		}
+		if _, err := producer.Default.Publish(ctx, m); err != nil {
+			return fmt.Errorf("publish failed: %w", err)
+		}
+		if err := db.SaveResumeToken(stream, cs.ResumeToken()); err != nil {
+			return fmt.Errorf("resume token save failed: %w", err)
+		}
+		fmt.Printf("🛰️ CDC %s %s %v\n", change.OperationType, change.NS.Coll, change.DocumentKey.ID)
+	}
+	return cs.Err()
+}
+
+// message converts a change in workspace into a history event message. Its
+// event ID is derived from the resume token, so a change published twice is
+// recognisable as the same event.
+func (c changeEvent) message(token bson.Raw, workspace string) (kafkago.Message, error) {
+	entity := entities[c.NS.Coll]
+	entityID := idString(c.DocumentKey.ID)
+
+	var after bson.M
+	if c.OperationType != "delete" {
+		after = c.FullDocument
+	}
+	before := c.FullDocumentBeforeChange
+
+	kind := "UPDATED"
+	switch c.OperationType {
+	case "insert":
+		kind = "CREATED"
+		before = nil
+	case "delete":
+		kind = "DELETED"
+	}
+
+	// Route events name the group/task an entity belongs to; take them from
+	// whichever document is known
+	doc := c.document()
+	payload := kafka.Payload{
+		Entity:    entity,
+		EntityId:  entityID,
+		Changes:   c.describe(entity, entityID, doc),
+		User:      user,
+		Workspace: workspace,
+		Timestamp: c.changedAt().Format(time.RFC3339Nano),
+	}
+	switch entity {
+	case "Group":
+		payload.GroupName = stringField(doc, "name")
+	case "Task":
+		payload.GroupId = idString(doc["groupId"])
+		payload.TaskName = stringField(doc, "name")
+	case "Comment":
+		payload.TaskId = idString(doc["taskId"])
+	}
+
+	var err error
+	if payload.Before, err = documentJSON(before); err != nil {
+		return kafkago.Message{}, err
+	}
+	if payload.After, err = documentJSON(after); err != nil {
+		return kafkago.Message{}, err
+	}
+
+	value, err := json.Marshal(kafka.Event{
+		EventType: "CDC_" + strings.ToUpper(entity) + "_" + kind,
+		Payload:   payload,
+		Timestamp: payload.Timestamp,
+	})
+	if err != nil {
+		return kafkago.Message{}, err
+	}
+
+	sum := sha256.Sum256(token)
+	return kafkago.Message{
+		Topic: topic(),
+		Key:   []byte(entityID),
+		Value: value,
+		Headers: []kafkago.Header{
+			{Key: message.HeaderEventID, Value: []byte("cdc-" + hex.EncodeToString(sum[:16]))},
+			{Key: message.HeaderSource, Value: []byte(source)},
+		},
+	}, nil
+}
+
+// describe summarises the change for the changes column.
+func (c changeEvent) describe(entity, entityID string, doc bson.M) string {
+	name := entityID
+	if n := stringField(doc, "name"); n != "" {
+		name = fmt.Sprintf("%q", n)
+	}
+
+	switch c.OperationType {
+	case "insert":
+		return fmt.Sprintf("%s %s created (MongoDB change stream)", entity, name)
+	case "delete":
+		return fmt.Sprintf("%s %s deleted (MongoDB change stream)", entity, name)
+	case "replace":
+		return fmt.Sprintf("%s %s replaced (MongoDB change stream)", entity, name)
+	}
+
+	var fields []string
+	if c.UpdateDescription != nil {
+		for f := range c.UpdateDescription.UpdatedFields {
+			fields = append(fields, f)
+		}
+		fields = append(fields, c.UpdateDescription.RemovedFields...)
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("%s %s updated: %s (MongoDB change stream)", entity, name, strings.Join(fields, ", "))
+}
+
+// changedAt returns when the change was made: the wall clock time MongoDB 6.0+
+// records, else the cluster time.
+func (c changeEvent) changedAt() time.Time {
+	if !c.WallTime.IsZero() {
+		return c.WallTime.UTC()
+	}
+	return time.Unix(int64(c.ClusterTime.T), 0).UTC()
+}
+
+// documentJSON encodes a document the way snapshots are normalised
+// (ObjectIDs as hex strings, dates as RFC 3339), or returns nil for none.
+func documentJSON(doc bson.M) (json.RawMessage, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	return json.Marshal(doc)
+}
+
+// document returns the entity as of the change: the after document, or the
+// before document of a delete. It is nil for a delete without a pre-image.
+func (c changeEvent) document() bson.M {
+	if c.OperationType != "delete" && c.FullDocument != nil {
+		return c.FullDocument
+	}
+	return c.FullDocumentBeforeChange
+}
+
+// workspace returns the workspace the changed entity belongs to: the
+// document's own workspace field if it has one, else the workspace its
+// events, or its parent's, were logged in. A change to an entity nothing
+// has been logged for yet waits up to workspaceWait for its route event.
+// It returns "" when the workspace cannot be determined.
+func (c changeEvent) workspace(ctx context.Context) (string, error) {
+	doc := c.document()
+	if ws := stringField(doc, "workspace"); ws != "" {
+		return ws, nil
+	}
+
+	entity := entities[c.NS.Coll]
+	candidates := [][2]string{{entity, idString(c.DocumentKey.ID)}}
+	switch entity {
+	case "Task":
+		candidates = append(candidates, [2]string{"Group", idString(doc["groupId"])})
+	case "Comment":
+		candidates = append(candidates, [2]string{"Task", idString(doc["taskId"])})
+	}
+
+	deadline := time.Now().Add(workspaceWait)
+	for {
+		for _, candidate := range candidates {
+			if candidate[1] == "" {
+				continue
+			}
+			ws, err := db.EntityWorkspace(ctx, candidate[0], candidate[1])
+			if err != nil || ws != "" {
+				return ws, err
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// deadLetter readdresses m to the dead-letter topic with the reason headers
+// producer.DeadLetter adds to consumed messages.
+func deadLetter(m kafkago.Message, reason string) kafkago.Message {
+	m.Headers = append(m.Headers,
+		kafkago.Header{Key: "dlq-reason", Value: []byte(reason)},
+		kafkago.Header{Key: "dlq-source-topic", Value: []byte(m.Topic)},
+		kafkago.Header{Key: "dlq-failed-at", Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+	m.Topic = producer.DeadLetterTopic()
+	return m
+}
+
+func topic() string {
+	if t := os.Getenv("CDC_TOPIC"); t != "" {
+		return t
+	}
+	return "todo-history-events"
+}
+
+func stringField(doc bson.M, field string) string {
+	s, _ := doc[field].(string)
+	return s
+}
+
+func idString(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case primitive.ObjectID:
+		return v.Hex()
+	default:
+		return fmt.Sprint(v)
+	}
+}
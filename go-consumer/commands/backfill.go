@@ -0,0 +1,302 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"todo-consumer/db"
+	consumer "todo-consumer/kafka"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/topics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const backfillUsage = "backfill [-progress <duration>] [-swap [-force]]"
+
+// backfillTopic is the topic history is rebuilt from, and liveGroup the
+// consumer group that writes it to the live table.
+const (
+	backfillTopic = "todo-history-events"
+	liveGroup     = "todo-consumer-group-go"
+)
+
+// backfillState tracks how far a backfill has read the topic.
+type backfillState struct {
+	next     map[int]int64 // next offset to read, per partition
+	inserted int64
+	skipped  int64 // snapshot triggers, which log no event
+	rejected int64 // undecodable events, dead-lettered by the consumer
+	started  time.Time
+}
+
+// runBackfill rebuilds todo_event_logs from the topic into a shadow table,
+// reading from the earliest offset with a group of its own so the live
+// consumer is undisturbed. It reports progress while it catches up and
+// compares event counts with the live table once it has. With -swap it then
+// waits for the live consumer to be stopped, reads the last events, swaps
+// the shadow table in and commits the live group's offsets to where the
+// backfill stopped, so the consumer resumes without gaps or duplicates.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	every := fs.Duration("progress", 10*time.Second, "interval between progress reports")
+	swap := fs.Bool("swap", false, "replace the live table once caught up (waits for the consumer to be stopped)")
+	force := fs.Bool("force", false, "swap even if the rebuilt table has fewer events than the live one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *every <= 0 {
+		return fmt.Errorf("-progress must be positive")
+	}
+	if *force && !*swap {
+		return fmt.Errorf("-force only applies with -swap")
+	}
+
+	if err := connectDB(); err != nil {
+		return err
+	}
+	if err := db.PrepareBackfill(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := kafkaclient.NewClient()
+	if err != nil {
+		return err
+	}
+
+	// A group nobody else uses and that never commits starts at the
+	// earliest offset and leaves nothing behind
+	group := fmt.Sprintf("todo-backfill-%d", time.Now().Unix())
+	maxBytes, err := topics.MaxMessageBytes(backfillTopic)
+	if err != nil {
+		return err
+	}
+	reader, err := kafkaclient.NewReader(backfillTopic, group, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	fmt.Printf("🔁 Backfilling %s from the earliest offset (group %s)\n", backfillTopic, group)
+	state := &backfillState{next: map[int]int64{}, started: time.Now()}
+	if err := state.catchUp(ctx, reader, *every); err != nil {
+		return err
+	}
+
+	fmt.Println("🔨 Building indexes on the rebuilt table...")
+	if err := db.BuildBackfillIndexes(); err != nil {
+		return err
+	}
+	if err := state.catchUp(ctx, reader, *every); err != nil {
+		return err
+	}
+
+	short, err := printParity()
+	if err != nil {
+		return err
+	}
+	if !*swap {
+		fmt.Println("✅ Caught up; the rebuilt table was kept for inspection. Run with -swap to replace the live table.")
+		return nil
+	}
+	if short && !*force {
+		return fmt.Errorf("rebuilt history has fewer events than the live table (older events may have expired from the topic); use -force to swap anyway")
+	}
+
+	// Offsets are handed over to the live group, which must not be running
+	// and committing its own
+	for {
+		err := ensureGroupInactive(ctx, client, liveGroup)
+		if err == nil {
+			break
+		}
+		fmt.Printf("⏳ Waiting to swap: %v\n", err)
+		time.Sleep(*every)
+		if err := state.catchUp(ctx, reader, *every); err != nil {
+			return err
+		}
+	}
+	if err := state.catchUp(ctx, reader, *every); err != nil {
+		return err
+	}
+	reader.Close()
+
+	bounds, err := topicBounds(ctx, backfillTopic, -1)
+	if err != nil {
+		return err
+	}
+	var commits []kafka.OffsetCommit
+	for _, b := range bounds {
+		commits = append(commits, kafka.OffsetCommit{Partition: b.Partition, Offset: state.nextOffset(b)})
+	}
+
+	printCommits := func() {
+		for _, c := range commits {
+			fmt.Printf("   partition %d -> offset %d\n", c.Partition, c.Offset)
+		}
+	}
+
+	replaced, err := db.SwapBackfill()
+	if replaced == "" {
+		return err
+	}
+	fmt.Printf("🔀 Swapped the rebuilt table in; the previous one is kept as %s\n", replaced)
+	if err != nil {
+		// Without its schema the table must not take live writes, so the
+		// consumer is kept from resuming until the setup is fixed
+		printCommits()
+		return fmt.Errorf("%w; %s offsets were not moved: fix the cause and re-run the schema setup (any command that connects to the database does, e.g. verify), then commit the offsets above before starting the consumer", err, liveGroup)
+	}
+
+	res, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      liveGroup,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{backfillTopic: commits},
+	})
+	if err == nil {
+		for _, p := range res.Topics[backfillTopic] {
+			if p.Error != nil {
+				err = fmt.Errorf("%s[%d]: %w", backfillTopic, p.Partition, p.Error)
+				break
+			}
+		}
+	}
+	if err != nil {
+		printCommits()
+		return fmt.Errorf("table swapped but %s offsets were not moved; commit the offsets above before restarting the consumer: %w", liveGroup, err)
+	}
+
+	fmt.Printf("✅ Backfill complete; %s resumes at the rebuilt table's last event\n", liveGroup)
+	return nil
+}
+
+// catchUp reads until every partition has been read up to its end offset,
+// reporting progress every interval.
+func (s *backfillState) catchUp(ctx context.Context, reader *kafka.Reader, every time.Duration) error {
+	for {
+		bounds, err := topicBounds(ctx, backfillTopic, -1)
+		if err != nil {
+			return err
+		}
+		if s.caughtUp(bounds) {
+			s.report(bounds)
+			return nil
+		}
+
+		deadline := time.Now().Add(every)
+		for !s.caughtUp(bounds) {
+			fetchCtx, cancel := context.WithDeadline(ctx, deadline)
+			m, err := reader.FetchMessage(fetchCtx)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := s.apply(m); err != nil {
+				return err
+			}
+		}
+		s.report(bounds)
+	}
+}
+
+// apply writes one message to the shadow table the way the consumer writes
+// it to the live one.
+func (s *backfillState) apply(m kafka.Message) error {
+	s.next[m.Partition] = m.Offset + 1
+
+	env, e, err := consumer.DecodeEvent(m)
+	if err != nil {
+		s.rejected++
+		return nil
+	}
+	if e.EventType == "SNAPSHOT_TRIGGER" {
+		s.skipped++
+		return nil
+	}
+
+	err = db.InsertBackfillLog(
+		e.EventType,
+		e.Payload.Entity,
+		e.Payload.EntityId,
+		e.GroupID(),
+		e.Payload.GroupName,
+		e.TaskID(),
+		e.Payload.TaskName,
+		e.Payload.Changes,
+		e.Payload.User,
+		e.Payload.Workspace,
+		e.Payload.EventData(),
+		e.Time(m),
+	)
+	if err != nil {
+		return fmt.Errorf("insert of event %s failed: %w", env.EventID, err)
+	}
+	s.inserted++
+	return nil
+}
+
+// nextOffset is the next offset to read from the partition; partitions not
+// read from yet start at their first offset.
+func (s *backfillState) nextOffset(b partitionBounds) int64 {
+	if next, ok := s.next[b.Partition]; ok {
+		return next
+	}
+	return b.First
+}
+
+func (s *backfillState) caughtUp(bounds []partitionBounds) bool {
+	for _, b := range bounds {
+		if s.nextOffset(b) < b.End {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *backfillState) report(bounds []partitionBounds) {
+	var read, total int64
+	for _, b := range bounds {
+		read += s.nextOffset(b) - b.First
+		total += b.End - b.First
+	}
+	percent := 100.0
+	if total > 0 {
+		percent = float64(read) * 100 / float64(total)
+	}
+	rate := float64(read) / time.Since(s.started).Seconds()
+
+	fmt.Printf("📥 %d/%d messages (%.1f%%): %d inserted, %d skipped, %d rejected, %.0f msg/s\n",
+		read, total, percent, s.inserted, s.skipped, s.rejected, rate)
+}
+
+// printParity prints the event counts of the live and rebuilt tables and
+// reports whether the rebuilt table has fewer events of any kind.
+func printParity() (bool, error) {
+	parity, err := db.BackfillParity()
+	if err != nil {
+		return false, err
+	}
+
+	short := false
+	var live, backfill int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKSPACE\tEVENT TYPE\tLIVE\tBACKFILL\tDIFF")
+	for _, p := range parity {
+		if p.Backfill < p.Live {
+			short = true
+		}
+		live += p.Live
+		backfill += p.Backfill
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%+d\n", p.Workspace, p.EventType, p.Live, p.Backfill, p.Backfill-p.Live)
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\t%d\t%+d\n", live, backfill, backfill-live)
+	return short, w.Flush()
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"todo-consumer/db"
+	"todo-consumer/export"
+)
+
+const exportUsage = "export [-workspace <name>] [-group <id>] [-task <id>] [-user <name>] [-event-type <a,b>] [-from <RFC3339>] [-to <RFC3339>] [-format csv|ndjson|parquet] [-gzip] [-o <file> | -s3]"
+
+// runExport writes the event history matching the filters, oldest first, to
+// stdout, a file or the S3 bucket.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	workspace := fs.String("workspace", defaultWorkspace, "workspace to export")
+	group := fs.String("group", "", "only events of this group (and its tasks)")
+	task := fs.String("task", "", "only events of this task")
+	user := fs.String("user", "", "only events by this user")
+	eventTypes := fs.String("event-type", "", "comma separated event types")
+	from := fs.String("from", "", "events at or after this RFC3339 timestamp")
+	to := fs.String("to", "", "events before this RFC3339 timestamp")
+	format := fs.String("format", export.CSV, "csv, ndjson or parquet")
+	gzip := fs.Bool("gzip", false, "gzip the output (csv and ndjson)")
+	output := fs.String("o", "-", "output file, - for stdout")
+	toS3 := fs.Bool("s3", false, "upload to s3://$S3_BUCKET_NAME/exports/ instead of writing locally")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: %s", exportUsage)
+	}
+
+	opts := export.Options{Format: *format, Gzip: *gzip}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	q := db.NewLogQuery(*workspace).Group(*group).Task(*task).User(*user).Ascending()
+	if *eventTypes != "" {
+		q.EventTypes(strings.Split(*eventTypes, ",")...)
+	}
+	if *from != "" {
+		t, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		q.Since(t)
+	}
+	if *to != "" {
+		t, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+		q.Until(t)
+	}
+
+	if err := connectDB(); err != nil {
+		return err
+	}
+
+	if *toS3 {
+		name := fmt.Sprintf("%s_%s", *workspace, time.Now().UTC().Format("20060102T150405Z"))
+		uri, n, err := export.Upload(q, opts, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "📤 Exported %d rows -> %s\n", n, uri)
+		return nil
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	buffered := bufio.NewWriter(out)
+	n, err := export.Write(buffered, q, opts)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if *output != "-" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "📤 Exported %d rows\n", n)
+	return nil
+}
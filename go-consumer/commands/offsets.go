@@ -0,0 +1,462 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/producer"
+	"todo-consumer/topics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const offsetsUsage = "offsets lag -group <group> | offsets reset -group <group> -to earliest|latest [-partition <n>] [-dry-run] | offsets seek -group <group> -time <RFC3339> [-partition <n>] [-dry-run] | offsets replay -group <group> -partition <n> -from <offset> -to <offset> [-o <file> | -topic <sink>]"
+
+// replayIdleTimeout is how long replay waits for the next message of its
+// range. Offsets below the partition end can hold no message (compacted
+// away, or transaction markers), so a range ending in such offsets is only
+// known to be exhausted when nothing more arrives.
+const replayIdleTimeout = 10 * time.Second
+
+// groupTopics lists the consumer groups the offsets command manages and the
+// topic each one consumes.
+var groupTopics = map[string]string{
+	"todo-consumer-group-go":   "todo-history-events",
+	"snapshot-processor-group": "todo-snapshots",
+}
+
+// runOffsets inspects and moves consumer group offsets, or replays a range
+// of a group's topic into a separate sink.
+func runOffsets(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", offsetsUsage)
+	}
+
+	switch args[0] {
+	case "lag":
+		return runOffsetsLag(args[1:])
+	case "reset":
+		return runOffsetsMove("reset", args[1:])
+	case "seek":
+		return runOffsetsMove("seek", args[1:])
+	case "replay":
+		return runOffsetsReplay(args[1:])
+	default:
+		return fmt.Errorf("unknown offsets command %q\nusage: %s", args[0], offsetsUsage)
+	}
+}
+
+// groupTopic validates a -group flag and returns the topic it consumes.
+func groupTopic(group string) (string, error) {
+	topic, ok := groupTopics[group]
+	if !ok {
+		return "", fmt.Errorf("-group must be todo-consumer-group-go or snapshot-processor-group")
+	}
+	return topic, nil
+}
+
+// partitionBounds is the first and next (end) offset of a partition.
+type partitionBounds struct {
+	Partition int
+	First     int64
+	End       int64
+}
+
+// topicBounds returns the offset range of every partition of topic, or only
+// of partition when it is not -1.
+func topicBounds(ctx context.Context, topic string, partition int) ([]partitionBounds, error) {
+	cfg, err := kafkaclient.Load()
+	if err != nil {
+		return nil, err
+	}
+	dialer := cfg.Dialer()
+
+	found, err := dialer.LookupPartitions(ctx, "tcp", cfg.Brokers[0], topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions of %s: %w", topic, err)
+	}
+
+	var bounds []partitionBounds
+	for _, p := range found {
+		if partition != -1 && p.ID != partition {
+			continue
+		}
+		conn, err := dialer.DialLeader(ctx, "tcp", cfg.Brokers[0], topic, p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach leader of %s[%d]: %w", topic, p.ID, err)
+		}
+		first, end, err := conn.ReadOffsets()
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, partitionBounds{Partition: p.ID, First: first, End: end})
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("%s has no partition %d", topic, partition)
+	}
+
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Partition < bounds[j].Partition })
+	return bounds, nil
+}
+
+// committedOffsets returns the group's committed offset per partition; -1
+// means nothing is committed.
+func committedOffsets(ctx context.Context, client *kafka.Client, group, topic string, bounds []partitionBounds) (map[int]int64, error) {
+	partitions := make([]int, len(bounds))
+	for i, b := range bounds {
+		partitions[i] = b.Partition
+	}
+
+	res, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: group,
+		Topics:  map[string][]int{topic: partitions},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	committed := map[int]int64{}
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return nil, p.Error
+		}
+		committed[p.Partition] = p.CommittedOffset
+	}
+	return committed, nil
+}
+
+// ensureGroupInactive refuses to touch offsets a running consumer would
+// overwrite with its next commit.
+func ensureGroupInactive(ctx context.Context, client *kafka.Client, group string) error {
+	res, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return err
+	}
+	for _, g := range res.Groups {
+		if g.Error != nil {
+			return g.Error
+		}
+		if len(g.Members) > 0 {
+			return fmt.Errorf("group %s has %d active members (state %s); stop its consumers first", group, len(g.Members), g.GroupState)
+		}
+	}
+	return nil
+}
+
+func runOffsetsLag(args []string) error {
+	fs := flag.NewFlagSet("offsets lag", flag.ContinueOnError)
+	group := fs.String("group", "", "consumer group")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	topic, err := groupTopic(*group)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := kafkaclient.NewClient()
+	if err != nil {
+		return err
+	}
+	bounds, err := topicBounds(ctx, topic, -1)
+	if err != nil {
+		return err
+	}
+	committed, err := committedOffsets(ctx, client, *group, topic, bounds)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s (%s)\n", *group, topic)
+	fmt.Fprintln(w, "PARTITION\tCOMMITTED\tEARLIEST\tLATEST\tLAG")
+	var total int64
+	for _, b := range bounds {
+		offset, ok := committed[b.Partition]
+		shown := fmt.Sprint(offset)
+		if !ok || offset < 0 {
+			// Nothing committed: the group would start from the beginning
+			offset, shown = b.First, "-"
+		}
+		lag := b.End - offset
+		total += lag
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\n", b.Partition, shown, b.First, b.End, lag)
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t\t%d\n", total)
+	return w.Flush()
+}
+
+// runOffsetsMove commits new offsets for the group: the earliest or latest
+// offset for "reset", or the first offset at or after -time for "seek".
+func runOffsetsMove(name string, args []string) error {
+	fs := flag.NewFlagSet("offsets "+name, flag.ContinueOnError)
+	group := fs.String("group", "", "consumer group")
+	partition := fs.Int("partition", -1, "only this partition (default all)")
+	dryRun := fs.Bool("dry-run", false, "print the new offsets without committing them")
+	to := fs.String("to", "", "earliest or latest (reset)")
+	at := fs.String("time", "", "RFC3339 timestamp to seek to (seek)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	topic, err := groupTopic(*group)
+	if err != nil {
+		return err
+	}
+
+	var seekTime time.Time
+	switch name {
+	case "reset":
+		if *to != "earliest" && *to != "latest" {
+			return fmt.Errorf("-to must be earliest or latest")
+		}
+	case "seek":
+		seekTime, err = time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -time: %w", err)
+		}
+	}
+
+	ctx := context.Background()
+	client, err := kafkaclient.NewClient()
+	if err != nil {
+		return err
+	}
+	if err := ensureGroupInactive(ctx, client, *group); err != nil {
+		return err
+	}
+	bounds, err := topicBounds(ctx, topic, *partition)
+	if err != nil {
+		return err
+	}
+	committed, err := committedOffsets(ctx, client, *group, topic, bounds)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := kafkaclient.Load()
+	if err != nil {
+		return err
+	}
+
+	var commits []kafka.OffsetCommit
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tFROM\tTO")
+	for _, b := range bounds {
+		var offset int64
+		switch {
+		case name == "seek":
+			conn, err := cfg.Dialer().DialLeader(ctx, "tcp", cfg.Brokers[0], topic, b.Partition)
+			if err != nil {
+				return err
+			}
+			offset, err = conn.ReadOffset(seekTime)
+			conn.Close()
+			if err != nil {
+				return fmt.Errorf("failed to find offset of %s[%d] at %s: %w", topic, b.Partition, *at, err)
+			}
+			if offset < 0 {
+				// Nothing at or after -time yet: continue with new messages
+				offset = b.End
+			}
+		case *to == "earliest":
+			offset = b.First
+		default:
+			offset = b.End
+		}
+
+		previous := "-"
+		if c, ok := committed[b.Partition]; ok && c >= 0 {
+			previous = fmt.Sprint(c)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\n", b.Partition, previous, offset)
+		commits = append(commits, kafka.OffsetCommit{Partition: b.Partition, Offset: offset})
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Println("Dry run: offsets not committed")
+		return nil
+	}
+
+	// Generation -1 with no member is an admin commit, accepted only while
+	// the group is empty (checked above)
+	res, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      *group,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{topic: commits},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return fmt.Errorf("failed to commit %s[%d]: %w", topic, p.Partition, p.Error)
+		}
+	}
+
+	fmt.Printf("✅ Committed %d offsets for %s\n", len(commits), *group)
+	return nil
+}
+
+// replayedMessage is one line of a replay written to a file.
+type replayedMessage struct {
+	Topic     string            `json:"topic"`
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Time      time.Time         `json:"time"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Value     json.RawMessage   `json:"value,omitempty"`
+	RawValue  []byte            `json:"rawValue,omitempty"` // base64, when the value is not JSON
+}
+
+// runOffsetsReplay copies offsets [-from, -to) of one partition to an NDJSON
+// file or another topic. It reads outside the group, so committed offsets
+// are untouched and the group may keep running.
+func runOffsetsReplay(args []string) error {
+	fs := flag.NewFlagSet("offsets replay", flag.ContinueOnError)
+	group := fs.String("group", "", "consumer group whose topic is replayed")
+	partition := fs.Int("partition", -1, "partition to replay")
+	from := fs.Int64("from", -1, "first offset to replay")
+	to := fs.Int64("to", -1, "offset to stop before")
+	output := fs.String("o", "-", "NDJSON output file, - for stdout")
+	sink := fs.String("topic", "", "republish to this topic instead of writing NDJSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	topic, err := groupTopic(*group)
+	if err != nil {
+		return err
+	}
+	if *partition < 0 || *from < 0 || *to <= *from {
+		return fmt.Errorf("usage: offsets replay -group <group> -partition <n> -from <offset> -to <offset> [-o <file> | -topic <sink>]")
+	}
+	if *sink == topic {
+		return fmt.Errorf("-topic must be a separate sink, not %s itself", topic)
+	}
+
+	ctx := context.Background()
+	bounds, err := topicBounds(ctx, topic, *partition)
+	if err != nil {
+		return err
+	}
+	b := bounds[0]
+	if *from < b.First || *to > b.End {
+		return fmt.Errorf("range [%d, %d) is outside %s[%d], which holds [%d, %d)", *from, *to, topic, b.Partition, b.First, b.End)
+	}
+
+	var write func(m kafka.Message) error
+	var done func() error
+	if *sink != "" {
+		if err := producer.Init(); err != nil {
+			return err
+		}
+		write = func(m kafka.Message) error {
+			_, err := producer.Default.Publish(ctx, kafka.Message{Topic: *sink, Key: m.Key, Value: m.Value, Headers: m.Headers})
+			return err
+		}
+		done = producer.Close
+	} else {
+		var out io.Writer = os.Stdout
+		var file *os.File
+		if *output != "-" {
+			if file, err = os.Create(*output); err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		buffered := bufio.NewWriter(out)
+		encoder := json.NewEncoder(buffered)
+		write = func(m kafka.Message) error {
+			return encoder.Encode(newReplayedMessage(m))
+		}
+		done = func() error {
+			if err := buffered.Flush(); err != nil {
+				return err
+			}
+			if file != nil {
+				return file.Close()
+			}
+			return nil
+		}
+	}
+
+	maxBytes, err := topics.MaxMessageBytes(topic)
+	if err != nil {
+		return err
+	}
+	reader, err := kafkaclient.NewPartitionReader(topic, *partition, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := reader.SetOffset(*from); err != nil {
+		return err
+	}
+
+	var n int
+	for reader.Offset() < *to {
+		readCtx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		m, err := reader.ReadMessage(readCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "⚠️ No message at offsets [%d, %d) after %s, assuming none are left\n", reader.Offset(), *to, replayIdleTimeout)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if m.Offset >= *to {
+			break
+		}
+		if err := write(m); err != nil {
+			return fmt.Errorf("replay failed at offset %d: %w", m.Offset, err)
+		}
+		n++
+	}
+	if err := done(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "🔁 Replayed %d messages from %s[%d] offsets [%d, %d)\n", n, topic, *partition, *from, *to)
+	return nil
+}
+
+func newReplayedMessage(m kafka.Message) replayedMessage {
+	r := replayedMessage{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Time:      m.Time.UTC(),
+		Key:       string(m.Key),
+	}
+	if len(m.Headers) > 0 {
+		r.Headers = map[string]string{}
+		for _, h := range m.Headers {
+			r.Headers[h.Key] = string(h.Value)
+		}
+	}
+	if json.Valid(m.Value) {
+		r.Value = m.Value
+	} else {
+		r.RawValue = m.Value
+	}
+	return r
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"todo-consumer/snapshot"
+)
+
+const snapshotUsage = "snapshot diff [-json] <a> <b> | snapshot rewrap [-from <key-id>] [-dry-run]"
+
+func runSnapshot(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", snapshotUsage)
+	}
+
+	switch args[0] {
+	case "diff":
+		return runSnapshotDiff(args[1:])
+	case "rewrap":
+		return runSnapshotRewrap(args[1:])
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+}
+
+// runSnapshotDiff compares two snapshots, each given as a snapshot ID in the
+// S3 bucket or a path to a local snapshot JSON file.
+func runSnapshotDiff(args []string) error {
+	fs := flag.NewFlagSet("snapshot diff", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the diff as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: snapshot diff [-json] <a> <b>")
+	}
+
+	from, err := loadSnapshotRef(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	to, err := loadSnapshotRef(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	report, err := snapshot.Diff(from, to)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(report)
+	}
+	fmt.Print(report.Text())
+	return nil
+}
+
+// loadSnapshotRef treats ref as a local file when it exists and as a
+// snapshot ID in the bucket otherwise.
+func loadSnapshotRef(ref string) (*snapshot.SnapshotData, error) {
+	if _, err := os.Stat(ref); err == nil {
+		return snapshot.LoadSnapshotFile(ref)
+	}
+	return snapshot.LoadSnapshot(ref)
+}
+
+// runSnapshotRewrap rotates stored snapshots to the active key of the
+// configured SNAPSHOT_ENCRYPTION provider, so a retired key can be removed
+// from the keyring. Keys being retired must stay in the keyring until it
+// has run.
+func runSnapshotRewrap(args []string) error {
+	fs := flag.NewFlagSet("snapshot rewrap", flag.ContinueOnError)
+	from := fs.String("from", "", "only rewrap snapshots wrapped with this key ID")
+	dryRun := fs.Bool("dry-run", false, "report what would be rewrapped without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: snapshot rewrap [-from <key-id>] [-dry-run]")
+	}
+
+	provider, err := snapshot.LoadKeyProvider()
+	if err != nil {
+		return err
+	}
+	if provider == nil {
+		return fmt.Errorf("SNAPSHOT_ENCRYPTION is not configured")
+	}
+
+	var rewrapped, skipped int
+	err = snapshot.RewrapStored(provider, *from, *dryRun, func(r snapshot.RewrapResult) {
+		if r.Skipped != "" {
+			skipped++
+			return
+		}
+		rewrapped++
+		fmt.Printf("🔑 %s: %s -> %s\n", r.SnapshotID, r.FromKey, r.ToKey)
+	})
+
+	verb := "Rewrapped"
+	if *dryRun {
+		verb = "Would rewrap"
+	}
+	fmt.Printf("✅ %s %d snapshots, %d left as they were\n", verb, rewrapped, skipped)
+	return err
+}
@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"todo-consumer/projection"
+)
+
+// runState prints an entity rebuilt from history, or with "check" compares
+// the projection with a snapshot taken at the same moment.
+func runState(args []string) error {
+	if len(args) > 0 && args[0] == "check" {
+		return runStateCheck(args[1:])
+	}
+
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	asOf := fs.String("as-of", "", "rebuild as of this RFC3339 timestamp (default now)")
+	workspace := fs.String("workspace", defaultWorkspace, "workspace the entity belongs to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: state [-workspace <name>] [-as-of <RFC3339>] <Group|Task|Comment> <id>")
+	}
+
+	at := time.Now().UTC()
+	if *asOf != "" {
+		parsed, err := time.Parse(time.RFC3339, *asOf)
+		if err != nil {
+			return fmt.Errorf("invalid -as-of: %w", err)
+		}
+		at = parsed
+	}
+
+	if err := connectDB(); err != nil {
+		return err
+	}
+
+	state, err := projection.Rebuild(*workspace, fs.Arg(0), fs.Arg(1), at)
+	if err != nil {
+		return err
+	}
+	return printJSON(state)
+}
+
+func runStateCheck(args []string) error {
+	fs := flag.NewFlagSet("state check", flag.ContinueOnError)
+	workspace := fs.String("workspace", "", "workspace to check (default: the snapshot's, else \""+defaultWorkspace+"\")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: state check [-workspace <name>] <snapshot>")
+	}
+
+	snap, err := loadSnapshotRef(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *workspace == "" {
+		*workspace = snap.Workspace
+	}
+	if *workspace == "" {
+		*workspace = defaultWorkspace
+	}
+	if err := connectDB(); err != nil {
+		return err
+	}
+
+	mismatches, err := projection.CheckSnapshot(*workspace, snap)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		fmt.Printf("✅ Projection matches snapshot %s\n", snap.SnapshotID)
+		return nil
+	}
+
+	if err := printJSON(mismatches); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d mismatches between projection and snapshot %s", len(mismatches), snap.SnapshotID)
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
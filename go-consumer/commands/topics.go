@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/topics"
+)
+
+const topicsUsage = "topics check | topics apply [-reconcile]"
+
+// runTopics compares the Kafka topics with their specs, and with apply
+// creates the missing ones (and with -reconcile fixes drift) like the
+// service does at startup.
+func runTopics(args []string) error {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "apply") {
+		return fmt.Errorf("usage: %s", topicsUsage)
+	}
+
+	fs := flag.NewFlagSet("topics "+args[0], flag.ContinueOnError)
+	reconcile := fs.Bool("reconcile", false, "also fix drifted configs and add missing partitions")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *reconcile && args[0] != "apply" {
+		return fmt.Errorf("-reconcile only applies to topics apply")
+	}
+
+	specs, err := topics.Specs()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client, err := kafkaclient.NewClient()
+	if err != nil {
+		return err
+	}
+	report, err := topics.Check(ctx, client, specs)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tSETTING\tSPEC\tACTUAL\tFIXABLE")
+	for _, s := range report.Missing {
+		fmt.Fprintf(w, "%s\t(topic)\t%d partitions\tmissing\tyes\n", s.Name, s.Partitions)
+	}
+	for _, d := range report.Drift {
+		fixable := "no"
+		if d.Fixable {
+			fixable = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Topic, d.Setting, d.Want, d.Have, fixable)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(report.Missing) == 0 && len(report.Drift) == 0 {
+		fmt.Println("✅ All topics match their specs")
+		return nil
+	}
+
+	if args[0] == "check" {
+		return nil
+	}
+	return topics.Apply(ctx, client, report, *reconcile)
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// aggregateViews maps a bucket interval to its continuous aggregate.
+var aggregateViews = map[string]string{
+	"hour": "activity_hourly",
+	"day":  "activity_daily",
+}
+
+// aggregateColumns are the columns added to the aggregates since they were
+// first created; views missing one are recreated.
+var aggregateColumns = []string{"workspace", "group_name", "task_name", "last_activity"}
+
+// aggregateSchema creates the continuous aggregates and refresh policies.
+// Each statement runs on its own: continuous aggregates cannot be created
+// inside the implicit transaction of a multi-statement Exec. The views are
+// real-time (materialized_only = false) so the latest bucket is always
+// complete even between refreshes. Views bypass row-level security, so
+// readers must filter on workspace themselves.
+var aggregateSchema = []string{
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS activity_hourly
+	WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT
+		time_bucket(INTERVAL '1 hour', timestamp) AS bucket,
+		workspace, group_id, group_name, task_id, task_name, user_name, event_type,
+		COUNT(*) AS event_count,
+		MAX(timestamp) AS last_activity
+	FROM todo_event_logs
+	GROUP BY bucket, workspace, group_id, group_name, task_id, task_name, user_name, event_type
+	WITH NO DATA`,
+
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS activity_daily
+	WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT
+		time_bucket(INTERVAL '1 day', timestamp) AS bucket,
+		workspace, group_id, group_name, task_id, task_name, user_name, event_type,
+		COUNT(*) AS event_count,
+		MAX(timestamp) AS last_activity
+	FROM todo_event_logs
+	GROUP BY bucket, workspace, group_id, group_name, task_id, task_name, user_name, event_type
+	WITH NO DATA`,
+
+	`SELECT add_continuous_aggregate_policy('activity_hourly',
+		start_offset => INTERVAL '3 days',
+		end_offset => INTERVAL '1 hour',
+		schedule_interval => INTERVAL '30 minutes',
+		if_not_exists => TRUE)`,
+
+	`SELECT add_continuous_aggregate_policy('activity_daily',
+		start_offset => INTERVAL '30 days',
+		end_offset => INTERVAL '1 day',
+		schedule_interval => INTERVAL '1 hour',
+		if_not_exists => TRUE)`,
+
+	`CREATE INDEX IF NOT EXISTS idx_activity_hourly_group ON activity_hourly (group_id, bucket DESC)`,
+	`CREATE INDEX IF NOT EXISTS idx_activity_daily_group ON activity_daily (group_id, bucket DESC)`,
+	`CREATE INDEX IF NOT EXISTS idx_activity_hourly_workspace ON activity_hourly (workspace, bucket DESC)`,
+	`CREATE INDEX IF NOT EXISTS idx_activity_daily_workspace ON activity_daily (workspace, bucket DESC)`,
+
+	`GRANT SELECT ON activity_hourly, activity_daily TO ` + workspaceRole,
+}
+
+// ensureAggregates creates the activity continuous aggregates if missing.
+func ensureAggregates() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Views created before a column was added (workspace, the names and
+	// last activity of the summaries) cannot be altered; drop them so they
+	// are recreated below. Real-time aggregation serves correct counts until
+	// the refresh policy catches up.
+	for _, view := range aggregateViews {
+		var stale bool
+		err := Pool.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM information_schema.views WHERE table_name = $1)
+			   AND (SELECT COUNT(*) FROM information_schema.columns
+			        WHERE table_name = $1 AND column_name = ANY($2)) < CARDINALITY($2::TEXT[])
+		`, view, aggregateColumns).Scan(&stale)
+		if err != nil {
+			return fmt.Errorf("continuous aggregate check error: %w", err)
+		}
+		if stale {
+			if _, err := Pool.Exec(ctx, "DROP MATERIALIZED VIEW "+view+" CASCADE"); err != nil {
+				return fmt.Errorf("continuous aggregate migration error: %w", err)
+			}
+			fmt.Printf("♻️ Recreating %s with columns %v\n", view, aggregateColumns)
+		}
+	}
+
+	for _, stmt := range aggregateSchema {
+		if _, err := Pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("continuous aggregate setup error: %w", err)
+		}
+	}
+
+	fmt.Println("📊 Activity continuous aggregates verified (activity_hourly, activity_daily)")
+	return nil
+}
+
+// ActivityFilter selects the slice of activity to return. Empty fields are
+// not filtered on.
+type ActivityFilter struct {
+	Interval  string // "hour" or "day"
+	Workspace string // required
+	GroupID   string
+	TaskID    string
+	User      string
+	From      time.Time
+	To        time.Time
+
+	// By breaks each bucket down by "group", "task", "user" or "eventType";
+	// empty returns one total per bucket.
+	By string
+}
+
+// ActivityPoint is the event count in one time bucket, optionally for one
+// key of the breakdown dimension.
+type ActivityPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Key    string    `json:"key,omitempty"`
+	Count  int64     `json:"count"`
+}
+
+// breakdownColumns maps ActivityFilter.By to an aggregate column.
+var breakdownColumns = map[string]string{
+	"":          "''",
+	"group":     "COALESCE(group_id, '')",
+	"task":      "COALESCE(task_id, '')",
+	"user":      "COALESCE(user_name, '')",
+	"eventType": "event_type",
+}
+
+// GetActivitySeries returns time-bucketed event counts of a workspace from
+// the continuous aggregates, oldest bucket first.
+func GetActivitySeries(filter ActivityFilter) ([]ActivityPoint, error) {
+	if filter.Interval == "" {
+		filter.Interval = "hour"
+	}
+	view, ok := aggregateViews[filter.Interval]
+	if !ok {
+		return []ActivityPoint{}, fmt.Errorf("unsupported activity interval %q", filter.Interval)
+	}
+	key, ok := breakdownColumns[filter.By]
+	if !ok {
+		return []ActivityPoint{}, fmt.Errorf("unsupported activity breakdown %q", filter.By)
+	}
+
+	if filter.To.IsZero() {
+		filter.To = time.Now().UTC()
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-7 * 24 * time.Hour)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT bucket, %s AS key, SUM(event_count)::BIGINT AS count
+		FROM %s
+		WHERE workspace = $1 AND bucket >= $2 AND bucket < $3
+		  AND ($4 = '' OR group_id = $4)
+		  AND ($5 = '' OR task_id = $5)
+		  AND ($6 = '' OR user_name = $6)
+		GROUP BY bucket, key
+		ORDER BY bucket ASC, count DESC
+	`, key, view)
+
+	series := []ActivityPoint{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, filter.Workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, filter.Workspace,
+			filter.From.UTC(), filter.To.UTC(), filter.GroupID, filter.TaskID, filter.User)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var p ActivityPoint
+			if err := rows.Scan(&p.Bucket, &p.Key, &p.Count); err != nil {
+				return err
+			}
+			series = append(series, p)
+		}
+		return rows.Err()
+	})
+	return series, err
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// backfillTables are the shadow tables a backfill rebuilds history into.
+var backfillTables = chainTables{logs: "todo_event_logs_backfill", heads: "log_chain_heads_backfill"}
+
+// carriedEventTypes are logged by this service rather than consumed from
+// Kafka, so a backfill cannot rebuild them; they are copied from the live
+// table when the shadow table is swapped in.
+var carriedEventTypes = []string{"SNAPSHOT_CREATED"}
+
+// backfillIndexSuffix marks the indexes built on the shadow table under a
+// temporary name; the live table still owns the real names until the swap.
+const backfillIndexSuffix = "_backfill"
+
+// PrepareBackfill (re)creates the empty shadow tables. The shadow event log
+// is a hypertable with the live table's columns and primary key; its
+// secondary indexes are only built by BuildBackfillIndexes, once most rows
+// are in, so inserts stay fast.
+func PrepareBackfill() error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := Pool.Exec(ctx, `
+DROP TABLE IF EXISTS `+backfillTables.logs+`;
+DROP TABLE IF EXISTS `+backfillTables.heads+`;
+
+CREATE TABLE `+backfillTables.logs+` (
+  LIKE `+liveTables.logs+` INCLUDING DEFAULTS INCLUDING CONSTRAINTS,
+  PRIMARY KEY (timestamp, id)
+);
+
+SELECT create_hypertable('`+backfillTables.logs+`', 'timestamp',
+  chunk_time_interval => INTERVAL '1 day',
+  create_default_indexes => FALSE
+);
+
+CREATE TABLE `+backfillTables.heads+` (LIKE `+liveTables.heads+` INCLUDING ALL);
+
+GRANT SELECT, INSERT ON `+backfillTables.logs+` TO `+workspaceRole+`;
+GRANT SELECT, INSERT, UPDATE ON `+backfillTables.heads+` TO `+workspaceRole+`;
+`)
+	if err != nil {
+		return fmt.Errorf("backfill table setup error: %w", err)
+	}
+	return nil
+}
+
+// InsertBackfillLog appends an event to the shadow tables, scoped to its
+// workspace and chained exactly like InsertLog.
+func InsertBackfillLog(eventType, entity, entityId, groupId, groupName, taskId, taskName, changes, user, workspace string, eventData []byte, timestamp time.Time) error {
+	ctx := context.Background()
+	return inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		return insertChained(ctx, tx, backfillTables,
+			eventType, entity, entityId,
+			groupId, groupName, taskId, taskName,
+			changes, user, workspace, eventData, timestamp,
+		)
+	})
+}
+
+// liveIndexes returns the name and definition of every secondary index of
+// the live event log.
+func liveIndexes(ctx context.Context, q interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}) (map[string]string, error) {
+	rows, err := q.Query(ctx, `
+		SELECT i.relname, pg_get_indexdef(i.oid)
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		WHERE x.indrelid = $1::regclass AND NOT x.indisprimary
+	`, liveTables.logs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := map[string]string{}
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			return nil, err
+		}
+		indexes[name] = def
+	}
+	return indexes, rows.Err()
+}
+
+// BuildBackfillIndexes builds the live table's secondary indexes on the
+// shadow table under temporary names. Inserts into the shadow table wait
+// while an index is built.
+func BuildBackfillIndexes() error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	ctx := context.Background()
+	indexes, err := liveIndexes(ctx, Pool)
+	if err != nil {
+		return fmt.Errorf("index lookup error: %w", err)
+	}
+
+	for name, def := range indexes {
+		// CREATE INDEX name ON table USING method (...): keep the method
+		// and columns, point it at the shadow table
+		_, rest, ok := strings.Cut(def, " USING ")
+		if !ok {
+			return fmt.Errorf("unexpected definition of index %s: %s", name, def)
+		}
+		stmt := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING %s", name+backfillIndexSuffix, backfillTables.logs, rest)
+		if _, err := Pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("index %s build error: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ParityCount compares the number of events of one type in a workspace
+// between the live and the shadow table.
+type ParityCount struct {
+	Workspace string `json:"workspace"`
+	EventType string `json:"eventType"`
+	Live      int64  `json:"live"`
+	Backfill  int64  `json:"backfill"`
+}
+
+// BackfillParity counts the events of the live and shadow tables per
+// workspace and event type. Carried event types are left out: the shadow
+// table only receives them at the swap. Like the archiver's functions it
+// reads across tenants and is meant for the CLI, not for the API.
+func BackfillParity() ([]ParityCount, error) {
+	if Pool == nil {
+		return []ParityCount{}, fmt.Errorf("database not connected")
+	}
+
+	counts := func(table string) string {
+		return `SELECT COALESCE(workspace, '') AS workspace, event_type, COUNT(*) AS n
+			FROM ` + table + `
+			WHERE event_type <> ALL($1)
+			GROUP BY 1, 2`
+	}
+	rows, err := Pool.Query(context.Background(), `
+		SELECT COALESCE(l.workspace, b.workspace), COALESCE(l.event_type, b.event_type),
+		       COALESCE(l.n, 0), COALESCE(b.n, 0)
+		FROM (`+counts(liveTables.logs)+`) l
+		FULL JOIN (`+counts(backfillTables.logs)+`) b
+		  ON b.workspace = l.workspace AND b.event_type = l.event_type
+		ORDER BY 1, 2
+	`, carriedEventTypes)
+	if err != nil {
+		return []ParityCount{}, err
+	}
+	defer rows.Close()
+
+	parity := []ParityCount{}
+	for rows.Next() {
+		var p ParityCount
+		if err := rows.Scan(&p.Workspace, &p.EventType, &p.Live, &p.Backfill); err != nil {
+			return parity, err
+		}
+		parity = append(parity, p)
+	}
+	return parity, rows.Err()
+}
+
+// SwapBackfill atomically replaces the live tables with the shadow tables
+// and returns the name the old event log was kept under. In one
+// transaction, with the live tables locked against inserts, it copies the
+// carried events over, records the rebuilt chains as a new epoch (so anchors
+// of the replaced chains still verify), moves the index names to the shadow
+// table, renames the tables, puts the new event log under row-level
+// security and the isolation policy, and drops the continuous aggregates
+// built on the old event log. The schema is then verified again, which
+// recreates the aggregates and the compression and retention policies on
+// the new table; when that fails the swap has happened but the service must
+// not start until it is fixed.
+func SwapBackfill() (string, error) {
+	if Pool == nil {
+		return "", fmt.Errorf("database not connected")
+	}
+
+	ctx := context.Background()
+	suffix := "_replaced_" + time.Now().UTC().Format("20060102150405")
+	replaced := liveTables.logs + suffix
+
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "LOCK TABLE "+liveTables.logs+", "+liveTables.heads+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+		return "", fmt.Errorf("lock error: %w", err)
+	}
+
+	if err := carryEvents(ctx, tx); err != nil {
+		return "", fmt.Errorf("carry events error: %w", err)
+	}
+
+	// Taken once the lock is held, so every head of the replaced chains was
+	// last updated before it
+	var rebasedAt time.Time
+	if err := tx.QueryRow(ctx, `SELECT clock_timestamp()`).Scan(&rebasedAt); err != nil {
+		return "", err
+	}
+	if err := recordRebase(ctx, tx, replaced, rebasedAt); err != nil {
+		return "", fmt.Errorf("chain rebase record error: %w", err)
+	}
+
+	indexes, err := liveIndexes(ctx, tx)
+	if err != nil {
+		return "", fmt.Errorf("index lookup error: %w", err)
+	}
+	var stmts []string
+	for name := range indexes {
+		stmts = append(stmts, "ALTER INDEX "+name+" RENAME TO "+name+suffix)
+		stmts = append(stmts, "ALTER INDEX IF EXISTS "+name+backfillIndexSuffix+" RENAME TO "+name)
+	}
+	stmts = append(stmts,
+		"ALTER TABLE "+liveTables.logs+" RENAME TO "+replaced,
+		"ALTER TABLE "+liveTables.heads+" RENAME TO "+liveTables.heads+suffix,
+		"ALTER TABLE "+backfillTables.logs+" RENAME TO "+liveTables.logs,
+		"ALTER TABLE "+backfillTables.heads+" RENAME TO "+liveTables.heads,
+		// The id sequence is shared; keep it when the old table is dropped
+		"ALTER SEQUENCE "+liveTables.logs+"_id_seq OWNED BY "+liveTables.logs+".id",
+		// Isolation must hold from the moment the table is visible
+		rowSecurityStatement(LoadPolicyConfig().RowSecurity),
+		isolationPolicy,
+	)
+	for _, view := range aggregateViews {
+		stmts = append(stmts, "DROP MATERIALIZED VIEW IF EXISTS "+view+" CASCADE")
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return "", fmt.Errorf("swap error (%s): %w", stmt, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("swap commit error: %w", err)
+	}
+
+	if err := ensureSchema(); err != nil {
+		return replaced, fmt.Errorf("schema setup after swap failed: %w", err)
+	}
+	return replaced, nil
+}
+
+// carryEvents appends the live table's carried events to the shadow chains
+// in the order they were logged.
+func carryEvents(ctx context.Context, tx pgx.Tx) error {
+	type carried struct {
+		eventType, entity, entityId, groupId, groupName, taskId, taskName string
+		changes, user, workspace                                          string
+		eventData                                                         []byte
+		timestamp                                                         time.Time
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT event_type, entity, entity_id,
+		       COALESCE(group_id, ''), COALESCE(group_name, ''),
+		       COALESCE(task_id, ''), COALESCE(task_name, ''),
+		       COALESCE(changes, ''), COALESCE(user_name, ''), COALESCE(workspace, ''),
+		       event_data, timestamp
+		FROM `+liveTables.logs+`
+		WHERE event_type = ANY($1)
+		ORDER BY timestamp, id
+	`, carriedEventTypes)
+	if err != nil {
+		return err
+	}
+	var events []carried
+	for rows.Next() {
+		var c carried
+		if err := rows.Scan(&c.eventType, &c.entity, &c.entityId,
+			&c.groupId, &c.groupName, &c.taskId, &c.taskName,
+			&c.changes, &c.user, &c.workspace, &c.eventData, &c.timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range events {
+		if err := insertChained(ctx, tx, backfillTables,
+			c.eventType, c.entity, c.entityId,
+			c.groupId, c.groupName, c.taskId, c.taskName,
+			c.changes, c.user, c.workspace, c.eventData, c.timestamp,
+		); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("📋 Carried %d bookkeeping events into the rebuilt history\n", len(events))
+	return nil
+}
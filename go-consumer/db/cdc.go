@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// cdcSchema stores the MongoDB change stream resume token of each CDC
+// stream, so the ingester continues where it stopped after a restart.
+const cdcSchema = `
+CREATE TABLE IF NOT EXISTS cdc_resume_tokens (
+  stream VARCHAR(100) PRIMARY KEY,
+  token BYTEA NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+`
+
+// GetResumeToken returns the last resume token saved for stream, or nil if
+// the stream has never run.
+func GetResumeToken(stream string) ([]byte, error) {
+	if Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	var token []byte
+	err := Pool.QueryRow(context.Background(),
+		`SELECT token FROM cdc_resume_tokens WHERE stream = $1`, stream).Scan(&token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return token, err
+}
+
+// SaveResumeToken records the token of the last change of stream that was
+// fully handled.
+func SaveResumeToken(stream string, token []byte) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	_, err := Pool.Exec(context.Background(), `
+		INSERT INTO cdc_resume_tokens (stream, token, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (stream) DO UPDATE SET token = EXCLUDED.token, updated_at = NOW()
+	`, stream, token)
+	return err
+}
+
+// EntityWorkspace returns the workspace of the most recent event logged for
+// an entity, or "" when none is logged outside the system workspace. MongoDB
+// documents do not record their tenant, so this is where the CDC ingester
+// learns it. Like ListWorkspaces it reads across tenants.
+func EntityWorkspace(ctx context.Context, entity, entityID string) (string, error) {
+	if Pool == nil {
+		return "", fmt.Errorf("database not connected")
+	}
+
+	var workspace string
+	err := Pool.QueryRow(ctx, `
+		SELECT workspace
+		FROM todo_event_logs
+		WHERE entity = $1 AND entity_id = $2
+		  AND workspace IS NOT NULL AND workspace NOT IN ('', $3)
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`, entity, entityID, SystemWorkspace).Scan(&workspace)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return workspace, err
+}
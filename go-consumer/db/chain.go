@@ -0,0 +1,418 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// chainSchema adds the tamper-evident hash chain. Each workspace's events
+// form one chain in insertion order: chain_seq numbers the links, prev_hash
+// is the row_hash of the link before and row_hash covers the row content
+// plus prev_hash. log_chain_heads holds the latest link of every chain so
+// inserts find it without scanning the hypertable, and serialises them.
+// log_chain_epochs records every rebuild of the chains by a backfill swap:
+// the head each chain had when it was replaced, the table its links were
+// kept in, and the head of the rebuilt chain.
+const chainSchema = `
+ALTER TABLE todo_event_logs ADD COLUMN IF NOT EXISTS chain_seq BIGINT;
+ALTER TABLE todo_event_logs ADD COLUMN IF NOT EXISTS prev_hash TEXT;
+ALTER TABLE todo_event_logs ADD COLUMN IF NOT EXISTS row_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_chain ON todo_event_logs (workspace, chain_seq);
+
+CREATE TABLE IF NOT EXISTS log_chain_heads (
+  workspace VARCHAR(100) PRIMARY KEY,
+  seq BIGINT NOT NULL DEFAULT 0,
+  head_hash TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+GRANT SELECT, INSERT, UPDATE ON log_chain_heads TO ` + workspaceRole + `;
+
+CREATE TABLE IF NOT EXISTS log_chain_epochs (
+  workspace VARCHAR(100) NOT NULL,
+  rebased_at TIMESTAMPTZ NOT NULL,
+  replaced_table TEXT NOT NULL,
+  prev_seq BIGINT NOT NULL,
+  prev_hash TEXT NOT NULL,
+  seq BIGINT NOT NULL,
+  head_hash TEXT NOT NULL,
+  PRIMARY KEY (workspace, rebased_at)
+);
+
+GRANT SELECT ON log_chain_epochs TO ` + workspaceRole + `;
+`
+
+// chainDigest is the SQL expression hashing a link of table alias t. It is
+// computed by Postgres both when a row is inserted and when it is verified,
+// so the stored (normalised) JSONB and timestamp are hashed, not whatever
+// the producer sent.
+func chainDigest(t string) string {
+	return fmt.Sprintf(`encode(sha256(convert_to(jsonb_build_array(
+		%[1]s.prev_hash, %[1]s.chain_seq, %[1]s.workspace,
+		%[1]s.event_type, %[1]s.entity, %[1]s.entity_id,
+		%[1]s.group_id, %[1]s.group_name, %[1]s.task_id, %[1]s.task_name,
+		%[1]s.changes, %[1]s.user_name, %[1]s.event_data,
+		(EXTRACT(EPOCH FROM %[1]s.timestamp) * 1000000)::bigint
+	)::text, 'UTF8')), 'hex')`, t)
+}
+
+// ChainHead is the latest link of a workspace's chain.
+type ChainHead struct {
+	Workspace string    `json:"workspace"`
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// chainTables names an event log table and the chain heads kept for it.
+type chainTables struct {
+	logs  string
+	heads string
+}
+
+// liveTables are the tables the consumer writes to; a backfill writes to
+// its shadow copies (backfillTables) until they are swapped in.
+var liveTables = chainTables{logs: "todo_event_logs", heads: "log_chain_heads"}
+
+// insertChained appends an event to its workspace's chain inside tx. The
+// head row is locked for the rest of the transaction, so concurrent inserts
+// into one workspace are linked one after another.
+func insertChained(ctx context.Context, tx pgx.Tx, tables chainTables, eventType, entity, entityId, groupId, groupName, taskId, taskName, changes, user, workspace string, eventData []byte, timestamp time.Time) error {
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO `+tables.heads+` (workspace) VALUES ($1) ON CONFLICT (workspace) DO NOTHING`,
+		workspace); err != nil {
+		return fmt.Errorf("chain head error: %w", err)
+	}
+
+	var seq int64
+	var prevHash string
+	if err := tx.QueryRow(ctx,
+		`SELECT seq, head_hash FROM `+tables.heads+` WHERE workspace = $1 FOR UPDATE`,
+		workspace).Scan(&seq, &prevHash); err != nil {
+		return fmt.Errorf("chain head error: %w", err)
+	}
+	seq++
+
+	query := `
+		INSERT INTO ` + tables.logs + ` (
+			event_type, entity, entity_id,
+			group_id, group_name, task_id, task_name,
+			changes, user_name, workspace, event_data, timestamp,
+			chain_seq, prev_hash, row_hash
+		)
+		SELECT l.*, ` + chainDigest("l") + `
+		FROM (VALUES (
+			$1::varchar, $2::varchar, $3::varchar,
+			$4::varchar, $5::varchar, $6::varchar, $7::varchar,
+			$8::text, $9::varchar, $10::varchar, $11::jsonb, $12::timestamptz,
+			$13::bigint, $14::text
+		)) AS l (
+			event_type, entity, entity_id,
+			group_id, group_name, task_id, task_name,
+			changes, user_name, workspace, event_data, timestamp,
+			chain_seq, prev_hash
+		)
+		RETURNING row_hash
+	`
+
+	var rowHash string
+	if err := tx.QueryRow(ctx, query,
+		eventType, entity, entityId,
+		groupId, groupName, taskId, taskName,
+		changes, user, workspace, eventData, timestamp.UTC(),
+		seq, prevHash,
+	).Scan(&rowHash); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(ctx,
+		`UPDATE `+tables.heads+` SET seq = $2, head_hash = $3, updated_at = NOW() WHERE workspace = $1`,
+		workspace, seq, rowHash)
+	return err
+}
+
+// GetChainHeads returns the head of one workspace's chain, or of every chain
+// when workspace is empty. Snapshots record them as anchors.
+func GetChainHeads(workspace string) ([]ChainHead, error) {
+	if Pool == nil {
+		return []ChainHead{}, fmt.Errorf("database not connected")
+	}
+
+	rows, err := Pool.Query(context.Background(), `
+		SELECT workspace, seq, head_hash, updated_at
+		FROM log_chain_heads
+		WHERE ($1 = '' OR workspace = $1) AND seq > 0
+		ORDER BY workspace
+	`, workspace)
+	if err != nil {
+		return []ChainHead{}, err
+	}
+	defer rows.Close()
+
+	heads := []ChainHead{}
+	for rows.Next() {
+		var h ChainHead
+		if err := rows.Scan(&h.Workspace, &h.Seq, &h.Hash, &h.UpdatedAt); err != nil {
+			return heads, err
+		}
+		heads = append(heads, h)
+	}
+	return heads, rows.Err()
+}
+
+// ChainBreak is the first link that failed verification.
+type ChainBreak struct {
+	Seq       int64      `json:"seq"`
+	ID        int        `json:"id,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Reason    string     `json:"reason"`
+}
+
+// ChainReport is the outcome of verifying one workspace's chain.
+type ChainReport struct {
+	Workspace string       `json:"workspace"`
+	FirstSeq  int64        `json:"firstSeq"`
+	LastSeq   int64        `json:"lastSeq"`
+	Links     int64        `json:"links"`
+	Anchors   int          `json:"anchorsChecked"`
+	Epochs    []ChainEpoch `json:"epochs,omitempty"`
+	Break     *ChainBreak  `json:"break,omitempty"`
+}
+
+// ChainEpoch is one rebuild of a workspace's chain by a backfill swap.
+type ChainEpoch struct {
+	RebasedAt     time.Time `json:"rebasedAt"`
+	ReplacedTable string    `json:"replacedTable"`
+	PrevSeq       int64     `json:"prevSeq"`
+	PrevHash      string    `json:"prevHash"`
+	Seq           int64     `json:"seq"`
+	Hash          string    `json:"hash"`
+}
+
+// recordRebase records, inside the swap transaction, that the chains in
+// the live heads table are replaced by those in the shadow one at
+// rebasedAt, their links kept in replacedTable. The rebuilt heads are
+// stamped with rebasedAt, so anchors taken from them afterwards are never
+// mistaken for anchors of the replaced chains.
+func recordRebase(ctx context.Context, tx pgx.Tx, replacedTable string, rebasedAt time.Time) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO log_chain_epochs (workspace, rebased_at, replaced_table, prev_seq, prev_hash, seq, head_hash)
+		SELECT COALESCE(o.workspace, n.workspace), $1, $2,
+		       COALESCE(o.seq, 0), COALESCE(o.head_hash, ''),
+		       COALESCE(n.seq, 0), COALESCE(n.head_hash, '')
+		FROM `+liveTables.heads+` o
+		FULL JOIN `+backfillTables.heads+` n ON n.workspace = o.workspace
+		WHERE COALESCE(o.seq, 0) > 0
+	`, rebasedAt, replacedTable)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE `+backfillTables.heads+` SET updated_at = $1`, rebasedAt)
+	return err
+}
+
+// checkEpochAnchor verifies an anchor taken before the chain was rebuilt
+// against the replaced chain: it must not lie past the head the chain had
+// when it was replaced, and must match the replaced link while the table
+// it was kept in still exists. It returns why the anchor fails, or "".
+func checkEpochAnchor(ctx context.Context, tx pgx.Tx, workspace string, anchor ChainHead, epoch ChainEpoch) (string, error) {
+	replaced := epoch.RebasedAt.UTC().Format(time.RFC3339)
+	switch {
+	case anchor.Seq > epoch.PrevSeq:
+		return fmt.Sprintf("anchored link is past the head of the chain replaced at %s (link %d)", replaced, epoch.PrevSeq), nil
+	case anchor.Seq == epoch.PrevSeq && anchor.Hash != epoch.PrevHash:
+		return fmt.Sprintf("hash differs from the head of the chain replaced at %s", replaced), nil
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, epoch.ReplacedTable).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", nil
+	}
+
+	var rowHash string
+	err := tx.QueryRow(ctx,
+		`SELECT COALESCE(row_hash, '') FROM `+pgx.Identifier{epoch.ReplacedTable}.Sanitize()+` WHERE workspace = $1 AND chain_seq = $2`,
+		workspace, anchor.Seq).Scan(&rowHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Dropped by retention before the rebuild; the head check stands
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if rowHash != anchor.Hash {
+		return fmt.Sprintf("hash differs from the anchored link of the chain replaced at %s", replaced), nil
+	}
+	return "", nil
+}
+
+// VerifyChain walks a workspace's chain in order, recomputing every hash, and
+// stops at the first broken link. Events logged before the chain existed are
+// skipped, and the walk starts at the oldest retained link, so chunks
+// dropped by retention do not count as breaks. anchors (e.g. heads recorded
+// in snapshots) must match the links they name, and the walk must end at
+// the recorded chain head. Anchors taken before a backfill rebuilt the
+// chain are checked against the chain it replaced (see log_chain_epochs).
+func VerifyChain(workspace string, anchors []ChainHead) (*ChainReport, error) {
+	report := &ChainReport{Workspace: workspace}
+
+	query := `
+		SELECT l.id, l.timestamp, l.chain_seq, COALESCE(l.prev_hash, ''), COALESCE(l.row_hash, ''),
+			` + chainDigest("l") + `
+		FROM todo_event_logs l
+		WHERE l.workspace = $1 AND l.chain_seq IS NOT NULL
+		ORDER BY l.chain_seq ASC
+	`
+
+	var head ChainHead
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx,
+			`SELECT seq, head_hash FROM log_chain_heads WHERE workspace = $1`,
+			workspace).Scan(&head.Seq, &head.Hash)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		epochs, err := chainEpochs(ctx, tx, workspace)
+		if err != nil {
+			return err
+		}
+		report.Epochs = epochs
+
+		// Each anchor belongs to the chain that was live when it was taken:
+		// the one replaced by the first rebuild after it, or the current one
+		anchorHashes := map[int64]string{}
+	nextAnchor:
+		for _, a := range anchors {
+			if a.Workspace != workspace {
+				continue
+			}
+			for _, epoch := range epochs {
+				if !a.UpdatedAt.Before(epoch.RebasedAt) {
+					continue
+				}
+				reason, err := checkEpochAnchor(ctx, tx, workspace, a, epoch)
+				if err != nil {
+					return err
+				}
+				if reason != "" {
+					report.Break = &ChainBreak{Seq: a.Seq, Reason: reason}
+					return nil
+				}
+				report.Anchors++
+				continue nextAnchor
+			}
+			anchorHashes[a.Seq] = a.Hash
+		}
+
+		rows, err := tx.Query(ctx, query, workspace)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var lastHash string
+		for rows.Next() {
+			var (
+				id                            int
+				ts                            time.Time
+				seq                           int64
+				prevHash, rowHash, recomputed string
+			)
+			if err := rows.Scan(&id, &ts, &seq, &prevHash, &rowHash, &recomputed); err != nil {
+				return err
+			}
+
+			broken := func(reason string) error {
+				report.Break = &ChainBreak{Seq: seq, ID: id, Timestamp: &ts, Reason: reason}
+				return nil
+			}
+
+			if report.Links == 0 {
+				report.FirstSeq = seq
+				if seq == 1 && prevHash != "" {
+					return broken("first link has a previous hash")
+				}
+			} else {
+				if seq != report.LastSeq+1 {
+					return broken(fmt.Sprintf("links %d to %d are missing", report.LastSeq+1, seq-1))
+				}
+				if prevHash != lastHash {
+					return broken(fmt.Sprintf("previous hash does not match link %d", report.LastSeq))
+				}
+			}
+			if recomputed != rowHash {
+				return broken("row content does not match its hash")
+			}
+			if anchor, ok := anchorHashes[seq]; ok {
+				if anchor != rowHash {
+					return broken("hash differs from the anchored chain head")
+				}
+				report.Anchors++
+			}
+
+			report.Links++
+			report.LastSeq = seq
+			lastHash = rowHash
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Links removed from the end leave no gap; the head and the anchors
+		// still name them.
+		for seq := range anchorHashes {
+			if seq > report.LastSeq {
+				report.Break = &ChainBreak{Seq: seq, Reason: "anchored link is missing"}
+				return nil
+			}
+		}
+		switch {
+		case head.Seq != report.LastSeq:
+			report.Break = &ChainBreak{
+				Seq:    report.LastSeq + 1,
+				Reason: fmt.Sprintf("chain head is link %d but the log ends at link %d", head.Seq, report.LastSeq),
+			}
+		case head.Hash != lastHash:
+			report.Break = &ChainBreak{Seq: report.LastSeq, Reason: "last link does not match the chain head"}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// chainEpochs returns the rebuilds of a workspace's chain, oldest first.
+func chainEpochs(ctx context.Context, tx pgx.Tx, workspace string) ([]ChainEpoch, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT rebased_at, replaced_table, prev_seq, prev_hash, seq, head_hash
+		FROM log_chain_epochs
+		WHERE workspace = $1
+		ORDER BY rebased_at ASC
+	`, workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var epochs []ChainEpoch
+	for rows.Next() {
+		var e ChainEpoch
+		if err := rows.Scan(&e.RebasedAt, &e.ReplacedTable, &e.PrevSeq, &e.PrevHash, &e.Seq, &e.Hash); err != nil {
+			return nil, err
+		}
+		epochs = append(epochs, e)
+	}
+	return epochs, rows.Err()
+}
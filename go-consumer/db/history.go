@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// EntityEvent is one history row for an entity, including the structured
+// before/after state (event_data) used to replay it.
+type EntityEvent struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"eventType"`
+	Changes   string    `json:"changes"`
+	User      string    `json:"user"`
+	EventData []byte    `json:"-"`
+}
+
+// GetEntityEvents returns every event of a workspace for an entity (e.g.
+// "Task", id) up to and including until, oldest first.
+func GetEntityEvents(workspace, entity, entityId string, until time.Time) ([]EntityEvent, error) {
+	query := `
+		SELECT id, timestamp, event_type,
+			COALESCE(changes, ''), COALESCE(user_name, ''), event_data
+		FROM todo_event_logs
+		WHERE workspace = $1 AND entity = $2 AND entity_id = $3 AND timestamp <= $4
+		ORDER BY timestamp ASC, id ASC
+	`
+
+	events := []EntityEvent{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, workspace, entity, entityId, until.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var e EntityEvent
+			if err := rows.Scan(&e.ID, &e.Timestamp, &e.EventType, &e.Changes, &e.User, &e.EventData); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return rows.Err()
+	})
+	return events, err
+}
+
+// GetEntityIDs lists the distinct IDs of an entity type that have events in
+// a workspace up to and including until.
+func GetEntityIDs(workspace, entity string, until time.Time) ([]string, error) {
+	query := `
+		SELECT DISTINCT entity_id
+		FROM todo_event_logs
+		WHERE workspace = $1 AND entity = $2 AND timestamp <= $3
+	`
+
+	ids := []string{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, workspace, entity, until.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// leaderCheckInterval is how often Run confirms a running job's leader
+// still holds its lock.
+const leaderCheckInterval = 10 * time.Second
+
+// Leader elects the single replica allowed to run a job (scheduled
+// snapshots, archiving, the outbox relay, the CDC ingester) with a Postgres
+// advisory lock held on a dedicated connection outside the pool. The lock is released when
+// the connection closes, so a replica that dies hands leadership over.
+type Leader struct {
+	name string
+	key  int64
+
+	mu   sync.Mutex
+	conn *pgx.Conn
+}
+
+// NewLeader returns an election for the job named name (used in logs) on
+// advisory lock key.
+func NewLeader(name string, key int64) *Leader {
+	return &Leader{name: name, key: key}
+}
+
+// Run blocks, running job whenever this replica is the leader. Replicas
+// that are not wait and retry every interval. job gets a context that is
+// cancelled when leadership is lost and must return promptly then; when it
+// returns, leadership is released and contested again after interval.
+func (l *Leader) Run(interval time.Duration, job func(ctx context.Context)) {
+	for {
+		if !l.Acquire() {
+			time.Sleep(interval)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			job(ctx)
+		}()
+
+		ticker := time.NewTicker(leaderCheckInterval)
+	running:
+		for {
+			select {
+			case <-done:
+				break running
+			case <-ticker.C:
+				if !l.Acquire() {
+					cancel()
+					<-done
+					break running
+				}
+			}
+		}
+		ticker.Stop()
+		cancel()
+		l.Release()
+		time.Sleep(interval)
+	}
+}
+
+// Acquire returns true when this replica is (or has just become) the leader.
+// A leader whose lock connection has died steps down and tries again.
+func (l *Leader) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := l.conn.Ping(ctx)
+		cancel()
+		if err == nil {
+			return true
+		}
+		fmt.Printf("⚠️ %s lost leadership: %v\n", l.name, err)
+		l.conn.Close(context.Background())
+		l.conn = nil
+	}
+
+	conn, ok, err := TryAdvisoryLock(l.key)
+	if err != nil {
+		fmt.Printf("❌ %s lock error: %v\n", l.name, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	fmt.Printf("👑 %s elected leader\n", l.name)
+	l.conn = conn
+	return true
+}
+
+// Release gives up leadership.
+func (l *Leader) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ReleaseAdvisoryLock(l.conn, l.key)
+	l.conn = nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// StatusTransition is one point in a task's status history. Deleted marks
+// the end of the task's life; Status is empty then.
+type StatusTransition struct {
+	TaskID    string
+	GroupID   string
+	Status    string
+	Deleted   bool
+	Timestamp time.Time
+}
+
+// GetStatusTransitions returns the status history of a workspace's tasks up
+// to until, ordered by task then time. groupId and taskId narrow the result
+// when set.
+// Status comes from the structured event_data when present and otherwise
+// from the free-text message of older STATUS_CHANGED events; tasks start in
+// "New".
+func GetStatusTransitions(workspace, groupId, taskId string, until time.Time) ([]StatusTransition, error) {
+	query := `
+		SELECT
+			task_id,
+			COALESCE(group_id, ''),
+			COALESCE(
+				event_data->'after'->>'status',
+				CASE WHEN event_type = 'TASK_CREATED' THEN 'New' END,
+				substring(changes FROM 'to "([^"]*)"$'),
+				''
+			) AS status,
+			event_type = 'TASK_DELETED' AS deleted,
+			timestamp
+		FROM todo_event_logs
+		WHERE entity = 'Task'
+		  AND event_type IN ('TASK_CREATED', 'STATUS_CHANGED', 'TASK_DELETED')
+		  AND task_id IS NOT NULL
+		  AND workspace = $1
+		  AND ($2 = '' OR group_id = $2)
+		  AND ($3 = '' OR task_id = $3)
+		  AND timestamp <= $4
+		ORDER BY task_id, timestamp ASC, id ASC
+	`
+
+	transitions := []StatusTransition{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, workspace, groupId, taskId, until.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var t StatusTransition
+			if err := rows.Scan(&t.TaskID, &t.GroupID, &t.Status, &t.Deleted, &t.Timestamp); err != nil {
+				return err
+			}
+			transitions = append(transitions, t)
+		}
+		return rows.Err()
+	})
+	return transitions, err
+}
@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// ErrInvalidCursor is returned by Fetch when the cursor given to After was
+// not produced by a previous Fetch.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// LogEntry is one todo_event_logs row. Optional columns are empty when NULL.
+type LogEntry struct {
+	ID        int             `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	EventType string          `json:"eventType"`
+	Entity    string          `json:"entity"`
+	EntityID  string          `json:"entityId"`
+	GroupID   string          `json:"groupId,omitempty"`
+	GroupName string          `json:"groupName,omitempty"`
+	TaskID    string          `json:"taskId,omitempty"`
+	TaskName  string          `json:"taskName,omitempty"`
+	Changes   string          `json:"changes,omitempty"`
+	User      string          `json:"user,omitempty"`
+	Workspace string          `json:"workspace,omitempty"`
+	EventData json.RawMessage `json:"eventData,omitempty"`
+}
+
+// Cursor is the keyset position of an entry: pass it to LogQuery.After to
+// fetch the page that follows it.
+func (e LogEntry) Cursor() string {
+	return fmt.Sprintf("%d_%d", e.Timestamp.UnixMicro(), e.ID)
+}
+
+// LogQuery builds a filtered, ordered and keyset-paginated query over one
+// workspace of todo_event_logs. Filters combine with AND; zero values are
+// ignored:
+//
+//	entries, next, err := db.NewLogQuery(workspace).Group(id).Since(t).Limit(50).Fetch()
+type LogQuery struct {
+	workspace string
+	where     []string
+	args      []interface{}
+	ascending bool
+	limit     int
+	after     string
+}
+
+// NewLogQuery returns a query over all events of a workspace, newest first,
+// 100 per page. Fetch fails with ErrWorkspaceRequired for an empty workspace.
+func NewLogQuery(workspace string) *LogQuery {
+	q := &LogQuery{workspace: workspace, limit: defaultLogLimit}
+	return q.filter("workspace = ?", workspace)
+}
+
+// filter adds a condition; each "?" in cond is bound to the next arg.
+func (q *LogQuery) filter(cond string, args ...interface{}) *LogQuery {
+	for _, arg := range args {
+		q.args = append(q.args, arg)
+		cond = strings.Replace(cond, "?", "$"+strconv.Itoa(len(q.args)), 1)
+	}
+	q.where = append(q.where, cond)
+	return q
+}
+
+// Group keeps events of a group, including those of its tasks.
+func (q *LogQuery) Group(groupId string) *LogQuery {
+	if groupId == "" {
+		return q
+	}
+	return q.filter("group_id = ?", groupId)
+}
+
+// Task keeps events of a task.
+func (q *LogQuery) Task(taskId string) *LogQuery {
+	if taskId == "" {
+		return q
+	}
+	return q.filter("task_id = ?", taskId)
+}
+
+// Entity keeps events of an entity type ("Group", "Task", ...) and, when
+// entityId is set, of one entity.
+func (q *LogQuery) Entity(entity, entityId string) *LogQuery {
+	if entity != "" {
+		q.filter("entity = ?", entity)
+	}
+	if entityId != "" {
+		q.filter("entity_id = ?", entityId)
+	}
+	return q
+}
+
+// User keeps events performed by a user.
+func (q *LogQuery) User(user string) *LogQuery {
+	if user == "" {
+		return q
+	}
+	return q.filter("user_name = ?", user)
+}
+
+// EventTypes keeps events of any of the given types.
+func (q *LogQuery) EventTypes(types ...string) *LogQuery {
+	if len(types) == 0 {
+		return q
+	}
+	return q.filter("event_type = ANY(?::text[])", types)
+}
+
+// Since keeps events at or after t.
+func (q *LogQuery) Since(t time.Time) *LogQuery {
+	if t.IsZero() {
+		return q
+	}
+	return q.filter("timestamp >= ?", t.UTC())
+}
+
+// Until keeps events before t.
+func (q *LogQuery) Until(t time.Time) *LogQuery {
+	if t.IsZero() {
+		return q
+	}
+	return q.filter("timestamp < ?", t.UTC())
+}
+
+// Text keeps events matching a web-search style query over task names, group
+// names and change descriptions (see SearchLogs for ranked results).
+func (q *LogQuery) Text(text string) *LogQuery {
+	if strings.TrimSpace(text) == "" {
+		return q
+	}
+	return q.filter(searchVector+" @@ websearch_to_tsquery('english'::regconfig, ?)", text)
+}
+
+// Ascending returns the oldest events first instead of the newest.
+func (q *LogQuery) Ascending() *LogQuery {
+	q.ascending = true
+	return q
+}
+
+// Limit sets the page size (default 100, at most 1000).
+func (q *LogQuery) Limit(n int) *LogQuery {
+	if n > 0 {
+		q.limit = n
+	}
+	if q.limit > maxLogLimit {
+		q.limit = maxLogLimit
+	}
+	return q
+}
+
+// After continues from the cursor returned by a previous Fetch.
+func (q *LogQuery) After(cursor string) *LogQuery {
+	q.after = cursor
+	return q
+}
+
+// parseCursor decodes a LogEntry.Cursor.
+func parseCursor(cursor string) (time.Time, int, error) {
+	micros, id, ok := strings.Cut(cursor, "_")
+	if ok {
+		us, err1 := strconv.ParseInt(micros, 10, 64)
+		n, err2 := strconv.Atoi(id)
+		if err1 == nil && err2 == nil {
+			return time.UnixMicro(us).UTC(), n, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("%w %q", ErrInvalidCursor, cursor)
+}
+
+// sql renders the query with an optional row limit (0 for none).
+func (q *LogQuery) sql(limit int) (string, []interface{}, error) {
+	// Copy so the builder can be reused for the next page.
+	page := *q
+	page.where = append([]string(nil), q.where...)
+	page.args = append([]interface{}(nil), q.args...)
+
+	direction, compare := "DESC", "<"
+	if page.ascending {
+		direction, compare = "ASC", ">"
+	}
+	if page.after != "" {
+		ts, id, err := parseCursor(page.after)
+		if err != nil {
+			return "", nil, err
+		}
+		page.filter("(timestamp, id) "+compare+" (?, ?)", ts, id)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			id, timestamp, event_type, entity, entity_id,
+			COALESCE(group_id, ''), COALESCE(group_name, ''),
+			COALESCE(task_id, ''), COALESCE(task_name, ''),
+			COALESCE(changes, ''), COALESCE(user_name, ''), COALESCE(workspace, ''),
+			event_data
+		FROM todo_event_logs
+		WHERE %s
+		ORDER BY timestamp %s, id %s
+	`, strings.Join(page.where, " AND "), direction, direction)
+	if limit > 0 {
+		query += fmt.Sprintf("LIMIT %d", limit)
+	}
+	return query, page.args, nil
+}
+
+// each runs the query and calls fn for every row as it is read.
+func (q *LogQuery) each(limit int, fn func(e LogEntry) error) error {
+	query, args, err := q.sql(limit)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	return inWorkspace(ctx, q.workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var e LogEntry
+			if err := rows.Scan(
+				&e.ID, &e.Timestamp, &e.EventType, &e.Entity, &e.EntityID,
+				&e.GroupID, &e.GroupName, &e.TaskID, &e.TaskName,
+				&e.Changes, &e.User, &e.Workspace, &e.EventData,
+			); err != nil {
+				return fmt.Errorf("log row scan error: %w", err)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// Fetch runs the query and returns one page of entries together with the
+// cursor of the next page, which is empty on the last page.
+func (q *LogQuery) Fetch() ([]LogEntry, string, error) {
+	// Fetch one extra row to know whether another page follows.
+	entries := []LogEntry{}
+	err := q.each(q.limit+1, func(e LogEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return entries, "", err
+	}
+
+	next := ""
+	if len(entries) > q.limit {
+		entries = entries[:q.limit]
+		next = entries[len(entries)-1].Cursor()
+	}
+	return entries, next, nil
+}
+
+// Stream calls fn with every matching entry, ignoring the page size, without
+// loading the result into memory. It returns the number of entries passed
+// to fn.
+func (q *LogQuery) Stream(fn func(e LogEntry) error) (int, error) {
+	count := 0
+	err := q.each(0, func(e LogEntry) error {
+		if err := fn(e); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Storage policy settings for todo_event_logs, read from the environment:
+//
+//	EVENT_LOG_COMPRESS_AFTER  compress chunks older than this (default "7 days"
+//	                          when row-level security is off, otherwise off;
+//	                          "off" disables)
+//	EVENT_LOG_RETENTION       drop chunks older than this (default: keep forever)
+//	EVENT_LOG_ARCHIVE         "true" exports chunks to the object store before
+//	                          they are dropped, instead of a plain retention policy
+//	EVENT_LOG_RLS             "false" turns off the workspace row-level security
+//	                          policy (default on)
+//
+// TimescaleDB does not compress hypertables with row-level security, so the
+// two are a choice: isolation enforced by Postgres (the default), or
+// compressed storage with isolation left to the queries' workspace filters
+// (EVENT_LOG_RLS=false). Asking for both explicitly fails startup.
+const defaultCompressAfter = "7 days"
+
+// ErrCompressionWithRowSecurity is returned at startup when compression is
+// configured while row-level security is on.
+var ErrCompressionWithRowSecurity = errors.New("EVENT_LOG_COMPRESS_AFTER is set but TimescaleDB cannot compress todo_event_logs with row-level security; set EVENT_LOG_RLS=false or EVENT_LOG_COMPRESS_AFTER=off")
+
+// minRetention keeps raw rows around for the widest continuous aggregate
+// refresh window (activity_daily), so refreshes never see dropped data.
+const minRetention = 30 * 24 * time.Hour
+
+// PolicyConfig is the storage policy applied to todo_event_logs.
+type PolicyConfig struct {
+	CompressAfter string // Postgres interval, empty disables compression
+	Retention     string // Postgres interval, empty keeps rows forever
+	Archive       bool   // retention is enforced by the archiver, not Timescale
+	RowSecurity   bool   // workspace isolation policy enforced by Postgres
+}
+
+// LoadPolicyConfig reads the storage policy from the environment.
+func LoadPolicyConfig() PolicyConfig {
+	cfg := PolicyConfig{
+		Retention:   strings.TrimSpace(os.Getenv("EVENT_LOG_RETENTION")),
+		Archive:     os.Getenv("EVENT_LOG_ARCHIVE") == "true",
+		RowSecurity: os.Getenv("EVENT_LOG_RLS") != "false",
+	}
+	if !cfg.RowSecurity {
+		cfg.CompressAfter = defaultCompressAfter
+	}
+	if v, ok := os.LookupEnv("EVENT_LOG_COMPRESS_AFTER"); ok {
+		cfg.CompressAfter = strings.TrimSpace(v)
+	}
+	if strings.EqualFold(cfg.CompressAfter, "off") {
+		cfg.CompressAfter = ""
+	}
+	if strings.EqualFold(cfg.Retention, "off") {
+		cfg.Retention = ""
+	}
+	return cfg
+}
+
+// ensurePolicies applies the row-level security, compression and retention
+// policy. Policies are removed and re-added so configuration changes take
+// effect on restart.
+func ensurePolicies(cfg PolicyConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if cfg.RowSecurity && cfg.CompressAfter != "" {
+		return ErrCompressionWithRowSecurity
+	}
+	if err := ensureRowSecurity(cfg.RowSecurity); err != nil {
+		return err
+	}
+
+	if cfg.CompressAfter != "" {
+		var enabled bool
+		err := Pool.QueryRow(ctx, `
+			SELECT compression_enabled
+			FROM timescaledb_information.hypertables
+			WHERE hypertable_name = 'todo_event_logs'
+		`).Scan(&enabled)
+		if err != nil {
+			return fmt.Errorf("compression status check error: %w", err)
+		}
+
+		// Compression settings cannot change once chunks are compressed, so
+		// only enable them the first time.
+		if !enabled {
+			if _, err := Pool.Exec(ctx, `
+				ALTER TABLE todo_event_logs SET (
+					timescaledb.compress,
+					timescaledb.compress_segmentby = 'group_id',
+					timescaledb.compress_orderby = 'timestamp DESC'
+				)
+			`); err != nil {
+				return fmt.Errorf("enable compression error: %w", err)
+			}
+		}
+
+		if _, err := Pool.Exec(ctx, `SELECT remove_compression_policy('todo_event_logs', if_exists => TRUE)`); err != nil {
+			return fmt.Errorf("remove compression policy error: %w", err)
+		}
+		if _, err := Pool.Exec(ctx, `SELECT add_compression_policy('todo_event_logs', $1::interval)`, cfg.CompressAfter); err != nil {
+			return fmt.Errorf("add compression policy error: %w", err)
+		}
+		fmt.Printf("🗜️ Compression policy: chunks older than %s (segment by group_id)\n", cfg.CompressAfter)
+	} else {
+		if _, err := Pool.Exec(ctx, `SELECT remove_compression_policy('todo_event_logs', if_exists => TRUE)`); err != nil {
+			return fmt.Errorf("remove compression policy error: %w", err)
+		}
+		if cfg.RowSecurity {
+			fmt.Println("ℹ️ Compression off: not supported with row-level security (set EVENT_LOG_RLS=false to compress)")
+		}
+	}
+
+	if _, err := Pool.Exec(ctx, `SELECT remove_retention_policy('todo_event_logs', if_exists => TRUE)`); err != nil {
+		return fmt.Errorf("remove retention policy error: %w", err)
+	}
+	if cfg.Retention == "" {
+		return nil
+	}
+
+	retention, err := IntervalDuration(cfg.Retention)
+	if err != nil {
+		return err
+	}
+	if retention < minRetention {
+		fmt.Printf("⚠️ EVENT_LOG_RETENTION %s is shorter than the activity_daily refresh window (30 days)\n", cfg.Retention)
+	}
+
+	if cfg.Archive {
+		fmt.Printf("🗄️ Retention: chunks older than %s are archived to the object store, then dropped\n", cfg.Retention)
+		return nil
+	}
+
+	if _, err := Pool.Exec(ctx, `SELECT add_retention_policy('todo_event_logs', $1::interval)`, cfg.Retention); err != nil {
+		return fmt.Errorf("add retention policy error: %w", err)
+	}
+	fmt.Printf("🧹 Retention policy: chunks older than %s are dropped\n", cfg.Retention)
+	return nil
+}
+
+// IntervalDuration converts a Postgres interval string to a Go duration using
+// the database's own interval parsing.
+func IntervalDuration(interval string) (time.Duration, error) {
+	var seconds float64
+	err := Pool.QueryRow(context.Background(),
+		`SELECT EXTRACT(EPOCH FROM $1::interval)::float8`, interval).Scan(&seconds)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %w", interval, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Chunk is one todo_event_logs chunk and the time range it covers.
+type Chunk struct {
+	Name       string
+	RangeStart time.Time
+	RangeEnd   time.Time
+}
+
+// GetExpiredChunks lists chunks whose whole range is older than olderThan,
+// oldest first.
+func GetExpiredChunks(olderThan time.Time) ([]Chunk, error) {
+	if Pool == nil {
+		return []Chunk{}, fmt.Errorf("database not connected")
+	}
+
+	query := `
+		SELECT chunk_schema || '.' || chunk_name, range_start, range_end
+		FROM timescaledb_information.chunks
+		WHERE hypertable_name = 'todo_event_logs' AND range_end <= $1
+		ORDER BY range_start ASC
+	`
+
+	rows, err := Pool.Query(context.Background(), query, olderThan.UTC())
+	if err != nil {
+		return []Chunk{}, err
+	}
+	defer rows.Close()
+
+	chunks := []Chunk{}
+	for rows.Next() {
+		var c Chunk
+		if err := rows.Scan(&c.Name, &c.RangeStart, &c.RangeEnd); err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// StreamRange calls fn with every todo_event_logs row in [from, to) as a
+// JSON-ready map, without loading the range into memory.
+func StreamRange(from, to time.Time, fn func(row map[string]interface{}) error) (int, error) {
+	if Pool == nil {
+		return 0, fmt.Errorf("database not connected")
+	}
+
+	query := `
+		SELECT id, timestamp, event_type, entity, entity_id,
+			group_id, group_name, task_id, task_name,
+			changes, user_name, workspace, event_data,
+			chain_seq, prev_hash, row_hash
+		FROM todo_event_logs
+		WHERE timestamp >= $1 AND timestamp < $2
+		ORDER BY timestamp ASC, id ASC
+	`
+
+	rows, err := Pool.Query(context.Background(), query, from.UTC(), to.UTC())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		row, err := pgx.RowToMap(rows)
+		if err != nil {
+			return count, err
+		}
+		if err := fn(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// DropChunksBefore drops every todo_event_logs chunk that ends at or before t.
+func DropChunksBefore(t time.Time) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	_, err := Pool.Exec(context.Background(),
+		`SELECT drop_chunks('todo_event_logs', older_than => $1::timestamptz)`, t.UTC())
+	return err
+}
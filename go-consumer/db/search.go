@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// searchVector is the weighted document searched by SearchLogs: task names
+// rank above group names, which rank above the change description. It is an
+// index expression rather than a stored column because columns cannot be
+// added to a hypertable with compressed chunks; queries must use the exact
+// same expression for the index to apply.
+const searchVector = `(
+	setweight(to_tsvector('english'::regconfig, COALESCE(task_name, '')), 'A') ||
+	setweight(to_tsvector('english'::regconfig, COALESCE(group_name, '')), 'B') ||
+	setweight(to_tsvector('english'::regconfig, COALESCE(changes, '')), 'C')
+)`
+
+// escapedHeadlineSource is the text excerpted by SearchLogs, HTML-escaped
+// before ts_headline marks matches up so the only markup in a highlight is
+// the <b></b> it adds. The default parser skips the entities when
+// tokenizing, so matching is unaffected.
+const escapedHeadlineSource = `replace(replace(replace(replace(replace(
+	COALESCE(NULLIF(l.changes, ''), l.task_name, l.group_name, ''),
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+
+// searchSchema adds the full-text index over todo_event_logs.
+const searchSchema = `
+CREATE INDEX IF NOT EXISTS idx_event_search ON todo_event_logs USING GIN (` + searchVector + `);
+`
+
+// SearchQuery describes a full-text search over event history. Text uses web
+// search syntax ("renamed invoices", "-deleted", "\"exact phrase\"", "or").
+type SearchQuery struct {
+	Text       string
+	GroupID    string
+	TaskID     string
+	User       string
+	Workspace  string // required
+	EventTypes []string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// SearchResult is a matching event with its relevance and a highlighted
+// excerpt of the change description. Highlight is HTML (the excerpt escaped,
+// matches wrapped in <b></b>); every other field is raw text.
+type SearchResult struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"eventType"`
+	Entity    string    `json:"entity"`
+	EntityID  string    `json:"entityId"`
+	GroupID   string    `json:"groupId,omitempty"`
+	GroupName string    `json:"groupName,omitempty"`
+	TaskID    string    `json:"taskId,omitempty"`
+	TaskName  string    `json:"taskName,omitempty"`
+	Changes   string    `json:"changes,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	Rank      float64   `json:"rank"`
+	Highlight string    `json:"highlight"`
+}
+
+// SearchLogs runs a ranked full-text search over task names, group names and
+// change descriptions within a workspace. It also returns the total number of matches so
+// callers can paginate with Limit/Offset (0 when the page is past the end).
+func SearchLogs(q SearchQuery) ([]SearchResult, int, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return []SearchResult{}, 0, fmt.Errorf("search text is required")
+	}
+	if q.Limit <= 0 || q.Limit > 100 {
+		q.Limit = 20
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	var from, to *time.Time
+	if !q.From.IsZero() {
+		f := q.From.UTC()
+		from = &f
+	}
+	if !q.To.IsZero() {
+		t := q.To.UTC()
+		to = &t
+	}
+
+	query := `
+		WITH q AS (SELECT websearch_to_tsquery('english'::regconfig, $1) AS query)
+		SELECT
+			l.id, l.timestamp, l.event_type, l.entity, l.entity_id,
+			COALESCE(l.group_id, ''), COALESCE(l.group_name, ''),
+			COALESCE(l.task_id, ''), COALESCE(l.task_name, ''),
+			COALESCE(l.changes, ''), COALESCE(l.user_name, ''), COALESCE(l.workspace, ''),
+			ts_rank_cd(` + searchVector + `, q.query) AS rank,
+			ts_headline('english'::regconfig, ` + escapedHeadlineSource + `,
+				q.query, 'StartSel=<b>, StopSel=</b>, MaxFragments=2, MaxWords=20, MinWords=5'),
+			COUNT(*) OVER () AS total
+		FROM todo_event_logs l, q
+		WHERE ` + searchVector + ` @@ q.query
+		  AND ($2 = '' OR l.group_id = $2)
+		  AND ($3 = '' OR l.task_id = $3)
+		  AND ($4 = '' OR l.user_name = $4)
+		  AND l.workspace = $5
+		  AND (cardinality($6::text[]) = 0 OR l.event_type = ANY($6::text[]))
+		  AND ($7::timestamptz IS NULL OR l.timestamp >= $7)
+		  AND ($8::timestamptz IS NULL OR l.timestamp < $8)
+		ORDER BY rank DESC, l.timestamp DESC
+		LIMIT $9 OFFSET $10
+	`
+
+	eventTypes := q.EventTypes
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	results := []SearchResult{}
+	total := 0
+	ctx := context.Background()
+	err := inWorkspace(ctx, q.Workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query,
+			q.Text, q.GroupID, q.TaskID, q.User, q.Workspace, eventTypes, from, to, q.Limit, q.Offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var r SearchResult
+			if err := rows.Scan(
+				&r.ID, &r.Timestamp, &r.EventType, &r.Entity, &r.EntityID,
+				&r.GroupID, &r.GroupName, &r.TaskID, &r.TaskName,
+				&r.Changes, &r.User, &r.Workspace,
+				&r.Rank, &r.Highlight, &total,
+			); err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return results, 0, err
+	}
+	return results, total, nil
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Snapshot catalog statuses.
+const (
+	SnapshotPublished = "published" // written to the todo-snapshots topic
+	SnapshotArchived  = "archived"  // uploaded to the object store
+	SnapshotFailed    = "failed"    // publishing or uploading failed
+)
+
+// snapshotSchema creates the catalog of every snapshot taken, so listing them
+// does not depend on the object store or the free-text SNAPSHOT_CREATED rows.
+const snapshotSchema = `
+CREATE TABLE IF NOT EXISTS snapshots (
+  snapshot_id VARCHAR(100) PRIMARY KEY,
+  created_by VARCHAR(100),
+  trigger_reason TEXT,
+
+  group_count INTEGER NOT NULL DEFAULT 0,
+  task_count INTEGER NOT NULL DEFAULT 0,
+  comment_count INTEGER NOT NULL DEFAULT 0,
+  user_count INTEGER NOT NULL DEFAULT 0,
+
+  size_bytes BIGINT NOT NULL DEFAULT 0,
+  checksum VARCHAR(100),
+  storage_uri TEXT,
+  status VARCHAR(20) NOT NULL,
+  error TEXT,
+
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  published_at TIMESTAMPTZ,
+  archived_at TIMESTAMPTZ,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- NULL for whole-database snapshots
+ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS workspace VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_snapshots_created_at ON snapshots (created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_snapshots_status ON snapshots (status, created_at DESC);
+`
+
+// SnapshotRecord is one row of the snapshots catalog.
+type SnapshotRecord struct {
+	SnapshotID    string     `json:"snapshotId"`
+	CreatedBy     string     `json:"createdBy"`
+	TriggerReason string     `json:"triggerReason"`
+	Workspace     string     `json:"workspace,omitempty"` // empty for the whole database
+	GroupCount    int        `json:"groupCount"`
+	TaskCount     int        `json:"taskCount"`
+	CommentCount  int        `json:"commentCount"`
+	UserCount     int        `json:"userCount"`
+	SizeBytes     int64      `json:"sizeBytes"`
+	Checksum      string     `json:"checksum"`
+	StorageURI    string     `json:"storageUri,omitempty"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	PublishedAt   *time.Time `json:"publishedAt,omitempty"`
+	ArchivedAt    *time.Time `json:"archivedAt,omitempty"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// RecordSnapshot inserts or replaces the catalog entry written when a
+// snapshot is created. Status should be SnapshotPublished or SnapshotFailed.
+func RecordSnapshot(rec SnapshotRecord) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	query := `
+		INSERT INTO snapshots (
+			snapshot_id, created_by, trigger_reason,
+			group_count, task_count, comment_count, user_count,
+			size_bytes, checksum, status, error,
+			created_at, published_at, updated_at, workspace
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), $12,
+			CASE WHEN $10 = 'published' THEN NOW() END,
+			NOW(), NULLIF($13, '')
+		)
+		ON CONFLICT (snapshot_id) DO UPDATE SET
+			created_by = EXCLUDED.created_by,
+			trigger_reason = EXCLUDED.trigger_reason,
+			workspace = EXCLUDED.workspace,
+			group_count = EXCLUDED.group_count,
+			task_count = EXCLUDED.task_count,
+			comment_count = EXCLUDED.comment_count,
+			user_count = EXCLUDED.user_count,
+			size_bytes = EXCLUDED.size_bytes,
+			checksum = EXCLUDED.checksum,
+			-- never move an already archived snapshot back to published
+			status = CASE WHEN snapshots.status = 'archived' THEN snapshots.status ELSE EXCLUDED.status END,
+			error = EXCLUDED.error,
+			published_at = COALESCE(EXCLUDED.published_at, snapshots.published_at),
+			updated_at = NOW()
+	`
+
+	_, err := Pool.Exec(
+		context.Background(),
+		query,
+		rec.SnapshotID, rec.CreatedBy, rec.TriggerReason,
+		rec.GroupCount, rec.TaskCount, rec.CommentCount, rec.UserCount,
+		rec.SizeBytes, rec.Checksum, rec.Status, rec.Error,
+		rec.CreatedAt.UTC(), rec.Workspace,
+	)
+	return err
+}
+
+// MarkSnapshotArchived records a successful upload to the object store. A
+// row is created if the snapshot was published by a producer that does not
+// write to the catalog (e.g. the Express backend).
+func MarkSnapshotArchived(snapshotID, storageURI, checksum string, sizeBytes int64) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	query := `
+		INSERT INTO snapshots (snapshot_id, size_bytes, checksum, storage_uri, status, archived_at)
+		VALUES ($1, $2, $3, $4, 'archived', NOW())
+		ON CONFLICT (snapshot_id) DO UPDATE SET
+			storage_uri = EXCLUDED.storage_uri,
+			status = 'archived',
+			error = NULL,
+			archived_at = NOW(),
+			updated_at = NOW()
+	`
+
+	_, err := Pool.Exec(context.Background(), query, snapshotID, sizeBytes, checksum, storageURI)
+	return err
+}
+
+// MarkSnapshotFailed flags a snapshot whose publish or upload failed.
+func MarkSnapshotFailed(snapshotID, reason string) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	query := `
+		INSERT INTO snapshots (snapshot_id, status, error)
+		VALUES ($1, 'failed', $2)
+		ON CONFLICT (snapshot_id) DO UPDATE SET
+			status = 'failed',
+			error = EXCLUDED.error,
+			updated_at = NOW()
+	`
+
+	_, err := Pool.Exec(context.Background(), query, snapshotID, reason)
+	return err
+}
+
+const snapshotColumns = `
+	snapshot_id, COALESCE(created_by, ''), COALESCE(trigger_reason, ''), COALESCE(workspace, ''),
+	group_count, task_count, comment_count, user_count,
+	size_bytes, COALESCE(checksum, ''), COALESCE(storage_uri, ''),
+	status, COALESCE(error, ''),
+	created_at, published_at, archived_at, updated_at
+`
+
+func scanSnapshot(row pgx.Row) (SnapshotRecord, error) {
+	var rec SnapshotRecord
+	err := row.Scan(
+		&rec.SnapshotID, &rec.CreatedBy, &rec.TriggerReason, &rec.Workspace,
+		&rec.GroupCount, &rec.TaskCount, &rec.CommentCount, &rec.UserCount,
+		&rec.SizeBytes, &rec.Checksum, &rec.StorageURI,
+		&rec.Status, &rec.Error,
+		&rec.CreatedAt, &rec.PublishedAt, &rec.ArchivedAt, &rec.UpdatedAt,
+	)
+	return rec, err
+}
+
+// ListSnapshots returns catalog entries newest first, optionally filtered by
+// status. A limit of 0 returns up to 100 entries.
+func ListSnapshots(status string, limit int) ([]SnapshotRecord, error) {
+	if Pool == nil {
+		return []SnapshotRecord{}, fmt.Errorf("database not connected")
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := `
+		SELECT ` + snapshotColumns + `
+		FROM snapshots
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	rows, err := Pool.Query(context.Background(), query, status, limit)
+	if err != nil {
+		return []SnapshotRecord{}, err
+	}
+	defer rows.Close()
+
+	snapshots := []SnapshotRecord{}
+	for rows.Next() {
+		rec, err := scanSnapshot(rows)
+		if err != nil {
+			return snapshots, err
+		}
+		snapshots = append(snapshots, rec)
+	}
+	return snapshots, rows.Err()
+}
+
+// GetSnapshot looks up one catalog entry. It returns nil when the snapshot is
+// unknown.
+func GetSnapshot(snapshotID string) (*SnapshotRecord, error) {
+	if Pool == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	query := `SELECT ` + snapshotColumns + ` FROM snapshots WHERE snapshot_id = $1`
+
+	rec, err := scanSnapshot(Pool.QueryRow(context.Background(), query, snapshotID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
@@ -2,9 +2,13 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -59,275 +63,231 @@ CREATE INDEX IF NOT EXISTS idx_event_type ON todo_event_logs (event_type, timest
 CREATE INDEX IF NOT EXISTS idx_group_id ON todo_event_logs (group_id, timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_task_id ON todo_event_logs (task_id, timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_entity ON todo_event_logs (entity, entity_id, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_user_name ON todo_event_logs (user_name, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_ingest_order ON todo_event_logs (id);
 `
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := Pool.Exec(ctx, schema)
+	_, err := Pool.Exec(ctx, schema+snapshotSchema+searchSchema+workspaceSchema+chainSchema+cdcSchema)
 	if err != nil {
 		return fmt.Errorf("schema creation error: %w", err)
 	}
 
 	fmt.Println("🧩 TimescaleDB schema verified (todo_event_logs with group-task relationships ready)")
-	return nil
+	fmt.Println("🗂️ Snapshot catalog table verified (snapshots)")
+
+	if err := ensureAggregates(); err != nil {
+		return err
+	}
+	return ensurePolicies(LoadPolicyConfig())
 }
 
-// InsertLog inserts a log record into the hypertable with full event details
-func InsertLog(eventType, entity, entityId, groupId, groupName, taskId, taskName, changes, user, workspace string, timestamp time.Time) error {
-	query := `
-		INSERT INTO todo_event_logs (
-			event_type, entity, entity_id,
-			group_id, group_name, task_id, task_name,
-			changes, user_name, workspace, timestamp
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-	`
+// InsertLog inserts a log record into the hypertable with full event details.
+// eventData holds the structured before/after state as JSON and may be nil.
+// Every event belongs to a workspace; the insert runs scoped to it so the
+// isolation policy rejects rows written for another tenant, and appends the
+// row to the workspace's hash chain.
+func InsertLog(eventType, entity, entityId, groupId, groupName, taskId, taskName, changes, user, workspace string, eventData []byte, timestamp time.Time) error {
+	ctx := context.Background()
+	return inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		return insertChained(ctx, tx, liveTables,
+			eventType, entity, entityId,
+			groupId, groupName, taskId, taskName,
+			changes, user, workspace, eventData, timestamp,
+		)
+	})
+}
 
-	_, err := Pool.Exec(
-		context.Background(),
-		query,
-		eventType, entity, entityId,
-		groupId, groupName, taskId, taskName,
-		changes, user, workspace, timestamp.UTC(),
-	)
-	return err
+// IsPermanent reports whether an InsertLog error rejects the event itself
+// (no workspace, a value the column cannot hold, a violated constraint), so
+// retrying cannot help. Anything else, such as a lost connection or a
+// failover, is worth retrying.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrWorkspaceRequired) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 22: data exception, class 23: integrity constraint violation
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return false
 }
 
-// GetGroupLogs retrieves logs for a specific group (including all tasks under that group)
-func GetGroupLogs(groupId string) ([]map[string]interface{}, error) {
+// HasChangesSinceLastSnapshot reports whether any event other than snapshot
+// bookkeeping has been logged after the most recent SNAPSHOT_CREATED row.
+// Rows are compared in ingest order (their serial id), not by the
+// producer-supplied timestamp, so an event sent by a lagging clock or
+// delivered late still counts. When no snapshot exists yet, any logged
+// event counts as a change. An empty
+// workspace checks the whole database against whole-database snapshots
+// (logged in the system workspace); otherwise only that workspace's events
+// and snapshots are considered. It is used by the snapshot scheduler and
+// reads across tenants.
+func HasChangesSinceLastSnapshot(workspace string) (bool, error) {
 	if Pool == nil {
-		return []map[string]interface{}{}, fmt.Errorf("database not connected")
+		return false, fmt.Errorf("database not connected")
 	}
 
 	query := `
-		SELECT
-			id, timestamp, event_type, entity, entity_id,
-			group_id, group_name, task_id, task_name,
-			changes, user_name, workspace
-		FROM todo_event_logs
-		WHERE group_id = $1
-		ORDER BY timestamp DESC
-		LIMIT 100
-	`
-
-	rows, err := Pool.Query(context.Background(), query, groupId)
-	if err != nil {
-		return []map[string]interface{}{}, err
-	}
-	defer rows.Close()
-
-	var logs []map[string]interface{}
-	for rows.Next() {
-		var (
-			id                                                         int
-			timestamp                                                  time.Time
-			eventType, entity, entityId                                string
-			groupId, groupName, taskId, taskName                       *string
-			changes, userName, workspace                               *string
+		SELECT EXISTS (
+			SELECT 1
+			FROM todo_event_logs
+			WHERE event_type NOT IN ('SNAPSHOT_CREATED', 'SNAPSHOT_TRIGGER')
+			  AND ($1 = '' OR workspace = $1)
+			  AND id > COALESCE(
+				(SELECT MAX(id) FROM todo_event_logs
+				 WHERE event_type = 'SNAPSHOT_CREATED' AND workspace = COALESCE(NULLIF($1, ''), $2)),
+				0
+			  )
 		)
+	`
 
-		if err := rows.Scan(
-			&id, &timestamp, &eventType, &entity, &entityId,
-			&groupId, &groupName, &taskId, &taskName,
-			&changes, &userName, &workspace,
-		); err != nil {
-			continue
-		}
-
-		log := map[string]interface{}{
-			"id":        id,
-			"timestamp": timestamp,
-			"eventType": eventType,
-			"entity":    entity,
-			"entityId":  entityId,
-		}
-
-		if groupId != nil {
-			log["groupId"] = *groupId
-		}
-		if groupName != nil {
-			log["groupName"] = *groupName
-		}
-		if taskId != nil {
-			log["taskId"] = *taskId
-		}
-		if taskName != nil {
-			log["taskName"] = *taskName
-		}
-		if changes != nil {
-			log["changes"] = *changes
-		}
-		if userName != nil {
-			log["user"] = *userName
-		}
-		if workspace != nil {
-			log["workspace"] = *workspace
-		}
-
-		logs = append(logs, log)
+	var changed bool
+	if err := Pool.QueryRow(context.Background(), query, workspace, SystemWorkspace).Scan(&changed); err != nil {
+		return false, err
 	}
-	return logs, nil
+	return changed, nil
 }
 
-// GetTaskLogs retrieves logs for a specific task
-func GetTaskLogs(taskId string) ([]map[string]interface{}, error) {
+// TryAdvisoryLock attempts to take a session-level Postgres advisory lock on a
+// dedicated connection opened outside the pool, so held locks never starve
+// queries of pool connections. On success the caller owns the returned
+// connection and must keep it open for as long as the lock should be held;
+// ReleaseAdvisoryLock unlocks and closes it.
+func TryAdvisoryLock(key int64) (*pgx.Conn, bool, error) {
 	if Pool == nil {
-		return []map[string]interface{}{}, fmt.Errorf("database not connected")
+		return nil, false, fmt.Errorf("database not connected")
 	}
 
-	query := `
-		SELECT
-			id, timestamp, event_type, entity, entity_id,
-			group_id, group_name, task_id, task_name,
-			changes, user_name, workspace
-		FROM todo_event_logs
-		WHERE task_id = $1
-		ORDER BY timestamp DESC
-		LIMIT 100
-	`
-
-	rows, err := Pool.Query(context.Background(), query, taskId)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := pgx.ConnectConfig(ctx, Pool.Config().ConnConfig.Copy())
 	if err != nil {
-		return []map[string]interface{}{}, err
+		return nil, false, err
 	}
-	defer rows.Close()
-
-	var logs []map[string]interface{}
-	for rows.Next() {
-		var (
-			id                                                         int
-			timestamp                                                  time.Time
-			eventType, entity, entityId                                string
-			groupId, groupName, taskId, taskName                       *string
-			changes, userName, workspace                               *string
-		)
 
-		if err := rows.Scan(
-			&id, &timestamp, &eventType, &entity, &entityId,
-			&groupId, &groupName, &taskId, &taskName,
-			&changes, &userName, &workspace,
-		); err != nil {
-			continue
-		}
-
-		log := map[string]interface{}{
-			"id":        id,
-			"timestamp": timestamp,
-			"eventType": eventType,
-			"entity":    entity,
-			"entityId":  entityId,
-		}
-
-		if groupId != nil {
-			log["groupId"] = *groupId
-		}
-		if groupName != nil {
-			log["groupName"] = *groupName
-		}
-		if taskId != nil {
-			log["taskId"] = *taskId
-		}
-		if taskName != nil {
-			log["taskName"] = *taskName
-		}
-		if changes != nil {
-			log["changes"] = *changes
-		}
-		if userName != nil {
-			log["user"] = *userName
-		}
-		if workspace != nil {
-			log["workspace"] = *workspace
-		}
-
-		logs = append(logs, log)
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		conn.Close(context.Background())
+		return nil, false, err
+	}
+	if !locked {
+		conn.Close(context.Background())
+		return nil, false, nil
 	}
-	return logs, nil
+	return conn, true, nil
 }
 
-// GetGroupsSummary retrieves all groups with their log counts and last activity
-func GetGroupsSummary() ([]map[string]interface{}, error) {
-	if Pool == nil {
-		return []map[string]interface{}{}, fmt.Errorf("database not connected")
+// ReleaseAdvisoryLock unlocks a lock taken with TryAdvisoryLock and closes
+// its connection.
+func ReleaseAdvisoryLock(conn *pgx.Conn, key int64) {
+	if conn == nil {
+		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// A broken connection fails to unlock, but its session locks go with it
+	conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", key)
+	conn.Close(ctx)
+}
 
+// GetGroupsSummary retrieves all groups of a workspace with their log counts
+// and last activity from the activity_daily aggregate, so it reads one row
+// per group and day instead of every event. Groups are listed under their
+// most recent name.
+func GetGroupsSummary(workspace string) ([]map[string]interface{}, error) {
 	query := `
 		SELECT
 			group_id,
-			group_name,
-			COUNT(*) as log_count,
-			MAX(timestamp) as last_activity
-		FROM todo_event_logs
-		WHERE group_id IS NOT NULL
-		GROUP BY group_id, group_name
+			COALESCE((ARRAY_AGG(group_name ORDER BY last_activity DESC) FILTER (WHERE group_name IS NOT NULL))[1], '') AS group_name,
+			SUM(event_count)::BIGINT AS log_count,
+			MAX(last_activity) AS last_activity
+		FROM activity_daily
+		WHERE workspace = $1 AND group_id IS NOT NULL
+		GROUP BY group_id
 		ORDER BY last_activity DESC
 	`
 
-	rows, err := Pool.Query(context.Background(), query)
+	summary := []map[string]interface{}{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, workspace)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var groupId, groupName string
+			var logCount int64
+			var lastActivity time.Time
+
+			if err := rows.Scan(&groupId, &groupName, &logCount, &lastActivity); err != nil {
+				return err
+			}
+
+			summary = append(summary, map[string]interface{}{
+				"groupId":      groupId,
+				"groupName":    groupName,
+				"logCount":     logCount,
+				"lastActivity": lastActivity,
+			})
+		}
+		return rows.Err()
+	})
 	if err != nil {
 		return []map[string]interface{}{}, err
 	}
-	defer rows.Close()
-
-	var summary []map[string]interface{}
-	for rows.Next() {
-		var groupId, groupName string
-		var logCount int
-		var lastActivity time.Time
-
-		if err := rows.Scan(&groupId, &groupName, &logCount, &lastActivity); err != nil {
-			continue
-		}
-
-		summary = append(summary, map[string]interface{}{
-			"groupId":      groupId,
-			"groupName":    groupName,
-			"logCount":     logCount,
-			"lastActivity": lastActivity,
-		})
-	}
 	return summary, nil
 }
 
-// GetGroupTasksSummary retrieves all tasks under a group with their log counts
-func GetGroupTasksSummary(groupId string) ([]map[string]interface{}, error) {
-	if Pool == nil {
-		return []map[string]interface{}{}, fmt.Errorf("database not connected")
-	}
-
+// GetGroupTasksSummary retrieves all tasks under a group of a workspace with
+// their log counts and last activity from the activity_daily aggregate.
+// Tasks are listed under their most recent name.
+func GetGroupTasksSummary(workspace, groupId string) ([]map[string]interface{}, error) {
 	query := `
 		SELECT
 			task_id,
-			task_name,
-			COUNT(*) as log_count,
-			MAX(timestamp) as last_activity
-		FROM todo_event_logs
-		WHERE group_id = $1 AND task_id IS NOT NULL
-		GROUP BY task_id, task_name
+			COALESCE((ARRAY_AGG(task_name ORDER BY last_activity DESC) FILTER (WHERE task_name IS NOT NULL))[1], '') AS task_name,
+			SUM(event_count)::BIGINT AS log_count,
+			MAX(last_activity) AS last_activity
+		FROM activity_daily
+		WHERE workspace = $1 AND group_id = $2 AND task_id IS NOT NULL
+		GROUP BY task_id
 		ORDER BY last_activity DESC
 	`
 
-	rows, err := Pool.Query(context.Background(), query, groupId)
+	summary := []map[string]interface{}{}
+	ctx := context.Background()
+	err := inWorkspace(ctx, workspace, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, workspace, groupId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var taskId, taskName string
+			var logCount int64
+			var lastActivity time.Time
+
+			if err := rows.Scan(&taskId, &taskName, &logCount, &lastActivity); err != nil {
+				return err
+			}
+
+			summary = append(summary, map[string]interface{}{
+				"taskId":       taskId,
+				"taskName":     taskName,
+				"logCount":     logCount,
+				"lastActivity": lastActivity,
+			})
+		}
+		return rows.Err()
+	})
 	if err != nil {
 		return []map[string]interface{}{}, err
 	}
-	defer rows.Close()
-
-	var summary []map[string]interface{}
-	for rows.Next() {
-		var taskId, taskName string
-		var logCount int
-		var lastActivity time.Time
-
-		if err := rows.Scan(&taskId, &taskName, &logCount, &lastActivity); err != nil {
-			continue
-		}
-
-		summary = append(summary, map[string]interface{}{
-			"taskId":       taskId,
-			"taskName":     taskName,
-			"logCount":     logCount,
-			"lastActivity": lastActivity,
-		})
-	}
 	return summary, nil
 }
@@ -0,0 +1,65 @@
+package db
+
+import "time"
+
+// UserSummary counts a user's events in a workspace over a time range.
+type UserSummary struct {
+	User        string           `json:"user"`
+	From        time.Time        `json:"from"`
+	To          time.Time        `json:"to"`
+	Total       int64            `json:"total"`
+	ByEventType map[string]int64 `json:"byEventType"`
+	ByDay       []DayCount       `json:"byDay"`
+}
+
+// DayCount is the number of events on one UTC day.
+type DayCount struct {
+	Day   time.Time `json:"day"`
+	Count int64     `json:"count"`
+}
+
+// GetUserSummary counts a user's events by event type and by day from the
+// activity_daily aggregate. Days run midnight to midnight UTC; from defaults
+// to seven days before to, and to defaults to now. Days without activity are
+// included with a zero count.
+func GetUserSummary(workspace, user string, from, to time.Time) (*UserSummary, error) {
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -7)
+	}
+	from = from.UTC().Truncate(24 * time.Hour)
+	to = to.UTC()
+
+	points, err := GetActivitySeries(ActivityFilter{
+		Interval:  "day",
+		Workspace: workspace,
+		User:      user,
+		From:      from,
+		To:        to,
+		By:        "eventType",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UserSummary{
+		User:        user,
+		From:        from,
+		To:          to,
+		ByEventType: map[string]int64{},
+		ByDay:       []DayCount{},
+	}
+
+	perDay := map[time.Time]int64{}
+	for _, p := range points {
+		summary.Total += p.Count
+		summary.ByEventType[p.Key] += p.Count
+		perDay[p.Bucket.UTC()] += p.Count
+	}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		summary.ByDay = append(summary.ByDay, DayCount{Day: day, Count: perDay[day]})
+	}
+	return summary, nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrWorkspaceRequired is returned by workspace-scoped functions called
+// without a workspace.
+var ErrWorkspaceRequired = errors.New("workspace is required")
+
+// SystemWorkspace holds bookkeeping events that belong to no tenant, such
+// as SNAPSHOT_CREATED for whole-database snapshots.
+const SystemWorkspace = "system"
+
+// workspaceRole is the role scoped work runs as. It is not the table owner,
+// so the row-level security policy below applies to it even though the pool
+// itself connects as the owner (which keeps DDL, compression and continuous
+// aggregate refreshes working).
+const workspaceRole = "todo_workspace"
+
+// workspaceSchema creates the scoped role and the isolation policy: rows are
+// visible to, and may only be written by, the workspace named in the
+// transaction-local app.workspace setting. Without the setting nothing is
+// visible, so a missing scope fails closed.
+const workspaceSchema = `
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '` + workspaceRole + `') THEN
+    CREATE ROLE ` + workspaceRole + ` NOLOGIN;
+    EXECUTE format('GRANT ` + workspaceRole + ` TO %I', current_user);
+  END IF;
+END
+$$;
+
+GRANT SELECT, INSERT ON todo_event_logs TO ` + workspaceRole + `;
+GRANT USAGE ON SEQUENCE todo_event_logs_id_seq TO ` + workspaceRole + `;
+` + isolationPolicy
+
+// isolationPolicy (re)creates the isolation policy on todo_event_logs. A
+// backfill swap runs it in its own transaction, so the table it swaps in is
+// never left without the policy.
+const isolationPolicy = `
+DROP POLICY IF EXISTS workspace_isolation ON todo_event_logs;
+CREATE POLICY workspace_isolation ON todo_event_logs
+  USING (workspace = current_setting('app.workspace', true))
+  WITH CHECK (workspace = current_setting('app.workspace', true));
+`
+
+// rowSecurityStatement turns row-level security on todo_event_logs on or
+// off.
+func rowSecurityStatement(enabled bool) string {
+	if enabled {
+		return `ALTER TABLE todo_event_logs ENABLE ROW LEVEL SECURITY`
+	}
+	return `ALTER TABLE todo_event_logs DISABLE ROW LEVEL SECURITY`
+}
+
+// ensureRowSecurity turns the workspace isolation policy on or off.
+func ensureRowSecurity(enabled bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := Pool.Exec(ctx, rowSecurityStatement(enabled)); err != nil {
+		return fmt.Errorf("row-level security setup error: %w", err)
+	}
+
+	if enabled {
+		fmt.Println("🔒 Row-level security: todo_event_logs rows isolated by workspace")
+	} else {
+		fmt.Println("⚠️ Row-level security disabled - workspace isolation relies on query filters only")
+	}
+	return nil
+}
+
+// inWorkspace runs fn in a transaction scoped to one workspace: it runs as
+// the workspace role with app.workspace set, so the isolation policy limits
+// every statement to that workspace's rows. Queries still filter on the
+// workspace explicitly, which keeps them correct (and index-friendly) when
+// row-level security is disabled.
+func inWorkspace(ctx context.Context, workspace string, fn func(tx pgx.Tx) error) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+	if workspace == "" {
+		return ErrWorkspaceRequired
+	}
+
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+workspaceRole); err != nil {
+		return fmt.Errorf("workspace role error: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.workspace', $1, true)", workspace); err != nil {
+		return fmt.Errorf("workspace scope error: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ListWorkspaces returns every workspace with logged events, excluding the
+// system workspace. Like the archiver's chunk functions it reads across
+// tenants and is meant for background jobs, not for the API.
+func ListWorkspaces() ([]string, error) {
+	if Pool == nil {
+		return []string{}, fmt.Errorf("database not connected")
+	}
+
+	rows, err := Pool.Query(context.Background(), `
+		SELECT DISTINCT workspace
+		FROM todo_event_logs
+		WHERE workspace IS NOT NULL AND workspace <> '' AND workspace <> $1
+		ORDER BY workspace
+	`, SystemWorkspace)
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	workspaces := []string{}
+	for rows.Next() {
+		var w string
+		if err := rows.Scan(&w); err != nil {
+			return workspaces, err
+		}
+		workspaces = append(workspaces, w)
+	}
+	return workspaces, rows.Err()
+}
@@ -0,0 +1,234 @@
+package export
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"todo-consumer/db"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Supported export formats.
+const (
+	CSV     = "csv"
+	NDJSON  = "ndjson"
+	Parquet = "parquet"
+)
+
+// parquetRowGroup bounds how many rows the Parquet writer buffers before
+// flushing a row group, so large exports stay within constant memory.
+const parquetRowGroup = 50000
+
+// csvHeader lists the exported columns, in order.
+var csvHeader = []string{
+	"id", "timestamp", "event_type", "entity", "entity_id",
+	"group_id", "group_name", "task_id", "task_name",
+	"changes", "user_name", "workspace", "event_data",
+}
+
+// Options selects the output encoding of an export.
+type Options struct {
+	Format string // csv, ndjson or parquet
+	Gzip   bool   // gzip the output (csv and ndjson; Parquet compresses internally)
+}
+
+// Validate checks the format and compression combination.
+func (o Options) Validate() error {
+	switch o.Format {
+	case CSV, NDJSON:
+		return nil
+	case Parquet:
+		if o.Gzip {
+			return fmt.Errorf("gzip is not supported for parquet, which is compressed internally")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported export format %q (use csv, ndjson or parquet)", o.Format)
+	}
+}
+
+// Extension is the file extension for exports written with these options.
+func (o Options) Extension() string {
+	if o.Gzip {
+		return "." + o.Format + ".gz"
+	}
+	return "." + o.Format
+}
+
+// ContentType is the MIME type of the export.
+func (o Options) ContentType() string {
+	switch o.Format {
+	case CSV:
+		return "text/csv"
+	case NDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// parquetRow is the Parquet schema of an exported row.
+type parquetRow struct {
+	ID        int64     `parquet:"id"`
+	Timestamp time.Time `parquet:"timestamp,timestamp(microsecond)"`
+	EventType string    `parquet:"event_type"`
+	Entity    string    `parquet:"entity"`
+	EntityID  string    `parquet:"entity_id"`
+	GroupID   string    `parquet:"group_id,optional"`
+	GroupName string    `parquet:"group_name,optional"`
+	TaskID    string    `parquet:"task_id,optional"`
+	TaskName  string    `parquet:"task_name,optional"`
+	Changes   string    `parquet:"changes,optional"`
+	User      string    `parquet:"user_name,optional"`
+	Workspace string    `parquet:"workspace"`
+	EventData string    `parquet:"event_data,optional"`
+}
+
+// Write streams every row matched by q to w in the requested format and
+// returns the number of rows written.
+func Write(w io.Writer, q *db.LogQuery, opts Options) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+
+	var gz *gzip.Writer
+	if opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	var n int
+	var err error
+	switch opts.Format {
+	case CSV:
+		n, err = writeCSV(w, q)
+	case NDJSON:
+		n, err = writeNDJSON(w, q)
+	case Parquet:
+		n, err = writeParquet(w, q)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func writeCSV(w io.Writer, q *db.LogQuery) (int, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return 0, err
+	}
+
+	n, err := q.Stream(func(e db.LogEntry) error {
+		return writer.Write([]string{
+			strconv.Itoa(e.ID), e.Timestamp.UTC().Format(time.RFC3339Nano),
+			e.EventType, e.Entity, e.EntityID,
+			e.GroupID, e.GroupName, e.TaskID, e.TaskName,
+			e.Changes, e.User, e.Workspace, string(e.EventData),
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+
+	writer.Flush()
+	return n, writer.Error()
+}
+
+func writeNDJSON(w io.Writer, q *db.LogQuery) (int, error) {
+	encoder := json.NewEncoder(w)
+	return q.Stream(func(e db.LogEntry) error {
+		return encoder.Encode(e)
+	})
+}
+
+func writeParquet(w io.Writer, q *db.LogQuery) (int, error) {
+	writer := parquet.NewGenericWriter[parquetRow](w,
+		parquet.Compression(&parquet.Snappy),
+		parquet.MaxRowsPerRowGroup(parquetRowGroup),
+	)
+
+	n, err := q.Stream(func(e db.LogEntry) error {
+		_, err := writer.Write([]parquetRow{{
+			ID:        int64(e.ID),
+			Timestamp: e.Timestamp.UTC(),
+			EventType: e.EventType,
+			Entity:    e.Entity,
+			EntityID:  e.EntityID,
+			GroupID:   e.GroupID,
+			GroupName: e.GroupName,
+			TaskID:    e.TaskID,
+			TaskName:  e.TaskName,
+			Changes:   e.Changes,
+			User:      e.User,
+			Workspace: e.Workspace,
+			EventData: string(e.EventData),
+		}})
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, writer.Close()
+}
+
+// Upload streams an export straight into the S3 bucket (S3_BUCKET_NAME)
+// under exports/todo_event_logs/<name><extension> and returns its URI.
+func Upload(q *db.LogQuery, opts Options, name string) (string, int, error) {
+	if err := opts.Validate(); err != nil {
+		return "", 0, err
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("AWS session error: %w", err)
+	}
+	bucketName := os.Getenv("S3_BUCKET_NAME")
+	key := "exports/todo_event_logs/" + name + opts.Extension()
+
+	pr, pw := io.Pipe()
+	written := make(chan int, 1)
+	go func() {
+		n, err := Write(pw, q, opts)
+		pw.CloseWithError(err)
+		written <- n
+	}()
+
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        pr,
+		ContentType: aws.String(opts.ContentType()),
+	}
+	if opts.Gzip {
+		input.ContentEncoding = aws.String("gzip")
+	}
+
+	_, err = s3manager.NewUploader(sess).Upload(input)
+	if err != nil {
+		// Unblock the writer if the upload gave up early
+		pr.CloseWithError(err)
+	}
+	n := <-written
+	if err != nil {
+		return "", n, err
+	}
+	return fmt.Sprintf("s3://%s/%s", bucketName, key), n, nil
+}
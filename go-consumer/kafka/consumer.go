@@ -3,10 +3,14 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"todo-consumer/db"
+	"todo-consumer/message"
+	"todo-consumer/producer"
+	"todo-consumer/tracing"
 
 	"github.com/segmentio/kafka-go"
 )
@@ -29,93 +33,236 @@ type Payload struct {
 	User      string `json:"user"`
 	Workspace string `json:"workspace"`
 	Timestamp string `json:"timestamp"`
+
+	// Structured entity state before/after the change, when the producer
+	// sends it. Stored in event_data for state reconstruction.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// EventData returns the JSON stored in todo_event_logs.event_data, or nil
+// when the producer sent no structured state.
+func (p Payload) EventData() []byte {
+	if len(p.Before) == 0 && len(p.After) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(map[string]json.RawMessage{
+		"before": nullIfEmpty(p.Before),
+		"after":  nullIfEmpty(p.After),
+	})
+	if err != nil {
+		return nil
+	}
+	return data
 }
 
-func StartConsumer() {
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "todo-history-events",
-		GroupID: "todo-consumer-group-go",
+func nullIfEmpty(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return json.RawMessage("null")
+	}
+	return raw
+}
+
+// Inserts that fail for a reason other than the event itself (the database
+// is down or failing over) are retried with a backoff between these bounds
+// rather than dead-lettered, and the offset does not advance meanwhile.
+const (
+	minRetryBackoff = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// errRetry marks a processEvent failure worth retrying.
+var errRetry = errors.New("will retry")
+
+// StartConsumer consumes the history topic in the consumer group until
+// Close is called. Replicas share its partitions; each one logs what it is
+// assigned and, on revocation, commits the events it has written before
+// another replica takes the partitions over. It returns an error only when
+// it cannot join the group.
+//
+// snapshotTriggers decides whether SNAPSHOT_TRIGGER events take a snapshot;
+// the unified service leaves snapshots to Express and only logs them.
+func StartConsumer(snapshotTriggers bool) error {
+	handle := func(revoked context.Context, m kafka.Message, readStart time.Time) error {
+		return handleEvent(revoked, m, readStart, snapshotTriggers)
+	}
+	c := NewGroupConsumer("todo-history-events", "todo-consumer-group-go", handle)
+	c.OnAssigned(func(gen *kafka.Generation, partitions []int) error {
+		fmt.Printf("📌 Assigned partitions %v (generation %d, member %s)\n", partitions, gen.ID, gen.MemberID)
+		return nil
+	})
+	c.OnRevoked(func(gen *kafka.Generation, partitions []int) error {
+		fmt.Printf("🔄 Revoked partitions %v (generation %d), offsets committed\n", partitions, gen.ID)
+		return nil
 	})
 
 	fmt.Println("🚀 Go Kafka Consumer started on topic: todo-history-events")
 
+	return c.Run(context.Background())
+}
+
+// handleEvent processes one event, retrying transient failures until they
+// succeed or the partition is revoked. Each attempt is traced on its own.
+func handleEvent(revoked context.Context, m kafka.Message, readStart time.Time, snapshotTriggers bool) error {
+	backoff := minRetryBackoff
 	for {
-		m, err := reader.ReadMessage(context.Background())
-		if err != nil {
-			fmt.Printf("❌ Read error: %v\n", err)
-			time.Sleep(2 * time.Second)
-			continue
+		ctx, span := tracing.StartReceive(m, readStart)
+		err := processEvent(ctx, m, snapshotTriggers)
+		tracing.End(span, err)
+		if !errors.Is(err, errRetry) {
+			return nil
 		}
 
-		var e Event
-		if err := json.Unmarshal(m.Value, &e); err != nil {
-			fmt.Printf("⚠️  JSON parse error: %v\n", err)
-			continue
+		fmt.Printf("⏳ Retrying offset %d on partition %d in %s\n", m.Offset, m.Partition, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-revoked.Done():
+			return err
 		}
+		backoff = min(backoff*2, maxRetryBackoff)
+		readStart = time.Now()
+	}
+}
 
-		// Parse ISO timestamp or fallback to now
-		ts, err := time.Parse(time.RFC3339, e.Timestamp)
-		if err != nil {
-			ts = time.Now().UTC()
-		}
+// DecodeEvent reads the envelope and event of a consumed message and checks
+// the event belongs to a workspace. The backfill command decodes the topic
+// with it too, so history rebuilt from Kafka matches what the consumer
+// writes.
+func DecodeEvent(m kafka.Message) (message.Envelope, Event, error) {
+	var e Event
 
-		// Extract group and task IDs from the payload (now properly sent by Node.js)
-		groupId := e.Payload.GroupId
-		groupName := e.Payload.GroupName
-		taskId := e.Payload.TaskId
-		taskName := e.Payload.TaskName
+	// Headers decide how the value is read (schema version, encoding)
+	env, err := message.Parse(m)
+	if err != nil {
+		return env, e, err
+	}
+	if err := env.DecodeJSON(&e); err != nil {
+		return env, e, err
+	}
 
-		// For Group entities, the groupId is the entityId itself
-		if e.Payload.Entity == "Group" {
-			groupId = e.Payload.EntityId
-		}
+	// Every event must belong to a workspace; history is isolated per tenant
+	if e.Payload.Workspace == "" {
+		return env, e, fmt.Errorf("no workspace")
+	}
+	return env, e, nil
+}
 
-		// For Task entities, taskId is the entityId
-		if e.Payload.Entity == "Task" {
-			taskId = e.Payload.EntityId
+// Time returns when the event happened. Express sends the timestamp inside
+// the payload; the top-level field is read for other producers. Without
+// either, the time the message was written to Kafka is used.
+func (e Event) Time(m kafka.Message) time.Time {
+	for _, s := range []string{e.Payload.Timestamp, e.Timestamp} {
+		if ts, err := time.Parse(time.RFC3339, s); err == nil {
+			return ts.UTC()
 		}
+	}
+	if !m.Time.IsZero() {
+		return m.Time.UTC()
+	}
+	return time.Now().UTC()
+}
 
-		// Handle snapshot triggers
-		if e.EventType == "SNAPSHOT_TRIGGER" {
-			if err := handleSnapshotTrigger(e.Payload, ts); err != nil {
-				fmt.Printf("❌ Snapshot error: %v\n", err)
-			}
-			continue
-		}
+// GroupID returns the group the event belongs to; for Group entities that
+// is the entity itself.
+func (e Event) GroupID() string {
+	if e.Payload.Entity == "Group" {
+		return e.Payload.EntityId
+	}
+	return e.Payload.GroupId
+}
 
-		// Save to Timescale with proper group and task references
-		if err := db.InsertLog(
-			e.EventType,
-			e.Payload.Entity,
-			e.Payload.EntityId,
-			groupId,
-			groupName,
-			taskId,
-			taskName,
-			e.Payload.Changes,
-			e.Payload.User,
-			e.Payload.Workspace,
-			ts,
-		); err != nil {
-			fmt.Printf("❌ DB insert error: %v\n", err)
-			continue
-		}
+// TaskID returns the task the event belongs to; for Task entities that is
+// the entity itself.
+func (e Event) TaskID() string {
+	if e.Payload.Entity == "Task" {
+		return e.Payload.EntityId
+	}
+	return e.Payload.TaskId
+}
+
+// processEvent stores one consumed event and returns why it failed, for the
+// trace. Events that can never be stored (undecodable, invalid, rejected by
+// the database) are parked on the DLQ; an insert that failed otherwise
+// returns errRetry and is left for the caller to retry.
+func processEvent(ctx context.Context, m kafka.Message, snapshotTriggers bool) error {
+	env, e, err := DecodeEvent(m)
+	if err != nil {
+		fmt.Printf("⚠️  Rejected event %s from %s: %v\n", env.EventID, env.Source, err)
+		deadLetter(ctx, m, err.Error())
+		return err
+	}
+
+	ts := e.Time(m)
+	groupId := e.GroupID()
+	groupName := e.Payload.GroupName
+	taskId := e.TaskID()
+	taskName := e.Payload.TaskName
 
-		// Display formatted message
-		var displayMsg string
-		if e.Payload.Changes != "" {
-			displayMsg = e.Payload.Changes
-		} else {
-			displayMsg = fmt.Sprintf("%s operation on %s", e.EventType, e.Payload.Entity)
+	// Handle snapshot triggers
+	if e.EventType == "SNAPSHOT_TRIGGER" {
+		if !snapshotTriggers {
+			fmt.Printf("📸 Snapshot trigger received: %s by %s\n", e.Payload.Changes, e.Payload.User)
+			return nil
+		}
+		err := handleSnapshotTrigger(ctx, env, e.Payload, ts)
+		if err != nil {
+			fmt.Printf("❌ Snapshot error: %v\n", err)
 		}
+		return err
+	}
+
+	// Save to Timescale with proper group and task references
+	_, insertSpan := tracing.Start(ctx, "InsertLog")
+	err = db.InsertLog(
+		e.EventType,
+		e.Payload.Entity,
+		e.Payload.EntityId,
+		groupId,
+		groupName,
+		taskId,
+		taskName,
+		e.Payload.Changes,
+		e.Payload.User,
+		e.Payload.Workspace,
+		e.Payload.EventData(),
+		ts,
+	)
+	tracing.End(insertSpan, err)
+	if err != nil && !db.IsPermanent(err) {
+		fmt.Printf("❌ DB insert error: %v\n", err)
+		return fmt.Errorf("insert failed: %w (%w)", err, errRetry)
+	}
+	if err != nil {
+		fmt.Printf("⚠️  Rejected event %s by the database: %v\n", env.EventID, err)
+		deadLetter(ctx, m, fmt.Sprintf("insert failed: %v", err))
+		return err
+	}
+
+	// Display formatted message
+	var displayMsg string
+	if e.Payload.Changes != "" {
+		displayMsg = e.Payload.Changes
+	} else {
+		displayMsg = fmt.Sprintf("%s operation on %s", e.EventType, e.Payload.Entity)
+	}
+
+	fmt.Printf("📝 [%s] %s - %s (Group: %s, Task: %s)\n",
+		e.EventType,
+		ts.Format("15:04:05"),
+		displayMsg,
+		groupName,
+		taskName,
+	)
+	return nil
+}
 
-		fmt.Printf("📝 [%s] %s - %s (Group: %s, Task: %s)\n",
-			e.EventType,
-			ts.Format("15:04:05"),
-			displayMsg,
-			groupName,
-			taskName,
-		)
+// deadLetter parks a message that could not be processed on the DLQ instead
+// of dropping it.
+func deadLetter(ctx context.Context, m kafka.Message, reason string) {
+	delivery, err := producer.DeadLetter(ctx, m, reason)
+	if err != nil {
+		fmt.Printf("❌ Dead-letter error, message at offset %d dropped: %v\n", m.Offset, err)
+		return
 	}
+	fmt.Printf("📮 Message at offset %d sent to %s (offset %d)\n", m.Offset, delivery.Topic, delivery.Offset)
 }
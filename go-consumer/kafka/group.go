@@ -0,0 +1,371 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"todo-consumer/kafkaclient"
+	"todo-consumer/topics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// defaultCommitInterval is how often processed offsets are committed while
+// partitions stay assigned.
+const defaultCommitInterval = 5 * time.Second
+
+// HandleFunc handles one message of an assigned partition, with the time its
+// read began. ctx is done once the partition is revoked; it is for abandoning
+// retries, not for cutting short an event being written. A handler that
+// returns an error has not handled the message: the partition stops there
+// and its next owner reads the message again.
+type HandleFunc func(ctx context.Context, m kafka.Message, readStart time.Time) error
+
+// RebalanceFunc is called with the partitions of the topic assigned to or
+// revoked from this instance. Revoke callbacks run once every in-flight
+// event of the generation has been handled and before the partitions are
+// handed to another member, while the generation can still commit.
+type RebalanceFunc func(gen *kafka.Generation, partitions []int) error
+
+// PartitionStatus is the position of one assigned partition. Offsets are the
+// next offset to handle; -2 means the partition starts from its earliest
+// offset and nothing has been read yet, -1 that nothing was committed.
+type PartitionStatus struct {
+	Partition int   `json:"partition"`
+	Offset    int64 `json:"offset"`
+	Committed int64 `json:"committed"`
+}
+
+// Assignment is what one group consumer of this instance currently owns.
+type Assignment struct {
+	Host         string            `json:"host"`
+	Group        string            `json:"group"`
+	Topic        string            `json:"topic"`
+	MemberID     string            `json:"memberId,omitempty"`
+	GenerationID int32             `json:"generationId,omitempty"`
+	AssignedAt   *time.Time        `json:"assignedAt,omitempty"`
+	Partitions   []PartitionStatus `json:"partitions"`
+}
+
+// GroupConsumer reads a topic in a consumer group one generation at a time,
+// handling each assigned partition in its own goroutine. Unlike a group
+// kafka.Reader it knows when partitions are assigned and revoked: offsets of
+// handled events are committed periodically and, on revocation, once the
+// events in flight are written, so the next owner neither skips nor repeats
+// them.
+type GroupConsumer struct {
+	topic          string
+	groupID        string
+	handle         HandleFunc
+	commitInterval time.Duration
+	maxBytes       int // largest message of the topic, set by Run
+
+	onAssigned []RebalanceFunc
+	onRevoked  []RebalanceFunc
+
+	mu         sync.Mutex
+	group      *kafka.ConsumerGroup
+	assignment Assignment
+	handled    map[int]int64 // next offset to commit, per partition
+	committed  map[int]int64
+}
+
+var (
+	consumersMu sync.Mutex
+	consumers   []*GroupConsumer
+)
+
+// NewGroupConsumer returns a consumer passing every message of topic to
+// handle. Its first revoke callback commits the handled offsets; callbacks
+// added with OnAssigned and OnRevoked run after it.
+func NewGroupConsumer(topic, groupID string, handle HandleFunc) *GroupConsumer {
+	c := &GroupConsumer{
+		topic:          topic,
+		groupID:        groupID,
+		handle:         handle,
+		commitInterval: defaultCommitInterval,
+	}
+	c.assignment = c.emptyAssignment()
+	c.OnRevoked(c.commit)
+	return c
+}
+
+// OnAssigned adds a callback run when a generation assigns partitions,
+// before any of them is read.
+func (c *GroupConsumer) OnAssigned(fn RebalanceFunc) {
+	c.onAssigned = append(c.onAssigned, fn)
+}
+
+// OnRevoked adds a callback run when the partitions of a generation are
+// revoked (rebalance or Close).
+func (c *GroupConsumer) OnRevoked(fn RebalanceFunc) {
+	c.onRevoked = append(c.onRevoked, fn)
+}
+
+// Run joins the group and consumes until ctx is done or Close is called.
+func (c *GroupConsumer) Run(ctx context.Context) error {
+	maxBytes, err := topics.MaxMessageBytes(c.topic)
+	if err != nil {
+		return err
+	}
+	c.maxBytes = maxBytes
+
+	group, err := kafkaclient.NewConsumerGroup(c.topic, c.groupID)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.group = group
+	c.mu.Unlock()
+
+	register(c)
+	defer unregister(c)
+	defer group.Close()
+
+	for {
+		gen, err := group.Next(ctx)
+		if errors.Is(err, kafka.ErrGroupClosed) || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			fmt.Printf("❌ Consumer group %s error: %v\n", c.groupID, err)
+			continue
+		}
+		c.runGeneration(gen)
+	}
+}
+
+// Close leaves the group after the current generation's partitions are
+// revoked, so handled offsets are committed before the process exits.
+func (c *GroupConsumer) Close() error {
+	c.mu.Lock()
+	group := c.group
+	c.mu.Unlock()
+	if group == nil {
+		return nil
+	}
+	return group.Close()
+}
+
+// Assignment returns the partitions the consumer currently owns.
+func (c *GroupConsumer) Assignment() Assignment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a := c.assignment
+	a.Partitions = make([]PartitionStatus, len(c.assignment.Partitions))
+	for i, p := range c.assignment.Partitions {
+		p.Offset = c.handled[p.Partition]
+		p.Committed = c.committed[p.Partition]
+		a.Partitions[i] = p
+	}
+	return a
+}
+
+// runGeneration starts reading the partitions of a generation. The
+// generation ends (and Next returns the following one) once every
+// goroutine started here has returned.
+func (c *GroupConsumer) runGeneration(gen *kafka.Generation) {
+	assigned := gen.Assignments[c.topic]
+	partitions := make([]int, len(assigned))
+	for i, a := range assigned {
+		partitions[i] = a.ID
+	}
+	sort.Ints(partitions)
+
+	c.assign(gen, assigned)
+	c.runHooks("assigned", c.onAssigned, gen, partitions)
+
+	var readers sync.WaitGroup
+	for _, a := range assigned {
+		readers.Add(1)
+		gen.Start(func(ctx context.Context) {
+			defer readers.Done()
+			c.consume(ctx, a)
+		})
+	}
+
+	gen.Start(func(ctx context.Context) {
+		ticker := time.NewTicker(c.commitInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.commit(gen, partitions); err != nil {
+					fmt.Printf("⚠️ Offset commit error: %v\n", err)
+				}
+			case <-ctx.Done():
+				// Revoked: let the readers finish the events they are
+				// writing before anything is committed or handed over
+				readers.Wait()
+				c.runHooks("revoked", c.onRevoked, gen, partitions)
+				c.revoke()
+				return
+			}
+		}
+	})
+}
+
+// consume reads one assigned partition from its committed offset until the
+// generation ends. Events are not cancelled with the generation's context,
+// so one being written when partitions are revoked is finished, not
+// abandoned; one whose handler gave up stays uncommitted.
+func (c *GroupConsumer) consume(ctx context.Context, a kafka.PartitionAssignment) {
+	reader, err := kafkaclient.NewPartitionReader(c.topic, a.ID, c.maxBytes)
+	if err != nil {
+		fmt.Printf("❌ Kafka config error: %v\n", err)
+		return
+	}
+	defer reader.Close()
+	if err := reader.SetOffset(a.Offset); err != nil {
+		fmt.Printf("❌ Partition %d seek error: %v\n", a.ID, err)
+		return
+	}
+
+	for {
+		readStart := time.Now()
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("❌ Read error on partition %d: %v\n", a.ID, err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		if err := c.handle(ctx, m, readStart); err != nil {
+			fmt.Printf("↩️ Partition %d stopped at unhandled offset %d: %v\n", a.ID, m.Offset, err)
+			return
+		}
+
+		c.mu.Lock()
+		c.handled[m.Partition] = m.Offset + 1
+		c.mu.Unlock()
+	}
+}
+
+// commit commits the offsets handled since the last commit.
+func (c *GroupConsumer) commit(gen *kafka.Generation, _ []int) error {
+	c.mu.Lock()
+	offsets := map[int]int64{}
+	for partition, next := range c.handled {
+		if next >= 0 && next != c.committed[partition] {
+			offsets[partition] = next
+		}
+	}
+	c.mu.Unlock()
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	if err := gen.CommitOffsets(map[string]map[int]int64{c.topic: offsets}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	for partition, next := range offsets {
+		c.committed[partition] = next
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *GroupConsumer) runHooks(event string, hooks []RebalanceFunc, gen *kafka.Generation, partitions []int) {
+	for _, fn := range hooks {
+		if err := fn(gen, partitions); err != nil {
+			fmt.Printf("⚠️ Partitions %s callback error (generation %d): %v\n", event, gen.ID, err)
+		}
+	}
+}
+
+// assign records the partitions of a new generation. Their committed
+// offsets are where reading starts.
+func (c *GroupConsumer) assign(gen *kafka.Generation, assigned []kafka.PartitionAssignment) {
+	now := time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.assignment = c.emptyAssignment()
+	c.assignment.MemberID = gen.MemberID
+	c.assignment.GenerationID = gen.ID
+	c.assignment.AssignedAt = &now
+	c.handled = map[int]int64{}
+	c.committed = map[int]int64{}
+	for _, a := range assigned {
+		c.assignment.Partitions = append(c.assignment.Partitions, PartitionStatus{Partition: a.ID})
+		c.handled[a.ID] = a.Offset
+		c.committed[a.ID] = a.Offset
+		if a.Offset == kafka.FirstOffset {
+			c.committed[a.ID] = -1
+		}
+	}
+	sort.Slice(c.assignment.Partitions, func(i, j int) bool {
+		return c.assignment.Partitions[i].Partition < c.assignment.Partitions[j].Partition
+	})
+}
+
+// revoke forgets the partitions of the ended generation.
+func (c *GroupConsumer) revoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.assignment = c.emptyAssignment()
+	c.handled = map[int]int64{}
+	c.committed = map[int]int64{}
+}
+
+func (c *GroupConsumer) emptyAssignment() Assignment {
+	host, _ := os.Hostname()
+	return Assignment{Host: host, Group: c.groupID, Topic: c.topic, Partitions: []PartitionStatus{}}
+}
+
+func register(c *GroupConsumer) {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	consumers = append(consumers, c)
+}
+
+func unregister(c *GroupConsumer) {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	for i, other := range consumers {
+		if other == c {
+			consumers = append(consumers[:i], consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Assignments returns the partitions owned by every group consumer running
+// in this process, for the admin API.
+func Assignments() []Assignment {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+
+	assignments := make([]Assignment, len(consumers))
+	for i, c := range consumers {
+		assignments[i] = c.Assignment()
+	}
+	return assignments
+}
+
+// Close closes every running group consumer, committing the offsets of
+// handled events, so the service can exit without redelivering them.
+func Close() error {
+	consumersMu.Lock()
+	running := append([]*GroupConsumer(nil), consumers...)
+	consumersMu.Unlock()
+
+	var errs []error
+	for _, c := range running {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
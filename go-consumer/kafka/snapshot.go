@@ -1,14 +1,21 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"todo-consumer/message"
 	"todo-consumer/snapshot"
 )
 
-func handleSnapshotTrigger(payload Payload, ts time.Time) error {
-	fmt.Printf("📸 Snapshot trigger: %s by %s\n", payload.Changes, payload.User)
-	
-	return snapshot.CreateSnapshot(payload.Changes, payload.User)
+func handleSnapshotTrigger(ctx context.Context, env message.Envelope, payload Payload, ts time.Time) error {
+	fmt.Printf("📸 Snapshot trigger %s from %s: %s by %s\n", env.EventID, env.Source, payload.Changes, payload.User)
+
+	// Per-workspace mode snapshots only the workspace the trigger came from
+	workspace := ""
+	if snapshot.PerWorkspace() {
+		workspace = payload.Workspace
+	}
+	return snapshot.CreateSnapshot(ctx, payload.Changes, payload.User, workspace)
 }
\ No newline at end of file
@@ -0,0 +1,261 @@
+package kafkaclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/saslauthenticate"
+	"github.com/segmentio/kafka-go/protocol/saslhandshake"
+)
+
+// saslAuthenticationFailed is the Kafka SASL_AUTHENTICATION_FAILED code.
+const saslAuthenticationFailed = 58
+
+// fakeBroker is an in-process broker behind mutual TLS that authenticates
+// clients with SASL PLAIN and answers ApiVersions and Metadata, enough for a
+// Dialer or Transport round trip.
+type fakeBroker struct {
+	t                  *testing.T
+	listener           net.Listener
+	username, password string
+
+	mu            sync.Mutex
+	authenticated []string // SASL users, in order
+	clientCerts   []string // client certificate common names
+}
+
+func newFakeBroker(t *testing.T, p *testPKI, username, password string) *fakeBroker {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(p.serverCert, p.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{t: t, listener: listener, username: username, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) addr() string { return b.listener.Addr().String() }
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn.(*tls.Conn))
+	}
+}
+
+func (b *fakeBroker) handle(conn *tls.Conn) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.clientCerts = append(b.clientCerts, conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	b.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		version, correlationID, _, msg, err := protocol.ReadRequest(r)
+		if err != nil {
+			return
+		}
+
+		var resp protocol.Message
+		switch req := msg.(type) {
+		case *apiversions.Request:
+			resp = &apiversions.Response{ApiKeys: []apiversions.ApiKeyResponse{
+				{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+				{ApiKey: int16(protocol.Metadata), MinVersion: 0, MaxVersion: 1},
+				{ApiKey: int16(protocol.SaslHandshake), MinVersion: 0, MaxVersion: 1},
+				{ApiKey: int16(protocol.SaslAuthenticate), MinVersion: 0, MaxVersion: 0},
+			}}
+		case *saslhandshake.Request:
+			resp = &saslhandshake.Response{Mechanisms: []string{"PLAIN"}}
+			if req.Mechanism != "PLAIN" {
+				resp = &saslhandshake.Response{ErrorCode: int16(kafka.UnsupportedSASLMechanism), Mechanisms: []string{"PLAIN"}}
+			}
+		case *saslauthenticate.Request:
+			// PLAIN: authzid NUL username NUL password
+			parts := bytes.Split(req.AuthBytes, []byte{0})
+			if len(parts) != 3 || string(parts[1]) != b.username || string(parts[2]) != b.password {
+				resp = &saslauthenticate.Response{ErrorCode: saslAuthenticationFailed, ErrorMessage: "bad credentials"}
+				break
+			}
+			authenticated = true
+			b.mu.Lock()
+			b.authenticated = append(b.authenticated, string(parts[1]))
+			b.mu.Unlock()
+			resp = &saslauthenticate.Response{}
+		case *metadata.Request:
+			if !authenticated {
+				return
+			}
+			host, port, _ := net.SplitHostPort(b.addr())
+			n, _ := strconv.Atoi(port)
+			resp = &metadata.Response{
+				Brokers:      []metadata.ResponseBroker{{NodeID: 1, Host: host, Port: int32(n)}},
+				ControllerID: 1,
+			}
+		default:
+			b.t.Errorf("fake broker: unexpected request %T", msg)
+			return
+		}
+
+		if err := protocol.WriteResponse(conn, version, correlationID, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) seen() (users, certs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.authenticated...), append([]string(nil), b.clientCerts...)
+}
+
+// brokerConfig returns the client config for b as FromEnv builds it, with
+// the given SASL password.
+func brokerConfig(t *testing.T, p *testPKI, b *fakeBroker, password string) *Config {
+	t.Helper()
+	clearEnv(t)
+	t.Setenv("KAFKA_BROKERS", b.addr())
+	t.Setenv("KAFKA_TLS", "true")
+	t.Setenv("KAFKA_TLS_CA_FILE", p.caFile)
+	t.Setenv("KAFKA_TLS_CERT_FILE", p.clientCert)
+	t.Setenv("KAFKA_TLS_KEY_FILE", p.clientKey)
+	t.Setenv("KAFKA_SASL_MECHANISM", "PLAIN")
+	t.Setenv("KAFKA_SASL_USERNAME", "consumer")
+	t.Setenv("KAFKA_SASL_PASSWORD", password)
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestDialerRoundTrip(t *testing.T) {
+	p := newTestPKI(t)
+	b := newFakeBroker(t, p, "consumer", "secret")
+	cfg := brokerConfig(t, p, b, "secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := cfg.Dialer().DialContext(ctx, "tcp", cfg.Brokers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	versions, err := conn.ApiVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 {
+		t.Errorf("ApiVersions returned %d APIs, want 4", len(versions))
+	}
+
+	users, certs := b.seen()
+	if len(users) != 1 || users[0] != "consumer" {
+		t.Errorf("broker authenticated %v, want [consumer]", users)
+	}
+	if len(certs) != 1 || certs[0] != "client" {
+		t.Errorf("broker saw client certificates %v, want [client]", certs)
+	}
+}
+
+func TestDialerRejectedCredentials(t *testing.T) {
+	p := newTestPKI(t)
+	b := newFakeBroker(t, p, "consumer", "secret")
+	cfg := brokerConfig(t, p, b, "wrong")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := cfg.Dialer().DialContext(ctx, "tcp", cfg.Brokers[0])
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded with the wrong SASL password")
+	}
+	if users, _ := b.seen(); len(users) != 0 {
+		t.Errorf("broker authenticated %v", users)
+	}
+}
+
+func TestDialerRequiresTrustedBroker(t *testing.T) {
+	p := newTestPKI(t)
+	b := newFakeBroker(t, p, "consumer", "secret")
+	cfg := brokerConfig(t, p, b, "secret")
+	cfg.TLS.RootCAs = nil // system roots do not trust the test CA
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := cfg.Dialer().DialContext(ctx, "tcp", cfg.Brokers[0])
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded to a broker signed by an untrusted CA")
+	}
+	if users, _ := b.seen(); len(users) != 0 {
+		t.Errorf("credentials sent to an untrusted broker: %v", users)
+	}
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	p := newTestPKI(t)
+	b := newFakeBroker(t, p, "consumer", "secret")
+	cfg := brokerConfig(t, p, b, "secret")
+
+	transport := cfg.Transport()
+	defer transport.CloseIdleConnections()
+	client := &kafka.Client{Addr: kafka.TCP(cfg.Brokers...), Transport: transport, Timeout: 5 * time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Brokers) != 1 || resp.Brokers[0].ID != 1 {
+		t.Errorf("metadata brokers = %+v, want the fake broker", resp.Brokers)
+	}
+
+	users, certs := b.seen()
+	if len(users) == 0 || users[0] != "consumer" {
+		t.Errorf("broker authenticated %v, want consumer", users)
+	}
+	for _, cn := range certs {
+		if cn != "client" {
+			t.Errorf("broker saw client certificate %q", cn)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package kafkaclient builds every Kafka reader and writer of the service
+// from one connection config, so brokers, TLS and SASL are set in one place.
+// Writers go through the producer package, which uses Transport.
+//
+// Configuration (environment):
+//
+//	KAFKA_BROKERS                  comma separated, default localhost:9092
+//	KAFKA_TLS                      "true" to connect over TLS
+//	KAFKA_TLS_CA_FILE              PEM CA bundle (default: system roots)
+//	KAFKA_TLS_CERT_FILE            PEM client certificate, for mTLS
+//	KAFKA_TLS_KEY_FILE             PEM client key, for mTLS
+//	KAFKA_TLS_SERVER_NAME          override the verified server name
+//	KAFKA_TLS_INSECURE_SKIP_VERIFY "true" to skip verification (testing only)
+//	KAFKA_SASL_MECHANISM           PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+//	KAFKA_SASL_USERNAME
+//	KAFKA_SASL_PASSWORD
+package kafkaclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Config is the connection config shared by all clients.
+type Config struct {
+	Brokers []string
+	TLS     *tls.Config    // nil for plaintext
+	SASL    sasl.Mechanism // nil for no authentication
+}
+
+const dialTimeout = 10 * time.Second
+
+var (
+	loadOnce sync.Once
+	loaded   *Config
+	loadErr  error
+)
+
+// Load reads the config from the environment once and caches it.
+func Load() (*Config, error) {
+	loadOnce.Do(func() {
+		loaded, loadErr = FromEnv()
+		if loadErr == nil {
+			// stderr, so commands streaming to stdout stay clean
+			fmt.Fprintf(os.Stderr, "🔌 Kafka brokers %s (%s)\n", strings.Join(loaded.Brokers, ","), loaded.describe())
+		}
+	})
+	return loaded, loadErr
+}
+
+// FromEnv builds a Config from the KAFKA_* environment variables.
+func FromEnv() (*Config, error) {
+	cfg := &Config{Brokers: []string{"localhost:9092"}}
+	if raw := os.Getenv("KAFKA_BROKERS"); raw != "" {
+		cfg.Brokers = nil
+		for _, broker := range strings.Split(raw, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.Brokers = append(cfg.Brokers, broker)
+			}
+		}
+	}
+
+	if os.Getenv("KAFKA_TLS") == "true" {
+		tlsConfig, err := loadTLS(
+			os.Getenv("KAFKA_TLS_CA_FILE"),
+			os.Getenv("KAFKA_TLS_CERT_FILE"),
+			os.Getenv("KAFKA_TLS_KEY_FILE"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = os.Getenv("KAFKA_TLS_SERVER_NAME")
+		tlsConfig.InsecureSkipVerify = os.Getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY") == "true"
+		cfg.TLS = tlsConfig
+	}
+
+	if mechanism := os.Getenv("KAFKA_SASL_MECHANISM"); mechanism != "" {
+		m, err := saslMechanism(mechanism, os.Getenv("KAFKA_SASL_USERNAME"), os.Getenv("KAFKA_SASL_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.SASL = m
+	}
+
+	return cfg, nil
+}
+
+// loadTLS builds a TLS config trusting caFile (or the system roots) and
+// presenting the client certificate pair when both files are given.
+func loadTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka CA file error: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kafka CA file %s contains no certificates", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka client certificate error: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func saslMechanism(name, username, password string) (sasl.Mechanism, error) {
+	if username == "" {
+		return nil, fmt.Errorf("KAFKA_SASL_USERNAME is required for SASL %s", name)
+	}
+
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM %q (use PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512)", name)
+	}
+}
+
+func (c *Config) describe() string {
+	security := "plaintext"
+	if c.TLS != nil {
+		security = "TLS"
+	}
+	if c.SASL != nil {
+		security += ", SASL " + c.SASL.Name()
+	}
+	return security
+}
+
+// Dialer returns a dialer for readers and admin connections.
+func (c *Config) Dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       dialTimeout,
+		DualStack:     true,
+		TLS:           c.TLS,
+		SASLMechanism: c.SASL,
+	}
+}
+
+// Transport returns a transport for writers and the kafka.Client.
+func (c *Config) Transport() *kafka.Transport {
+	return &kafka.Transport{
+		DialTimeout: dialTimeout,
+		TLS:         c.TLS,
+		SASL:        c.SASL,
+	}
+}
+
+// NewReader returns a reader of topic in consumer group groupID. maxBytes
+// is the largest message it must read (the topic's max.message.bytes); 0
+// keeps kafka-go's 1 MB fetch limit.
+func NewReader(topic, groupID string, maxBytes int) (*kafka.Reader, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  cfg.Brokers,
+		Topic:    topic,
+		GroupID:  groupID,
+		Dialer:   cfg.Dialer(),
+		MaxBytes: maxBytes,
+	}), nil
+}
+
+// NewConsumerGroup joins consumer group groupID for topic, for consumers
+// that read the partitions of each generation themselves and need to know
+// when they are assigned and revoked.
+func NewConsumerGroup(topic, groupID string) (*kafka.ConsumerGroup, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:      groupID,
+		Brokers: cfg.Brokers,
+		Dialer:  cfg.Dialer(),
+		Topics:  []string{topic},
+	})
+}
+
+// NewPartitionReader returns a reader of one partition of topic outside any
+// consumer group, for tools that read at explicit offsets and for group
+// consumers reading the partitions they were assigned. maxBytes is as for
+// NewReader.
+func NewPartitionReader(topic string, partition, maxBytes int) (*kafka.Reader, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   cfg.Brokers,
+		Topic:     topic,
+		Partition: partition,
+		Dialer:    cfg.Dialer(),
+		MaxBytes:  maxBytes,
+	}), nil
+}
+
+// NewClient returns a client for group, offset and topic admin requests.
+func NewClient() (*kafka.Client, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Client{
+		Addr:      kafka.TCP(cfg.Brokers...),
+		Transport: cfg.Transport(),
+	}, nil
+}
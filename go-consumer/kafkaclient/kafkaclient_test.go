@@ -0,0 +1,257 @@
+package kafkaclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a throwaway CA with a server certificate for 127.0.0.1 and a
+// client certificate, all written as PEM files.
+type testPKI struct {
+	caFile, serverCert, serverKey, clientCert, clientKey string
+	pool                                                 *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafkaclient test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPKI{caFile: filepath.Join(dir, "ca.pem"), pool: x509.NewCertPool()}
+	p.pool.AddCert(ca)
+	writePEM(t, p.caFile, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	p.serverCert, p.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	p.clientCert, p.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clearEnv unsets every KAFKA_* variable FromEnv reads for the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{
+		"KAFKA_BROKERS", "KAFKA_TLS", "KAFKA_TLS_CA_FILE", "KAFKA_TLS_CERT_FILE", "KAFKA_TLS_KEY_FILE",
+		"KAFKA_TLS_SERVER_NAME", "KAFKA_TLS_INSECURE_SKIP_VERIFY",
+		"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USERNAME", "KAFKA_SASL_PASSWORD",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestFromEnvDefaults(t *testing.T) {
+	clearEnv(t)
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Brokers, []string{"localhost:9092"}) || cfg.TLS != nil || cfg.SASL != nil {
+		t.Errorf("default config = %+v, want plaintext localhost:9092", cfg)
+	}
+	if got := cfg.describe(); got != "plaintext" {
+		t.Errorf("describe() = %q", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	p := newTestPKI(t)
+	clearEnv(t)
+	t.Setenv("KAFKA_BROKERS", " kafka-1:9093, ,kafka-2:9093 ")
+	t.Setenv("KAFKA_TLS", "true")
+	t.Setenv("KAFKA_TLS_CA_FILE", p.caFile)
+	t.Setenv("KAFKA_TLS_CERT_FILE", p.clientCert)
+	t.Setenv("KAFKA_TLS_KEY_FILE", p.clientKey)
+	t.Setenv("KAFKA_TLS_SERVER_NAME", "kafka.internal")
+	t.Setenv("KAFKA_SASL_MECHANISM", "scram-sha-512")
+	t.Setenv("KAFKA_SASL_USERNAME", "consumer")
+	t.Setenv("KAFKA_SASL_PASSWORD", "secret")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kafka-1:9093", "kafka-2:9093"}; !reflect.DeepEqual(cfg.Brokers, want) {
+		t.Errorf("brokers = %v, want %v", cfg.Brokers, want)
+	}
+	if cfg.TLS == nil || cfg.TLS.ServerName != "kafka.internal" || cfg.TLS.InsecureSkipVerify {
+		t.Fatalf("TLS config = %+v", cfg.TLS)
+	}
+	if cfg.TLS.RootCAs == nil || len(cfg.TLS.Certificates) != 1 {
+		t.Errorf("TLS config lacks the CA or the client certificate")
+	}
+	if got := cfg.describe(); got != "TLS, SASL SCRAM-SHA-512" {
+		t.Errorf("describe() = %q", got)
+	}
+
+	if d := cfg.Dialer(); d.TLS != cfg.TLS || d.SASLMechanism != cfg.SASL {
+		t.Error("Dialer does not use the config's TLS and SASL")
+	}
+	if tr := cfg.Transport(); tr.TLS != cfg.TLS || tr.SASL != cfg.SASL {
+		t.Error("Transport does not use the config's TLS and SASL")
+	}
+}
+
+func TestFromEnvErrors(t *testing.T) {
+	p := newTestPKI(t)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"missing CA file", map[string]string{"KAFKA_TLS": "true", "KAFKA_TLS_CA_FILE": filepath.Join(t.TempDir(), "absent.pem")}, "CA file error"},
+		{"unknown mechanism", map[string]string{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USERNAME": "consumer"}, "unsupported KAFKA_SASL_MECHANISM"},
+		{"SASL without username", map[string]string{"KAFKA_SASL_MECHANISM": "PLAIN"}, "KAFKA_SASL_USERNAME is required"},
+		{"cert without key", map[string]string{"KAFKA_TLS": "true", "KAFKA_TLS_CERT_FILE": p.clientCert}, "must be set together"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := FromEnv()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("FromEnv() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTLS(t *testing.T) {
+	p := newTestPKI(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                      string
+		caFile, certFile, keyFile string
+		want                      string // error substring, "" for success
+	}{
+		{"system roots", "", "", "", ""},
+		{"CA file", p.caFile, "", "", ""},
+		{"mTLS pair", p.caFile, p.clientCert, p.clientKey, ""},
+		{"CA file without certificates", notPEM, "", "", "contains no certificates"},
+		{"key without cert", "", "", p.clientKey, "must be set together"},
+		{"mismatched pair", p.caFile, p.clientCert, p.serverKey, "client certificate error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTLS(tt.caFile, tt.certFile, tt.keyFile)
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("loadTLS() error = %v, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion = %x, want TLS 1.2", cfg.MinVersion)
+			}
+			if (cfg.RootCAs != nil) != (tt.caFile != "") {
+				t.Errorf("RootCAs set = %v, want %v", cfg.RootCAs != nil, tt.caFile != "")
+			}
+			wantCerts := 0
+			if tt.certFile != "" {
+				wantCerts = 1
+			}
+			if len(cfg.Certificates) != wantCerts {
+				t.Errorf("got %d client certificates, want %d", len(cfg.Certificates), wantCerts)
+			}
+		})
+	}
+}
+
+func TestSASLMechanism(t *testing.T) {
+	for _, name := range []string{"PLAIN", "plain", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		m, err := saslMechanism(name, "consumer", "secret")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if m.Name() != strings.ToUpper(name) {
+			t.Errorf("%s: mechanism %s", name, m.Name())
+		}
+	}
+
+	if _, err := saslMechanism("OAUTHBEARER", "consumer", "secret"); err == nil {
+		t.Error("unknown mechanism accepted")
+	}
+	if _, err := saslMechanism("PLAIN", "", "secret"); err == nil {
+		t.Error("mechanism accepted without a username")
+	}
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"todo-consumer/api"
+	"todo-consumer/archive"
+	"todo-consumer/cdc"
+	"todo-consumer/commands"
 	"todo-consumer/db"
 	"todo-consumer/kafka"
+	"todo-consumer/outbox"
+	"todo-consumer/producer"
+	"todo-consumer/snapshot"
+	"todo-consumer/topics"
+	"todo-consumer/tracing"
 
 	"github.com/joho/godotenv"
 )
@@ -15,6 +27,8 @@ import (
 // This service handles:
 // - Consuming events from Kafka topic 'todo-history-events'
 // - Writing event logs to TimescaleDB
+// - Optionally relaying the MongoDB outbox to Kafka (OUTBOX_RELAY=true)
+// - Optionally capturing MongoDB changes as history events (CDC_ENABLED=true)
 //
 // Architecture:
 // 1. Express backend (todo_serer) - Publishes events to Kafka
@@ -28,6 +42,15 @@ func main() {
 		fmt.Println("⚠️ No .env file found, using system environment variables")
 	}
 
+	// Subcommands (e.g. "snapshot diff a b") run instead of the service
+	if len(os.Args) > 1 {
+		if err := commands.Run(os.Args[1:]); err != nil {
+			fmt.Println("❌", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Println("🚀 Starting Go Kafka Consumer Service")
 	fmt.Println("📋 Role: Consume Kafka events → Write to TimescaleDB")
 
@@ -39,8 +62,104 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Spans go to OTLP or stdout per OTEL_TRACES_EXPORTER, flushed before exit
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		fmt.Println("❌ Failed to start tracing:", err)
+		os.Exit(1)
+	}
+
+	// Snapshots the topic accepts must not be refused by the producer
+	if err := topics.CheckProducerLimit(); err != nil {
+		fmt.Println("❌ Invalid Kafka message size config:", err)
+		os.Exit(1)
+	}
+
+	// Create missing topics with their partitions, retention and size limits
+	// before anything publishes to them
+	if err := topics.Ensure(context.Background()); err != nil {
+		fmt.Println("⚠️ Kafka topic bootstrap failed:", err)
+	}
+
+	// One producer for the life of the service (snapshots, dead letters),
+	// flushed before exit
+	if err := producer.Init(); err != nil {
+		fmt.Println("❌ Failed to start Kafka producer:", err)
+		os.Exit(1)
+	}
+	stopped := make(chan struct{})
+	go closeOnSignal(shutdownTracing, stopped)
+
+	// Snapshots are refused rather than published with rules that cannot
+	// be applied (hash or encrypt without SNAPSHOT_REDACT_KEY)
+	if _, err := snapshot.LoadRedactRules(); err != nil {
+		fmt.Println("❌ Invalid snapshot redaction config:", err)
+		os.Exit(1)
+	}
+
+	// Optionally take snapshots on a schedule (e.g. SNAPSHOT_CRON="0 * * * *")
+	if specs := os.Getenv("SNAPSHOT_CRON"); specs != "" {
+		if _, err := snapshot.StartScheduler(specs); err != nil {
+			fmt.Println("❌ Failed to start snapshot scheduler:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Archive expired event log chunks to S3 before dropping them
+	if os.Getenv("EVENT_LOG_ARCHIVE") == "true" {
+		go archive.StartArchiver()
+	}
+
+	// Log changes made in MongoDB itself (direct edits, restores) as history;
+	// only the replica holding the ingester lock watches
+	if os.Getenv("CDC_ENABLED") == "true" {
+		go cdc.Start()
+	}
+
+	// Publish history events the Express backend parked in the MongoDB
+	// outbox; only the replica holding the relay lock publishes
+	if os.Getenv("OUTBOX_RELAY") == "true" {
+		go outbox.StartRelay()
+	}
+
+	// Go-only endpoints (snapshot diff, entity state, ...) on port 7250
+	if os.Getenv("GO_API_ENABLED") == "true" {
+		go api.StartServer()
+	}
+
 	// Start consuming from Kafka and writing to TimescaleDB
 	// Note: History logs API is provided by Express.js backend on port 3001
 	fmt.Println("📡 Connecting to Kafka broker...")
-	kafka.StartConsumer()
+	if err := kafka.StartConsumer(true); err != nil {
+		fmt.Println("❌ Kafka consumer failed:", err)
+		os.Exit(1)
+	}
+
+	// The consumer returns as soon as closeOnSignal closes it; exit only
+	// once the producer and spans are flushed
+	<-stopped
+}
+
+// closeOnSignal commits the consumer's offsets and flushes the Kafka
+// producer and pending spans on SIGINT/SIGTERM, then closes stopped.
+func closeOnSignal(shutdownTracing func(context.Context) error, stopped chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	// Leaving the group revokes its partitions, which commits the offsets of
+	// events already written; dead letters still need the producer
+	fmt.Println("🛑 Shutting down, committing consumer offsets...")
+	if err := kafka.Close(); err != nil {
+		fmt.Println("⚠️ Failed to close Kafka consumer:", err)
+	}
+
+	fmt.Println("🛑 Flushing Kafka producer...")
+	if err := producer.Close(); err != nil {
+		fmt.Println("⚠️ Failed to flush Kafka producer:", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		fmt.Println("⚠️ Failed to flush traces:", err)
+	}
+	close(stopped)
 }
@@ -0,0 +1,165 @@
+// Package message defines the header convention of every Kafka message the
+// services exchange and the typed Envelope it is parsed into on read.
+package message
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+// Header keys carried by every message.
+const (
+	HeaderEventID         = "event-id"
+	HeaderSchemaVersion   = "schema-version"
+	HeaderContentType     = "content-type"
+	HeaderContentEncoding = "content-encoding"
+	HeaderTraceparent     = "traceparent"
+	HeaderSource          = "source"
+)
+
+// SchemaVersion is the newest payload schema this code reads and writes.
+const SchemaVersion = 1
+
+// Content types and encodings in use.
+const (
+	ContentTypeJSON  = "application/json"
+	EncodingIdentity = "identity"
+)
+
+// Envelope is a consumed message with its headers parsed. Messages written
+// before the convention existed get defaults: schema version 1, JSON,
+// identity encoding, source "unknown" and an event ID derived from their
+// position in the log.
+type Envelope struct {
+	EventID         string
+	SchemaVersion   int
+	ContentType     string
+	ContentEncoding string
+	Traceparent     string
+	Source          string
+
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []kafka.Header
+}
+
+// Parse reads the envelope of a consumed message.
+func Parse(m kafka.Message) (Envelope, error) {
+	env := Envelope{
+		EventID:         fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset),
+		SchemaVersion:   1,
+		ContentType:     ContentTypeJSON,
+		ContentEncoding: EncodingIdentity,
+		Source:          "unknown",
+		Topic:           m.Topic,
+		Partition:       m.Partition,
+		Offset:          m.Offset,
+		Key:             m.Key,
+		Value:           m.Value,
+		Headers:         m.Headers,
+	}
+
+	for _, h := range m.Headers {
+		value := string(h.Value)
+		if value == "" {
+			continue
+		}
+		switch h.Key {
+		case HeaderEventID:
+			env.EventID = value
+		case HeaderSchemaVersion:
+			version, err := strconv.Atoi(value)
+			if err != nil || version < 1 {
+				return env, fmt.Errorf("invalid %s header %q", HeaderSchemaVersion, value)
+			}
+			env.SchemaVersion = version
+		case HeaderContentType:
+			env.ContentType = value
+		case HeaderContentEncoding:
+			env.ContentEncoding = value
+		case HeaderTraceparent:
+			env.Traceparent = value
+		case HeaderSource:
+			env.Source = value
+		}
+	}
+	return env, nil
+}
+
+// DecodeJSON unmarshals the value into v after checking it is plain JSON of
+// a schema version this code understands.
+func (e Envelope) DecodeJSON(v interface{}) error {
+	if e.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d (newest supported is %d)", e.SchemaVersion, SchemaVersion)
+	}
+	if e.ContentType != ContentTypeJSON {
+		return fmt.Errorf("unsupported content type %q", e.ContentType)
+	}
+	if e.ContentEncoding != EncodingIdentity {
+		return fmt.Errorf("unsupported content encoding %q", e.ContentEncoding)
+	}
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+// Header returns the value of any header of the message, e.g. the
+// encryption-* headers of snapshots.
+func (e Envelope) Header(key string) (string, bool) {
+	for _, h := range e.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+// Source names this service in the source header (SERVICE_NAME, default
+// todo-consumer).
+func Source() string {
+	if name := os.Getenv("SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "todo-consumer"
+}
+
+// Stamp adds the convention headers m is missing: a new event ID, the
+// current schema version, JSON, identity encoding, a new trace and this
+// service as source. Headers already set (e.g. kept from a consumed message)
+// are left alone.
+func Stamp(m *kafka.Message) {
+	present := map[string]bool{}
+	for _, h := range m.Headers {
+		present[h.Key] = true
+	}
+
+	add := func(key, value string) {
+		if !present[key] {
+			m.Headers = append(m.Headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+	}
+	add(HeaderEventID, uuid.NewString())
+	add(HeaderSchemaVersion, strconv.Itoa(SchemaVersion))
+	add(HeaderContentType, ContentTypeJSON)
+	add(HeaderContentEncoding, EncodingIdentity)
+	add(HeaderTraceparent, newTraceparent())
+	add(HeaderSource, Source())
+}
+
+// newTraceparent starts a W3C trace context (version 00, sampled).
+func newTraceparent() string {
+	ids := make([]byte, 24)
+	rand.Read(ids)
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(ids[:16]), hex.EncodeToString(ids[16:]))
+}
@@ -0,0 +1,428 @@
+// Package outbox relays history events from the MongoDB outbox collection
+// to Kafka. With OUTBOX_ENABLED the Express backend stores each event in the
+// outbox in the same transaction as the entity change instead of publishing
+// it, so events outlive a Kafka outage; the relay publishes them in the order
+// they were written and marks each one delivered once the brokers
+// acknowledge it.
+//
+// Every replica may enable the relay; a Postgres advisory lock elects the
+// one that publishes, and another takes over when it dies.
+//
+// Delivery is at least once: an entry published but not yet marked (relay
+// crash, MongoDB error, a leader that lost its lock finishing a batch) is
+// published again and logged twice. The copies carry the same event-id
+// header, stored with the entry, but nothing downstream drops them.
+//
+// An entry the brokers reject for good (too large, invalid topic, not
+// authorized), or that has failed OUTBOX_MAX_ATTEMPTS times, is parked: it
+// is published to the dead-letter queue, failedAt is set and the relay moves
+// on. Parked entries are kept; unset failedAt to publish one again.
+//
+// Configuration (environment):
+//
+//	OUTBOX_BATCH_SIZE    entries published per batch, default 100
+//	OUTBOX_MAX_ATTEMPTS  failed publishes before an entry is parked, default 20
+//	OUTBOX_POLL_INTERVAL how often to look for entries, default 5s
+//	OUTBOX_RETENTION     how long delivered entries are kept, default 168h
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"todo-consumer/db"
+	"todo-consumer/producer"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultTopic is used for entries that name no topic.
+const DefaultTopic = "todo-history-events"
+
+// relayLockKey is the advisory lock the relay leader holds.
+const relayLockKey int64 = 0x6f626f78 // "obox"
+
+// maxBackoff caps the wait between attempts while Kafka or MongoDB fail.
+const maxBackoff = 30 * time.Second
+
+// Entry is one outbox document as written by the Express backend.
+type Entry struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Topic       string             `bson:"topic"`
+	Key         string             `bson:"key"`
+	Value       string             `bson:"value"`
+	Headers     map[string]string  `bson:"headers"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+	DeliveredAt *time.Time         `bson:"deliveredAt"`
+	FailedAt    *time.Time         `bson:"failedAt"`
+	Attempts    int                `bson:"attempts"`
+	LastError   string             `bson:"lastError,omitempty"`
+}
+
+// Config tunes the relay.
+type Config struct {
+	BatchSize    int64
+	MaxAttempts  int
+	PollInterval time.Duration
+	Retention    time.Duration
+}
+
+// ConfigFromEnv reads the OUTBOX_* variables.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{BatchSize: 100, MaxAttempts: 20, PollInterval: 5 * time.Second, Retention: 7 * 24 * time.Hour}
+
+	if v := os.Getenv("OUTBOX_BATCH_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid OUTBOX_BATCH_SIZE %q", v)
+		}
+		cfg.BatchSize = n
+	}
+	if v := os.Getenv("OUTBOX_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid OUTBOX_MAX_ATTEMPTS %q", v)
+		}
+		cfg.MaxAttempts = n
+	}
+	for name, d := range map[string]*time.Duration{
+		"OUTBOX_POLL_INTERVAL": &cfg.PollInterval,
+		"OUTBOX_RETENTION":     &cfg.Retention,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return cfg, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*d = parsed
+	}
+	return cfg, nil
+}
+
+// StartRelay publishes pending outbox entries until the process exits,
+// while this replica is the relay leader; standby replicas contest
+// leadership every poll interval. It blocks, so run it in a goroutine after
+// db.Init and producer.Init.
+func StartRelay() {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		fmt.Printf("❌ Outbox relay config error: %v\n", err)
+		return
+	}
+	if producer.Default == nil {
+		fmt.Println("❌ Outbox relay needs the Kafka producer (producer.Init)")
+		return
+	}
+
+	db.NewLeader("Outbox relay", relayLockKey).Run(cfg.PollInterval, func(ctx context.Context) {
+		relay(ctx, cfg)
+	})
+}
+
+// relay publishes pending entries until ctx is cancelled.
+func relay(ctx context.Context, cfg Config) {
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017/todo_manager"
+	}
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		fmt.Printf("❌ Outbox relay MongoDB connection failed: %v\n", err)
+		return
+	}
+	defer client.Disconnect(context.Background())
+
+	coll := client.Database("todo_manager").Collection("outbox")
+	if err := ensureIndexes(ctx, coll, cfg.Retention); err != nil {
+		fmt.Printf("❌ Outbox index error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("📬 Outbox relay started (batch %d, poll every %s)\n", cfg.BatchSize, cfg.PollInterval)
+	wake := watchInserts(ctx, coll, cfg.PollInterval)
+
+	backoff := time.Second
+	// isolating counts entries still to be published one at a time after a
+	// batch was rejected
+	isolating := 0
+	for {
+		limit := cfg.BatchSize
+		if isolating > 0 {
+			limit = 1
+		}
+		n, err := relayBatch(ctx, coll, limit, cfg.MaxAttempts)
+		if ctx.Err() != nil {
+			fmt.Println("📬 Outbox relay stopped")
+			return
+		}
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			// Kafka fails a whole partition batch for one bad message, so
+			// publish the entries alone to find the one to park
+			fmt.Printf("⚠️ Outbox batch rejected, publishing its %d entries one at a time: %v\n", rejected.entries, rejected.err)
+			isolating = rejected.entries
+			continue
+		}
+		if err != nil {
+			fmt.Printf("❌ Outbox relay error (retrying in %s): %v\n", backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = time.Second
+		isolating = max(isolating-n, 0)
+
+		// A full batch means more are likely waiting
+		if int64(n) == limit {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+// ensureIndexes creates the index pending entries are read by and the TTL
+// index that removes delivered entries after retention. Pending and parked
+// entries have no deliveredAt and never expire.
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, retention time.Duration) error {
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "deliveredAt", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "deliveredAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds())),
+		},
+	})
+	return err
+}
+
+// watchInserts signals when entries are added so they are published
+// without waiting for the next poll. Change streams need a replica set;
+// without one the relay only polls.
+func watchInserts(ctx context.Context, coll *mongo.Collection, pollInterval time.Duration) <-chan struct{} {
+	wake := make(chan struct{}, 1)
+	go func() {
+		pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+		stream, err := coll.Watch(ctx, pipeline)
+		if err != nil {
+			fmt.Printf("⚠️ Outbox change stream unavailable, polling every %s: %v\n", pollInterval, err)
+			return
+		}
+		defer stream.Close(ctx)
+
+		for stream.Next(ctx) {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("⚠️ Outbox change stream closed, polling every %s: %v\n", pollInterval, stream.Err())
+	}()
+	return wake
+}
+
+// relayBatch publishes up to limit pending entries, oldest first, and marks
+// them delivered. It returns how many were published or parked.
+func relayBatch(ctx context.Context, coll *mongo.Collection, limit int64, maxAttempts int) (int, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(limit)
+	cursor, err := coll.Find(ctx, bson.M{"deliveredAt": nil, "failedAt": nil}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var entries []Entry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	msgs := make([]kafka.Message, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.message()
+	}
+
+	deliveries, err := producer.Default.Publish(ctx, msgs...)
+	if err != nil {
+		if err := failBatch(ctx, coll, entries, msgs, err, maxAttempts); err != nil {
+			return 0, err
+		}
+		return len(entries), nil
+	}
+
+	now := time.Now().UTC()
+	updates := make([]mongo.WriteModel, len(entries))
+	for i, e := range entries {
+		updates[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": e.ID}).
+			SetUpdate(bson.M{
+				"$set": bson.M{
+					"deliveredAt": now,
+					"partition":   deliveries[i].Partition,
+					"offset":      deliveries[i].Offset,
+				},
+				"$inc":   bson.M{"attempts": 1},
+				"$unset": bson.M{"lastError": ""},
+			})
+	}
+	if _, err := coll.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false)); err != nil {
+		// Published but not marked: they will be published again
+		return 0, fmt.Errorf("marking %d outbox entries delivered failed: %w", len(entries), err)
+	}
+
+	fmt.Printf("📤 Relayed %d outbox entries to Kafka\n", len(entries))
+	return len(entries), nil
+}
+
+// failBatch records a failed publish on the entries that failed; they stay
+// pending and are retried in the same order. An entry is parked instead once
+// it has failed maxAttempts times, or when the brokers rejected it for good
+// and it was published alone, so the rejection is its own and not that of
+// its batch; a rejected batch is reported as a rejectedError. failBatch
+// returns nil when every failed entry was parked.
+func failBatch(ctx context.Context, coll *mongo.Collection, entries []Entry, msgs []kafka.Message, err error, maxAttempts int) error {
+	errs := entryErrors(err, len(entries))
+
+	var updates []mongo.WriteModel
+	for i, e := range entries {
+		if errs[i] != nil {
+			updates = append(updates, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": e.ID}).
+				SetUpdate(bson.M{"$inc": bson.M{"attempts": 1}, "$set": bson.M{"lastError": errs[i].Error()}}))
+		}
+	}
+	if len(updates) > 0 {
+		if _, markErr := coll.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false)); markErr != nil {
+			fmt.Printf("⚠️ Failed to record outbox publish error: %v\n", markErr)
+		}
+	}
+
+	pending := 0
+	for i, e := range entries {
+		switch {
+		case errs[i] == nil:
+			// Written but not marked delivered: published again
+		case permanent(errs[i]) && len(entries) > 1:
+			return &rejectedError{entries: len(entries), err: err}
+		case permanent(errs[i]) || e.Attempts+1 >= maxAttempts:
+			if parkErr := park(ctx, coll, e, msgs[i], errs[i]); parkErr != nil {
+				fmt.Printf("⚠️ Failed to park outbox entry %s: %v\n", e.ID.Hex(), parkErr)
+				pending++
+			}
+		default:
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("publish of %d outbox entries failed: %w", pending, err)
+	}
+	return nil
+}
+
+// park publishes the entry to the dead-letter queue and sets its failedAt,
+// so the relay moves past it. An entry the dead-letter queue cannot take
+// either (too large for it too) is parked without a copy there; one it
+// cannot take for now stays pending.
+func park(ctx context.Context, coll *mongo.Collection, e Entry, m kafka.Message, cause error) error {
+	m.Headers = append(m.Headers, kafka.Header{Key: "outbox-id", Value: []byte(e.ID.Hex())})
+	if _, err := producer.DeadLetter(ctx, m, cause.Error()); err != nil {
+		if !permanent(err) {
+			return fmt.Errorf("dead-letter publish failed: %w", err)
+		}
+		fmt.Printf("⚠️ Outbox entry %s rejected by the dead-letter queue too: %v\n", e.ID.Hex(), err)
+	}
+
+	_, err := coll.UpdateOne(ctx,
+		bson.M{"_id": e.ID},
+		bson.M{"$set": bson.M{"failedAt": time.Now().UTC(), "lastError": cause.Error()}},
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("⚠️ Parked outbox entry %s after %d attempts: %v\n", e.ID.Hex(), e.Attempts+1, cause)
+	return nil
+}
+
+// rejectedError reports a batch the brokers rejected for good.
+type rejectedError struct {
+	entries int
+	err     error
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("publish of %d outbox entries rejected: %v", e.entries, e.err)
+}
+
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// entryErrors splits a publish error into the error of each message. The
+// writer reports per-message errors for failed partition batches; any other
+// error failed them all.
+func entryErrors(err error, n int) []error {
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) && len(writeErrs) == n {
+		return writeErrs
+	}
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// permanent reports whether publishing failed in a way retrying cannot fix.
+func permanent(err error) bool {
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return true
+	}
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		switch kafkaErr {
+		case kafka.MessageSizeTooLarge, kafka.RecordListTooLarge, kafka.InvalidTopic,
+			kafka.TopicAuthorizationFailed, kafka.InvalidRecord:
+			return true
+		}
+	}
+	return false
+}
+
+// message builds the Kafka message of the entry. Its stored headers (event
+// ID, traceparent, source) are sent as-is, so every redelivery carries the
+// same event ID.
+func (e Entry) message() kafka.Message {
+	topic := e.Topic
+	if topic == "" {
+		topic = DefaultTopic
+	}
+
+	m := kafka.Message{Topic: topic, Value: []byte(e.Value)}
+	if e.Key != "" {
+		m.Key = []byte(e.Key)
+	}
+	for k, v := range e.Headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return m
+}
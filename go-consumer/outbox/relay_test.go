@@ -0,0 +1,47 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{kafka.MessageTooLargeError{}, true},
+		{kafka.MessageSizeTooLarge, true},
+		{fmt.Errorf("produce: %w", kafka.InvalidTopic), true},
+		{kafka.TopicAuthorizationFailed, true},
+		{kafka.LeaderNotAvailable, false},
+		{kafka.RequestTimedOut, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("dial tcp: connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestEntryErrors(t *testing.T) {
+	writeErrs := kafka.WriteErrors{nil, kafka.MessageSizeTooLarge, nil}
+	errs := entryErrors(writeErrs, 3)
+	if errs[0] != nil || !errors.Is(errs[1], kafka.MessageSizeTooLarge) || errs[2] != nil {
+		t.Errorf("per-message errors = %v", errs)
+	}
+
+	// Any other error failed every message
+	refused := errors.New("connection refused")
+	for i, err := range entryErrors(refused, 2) {
+		if err != refused {
+			t.Errorf("message %d error = %v, want %v", i, err, refused)
+		}
+	}
+}
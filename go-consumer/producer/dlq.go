@@ -0,0 +1,50 @@
+package producer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// DeadLetterTopic names the topic receiving consumed messages that could not
+// be processed (KAFKA_DLQ_TOPIC, default todo-history-events.dlq).
+func DeadLetterTopic() string {
+	if topic := os.Getenv("KAFKA_DLQ_TOPIC"); topic != "" {
+		return topic
+	}
+	return "todo-history-events.dlq"
+}
+
+// DeadLetter republishes a message that failed processing to the dead-letter
+// topic through Default, unchanged apart from headers recording why and
+// where it came from, so it can be inspected and replayed.
+func DeadLetter(ctx context.Context, m kafka.Message, reason string) (Delivery, error) {
+	key := m.Key
+	if len(key) == 0 {
+		key = []byte(fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset))
+	}
+
+	headers := append([]kafka.Header{}, m.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: "dlq-reason", Value: []byte(reason)},
+		kafka.Header{Key: "dlq-source-topic", Value: []byte(m.Topic)},
+		kafka.Header{Key: "dlq-source-partition", Value: []byte(strconv.Itoa(m.Partition))},
+		kafka.Header{Key: "dlq-source-offset", Value: []byte(strconv.FormatInt(m.Offset, 10))},
+		kafka.Header{Key: "dlq-failed-at", Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	deliveries, err := Default.Publish(ctx, kafka.Message{
+		Topic:   DeadLetterTopic(),
+		Key:     key,
+		Value:   m.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return Delivery{}, err
+	}
+	return deliveries[0], nil
+}
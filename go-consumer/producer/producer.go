@@ -0,0 +1,209 @@
+// Package producer owns the service's single long-lived Kafka writer. It is
+// opened once at startup (Init) and flushed on shutdown (Close); snapshot
+// publishing and the dead-letter queue both write through it.
+//
+// Configuration (environment, brokers and security from kafkaclient):
+//
+//	KAFKA_PRODUCER_ACKS              all (default), one or none
+//	KAFKA_PRODUCER_COMPRESSION       none, gzip, snappy (default), lz4 or zstd
+//	KAFKA_PRODUCER_MAX_MESSAGE_BYTES largest message accepted, default 10485760 (the todo-snapshots limit)
+//	KAFKA_PRODUCER_MAX_ATTEMPTS      delivery attempts per batch, default 10
+//	KAFKA_PRODUCER_LINGER_MS         how long to wait to fill a batch, default 10
+package producer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/message"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/compress"
+)
+
+// Config tunes delivery guarantees and batching of the producer.
+type Config struct {
+	RequiredAcks    kafka.RequiredAcks
+	Compression     kafka.Compression
+	MaxMessageBytes int64
+	MaxAttempts     int
+	Linger          time.Duration
+}
+
+// Delivery reports where a message was written.
+type Delivery struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Key       string `json:"key,omitempty"`
+}
+
+// Producer writes messages to any topic and reports their delivery.
+type Producer struct {
+	writer *kafka.Writer
+}
+
+// Default is the producer opened by Init.
+var Default *Producer
+
+var initOnce sync.Once
+
+// ConfigFromEnv reads the KAFKA_PRODUCER_* variables.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		RequiredAcks:    kafka.RequireAll,
+		Compression:     kafka.Snappy,
+		MaxMessageBytes: 10 * 1024 * 1024,
+		MaxAttempts:     10,
+		Linger:          10 * time.Millisecond,
+	}
+
+	switch acks := strings.ToLower(os.Getenv("KAFKA_PRODUCER_ACKS")); acks {
+	case "", "all", "-1":
+		cfg.RequiredAcks = kafka.RequireAll
+	case "one", "1":
+		cfg.RequiredAcks = kafka.RequireOne
+	case "none", "0":
+		cfg.RequiredAcks = kafka.RequireNone
+	default:
+		return cfg, fmt.Errorf("invalid KAFKA_PRODUCER_ACKS %q (use all, one or none)", acks)
+	}
+
+	if codec := strings.ToLower(os.Getenv("KAFKA_PRODUCER_COMPRESSION")); codec != "" {
+		var c compress.Compression
+		if err := c.UnmarshalText([]byte(codec)); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_PRODUCER_COMPRESSION %q (use none, gzip, snappy, lz4 or zstd)", codec)
+		}
+		cfg.Compression = c
+	}
+
+	var err error
+	if cfg.MaxMessageBytes, err = envInt("KAFKA_PRODUCER_MAX_MESSAGE_BYTES", cfg.MaxMessageBytes); err != nil {
+		return cfg, err
+	}
+	attempts, err := envInt("KAFKA_PRODUCER_MAX_ATTEMPTS", int64(cfg.MaxAttempts))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxAttempts = int(attempts)
+	lingerMs, err := envInt("KAFKA_PRODUCER_LINGER_MS", cfg.Linger.Milliseconds())
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Linger = time.Duration(lingerMs) * time.Millisecond
+
+	return cfg, nil
+}
+
+func envInt(name string, fallback int64) (int64, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n < 0 {
+		return fallback, fmt.Errorf("invalid %s %q", name, raw)
+	}
+	return n, nil
+}
+
+// New opens a producer on the brokers configured in kafkaclient.
+//
+// kafka-go has no idempotent producer, so a batch retried after a lost
+// acknowledgement may be written twice: delivery is at least once, and a
+// duplicated history event is logged twice.
+func New(cfg Config) (*Producer, error) {
+	client, err := kafkaclient.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(client.Brokers...),
+		Transport:    client.Transport(),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: cfg.RequiredAcks,
+		Compression:  cfg.Compression,
+		BatchBytes:   cfg.MaxMessageBytes,
+		BatchTimeout: cfg.Linger,
+		MaxAttempts:  cfg.MaxAttempts,
+		Completion:   reportDelivery,
+	}
+	return &Producer{writer: writer}, nil
+}
+
+// Init opens Default from the environment. Later calls are no-ops.
+func Init() error {
+	var err error
+	initOnce.Do(func() {
+		var cfg Config
+		if cfg, err = ConfigFromEnv(); err != nil {
+			return
+		}
+		Default, err = New(cfg)
+		if err == nil {
+			fmt.Printf("📤 Kafka producer ready (acks=%s, compression=%s, max %d bytes)\n",
+				cfg.RequiredAcks, cfg.Compression, cfg.MaxMessageBytes)
+		}
+	})
+	return err
+}
+
+// Close flushes and closes Default.
+func Close() error {
+	if Default == nil {
+		return nil
+	}
+	return Default.Close()
+}
+
+// reportDelivery copies the partition and offset the writer assigned back to
+// the caller's Delivery, carried in WriterData.
+func reportDelivery(messages []kafka.Message, err error) {
+	if err != nil {
+		return
+	}
+	for _, m := range messages {
+		if d, ok := m.WriterData.(*Delivery); ok {
+			d.Partition = m.Partition
+			d.Offset = m.Offset
+		}
+	}
+}
+
+// Publish writes msgs (each with its Topic set) and blocks until the brokers
+// acknowledge them, returning where each one landed, in order. Every message
+// is stamped with the headers of the message package convention.
+func (p *Producer) Publish(ctx context.Context, msgs ...kafka.Message) ([]Delivery, error) {
+	if p == nil {
+		return nil, fmt.Errorf("kafka producer not started")
+	}
+
+	deliveries := make([]Delivery, len(msgs))
+	tracked := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		if m.Topic == "" {
+			return nil, fmt.Errorf("message %d has no topic", i)
+		}
+		deliveries[i] = Delivery{Topic: m.Topic, Partition: -1, Offset: -1, Key: string(m.Key)}
+		m.Headers = append([]kafka.Header{}, m.Headers...)
+		message.Stamp(&m)
+		m.WriterData = &deliveries[i]
+		tracked[i] = m
+	}
+
+	if err := p.writer.WriteMessages(ctx, tracked...); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Close flushes pending batches and closes the connections.
+func (p *Producer) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,117 @@
+package projection
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"todo-consumer/db"
+)
+
+// legacyStatusChange matches the free-text STATUS_CHANGED message written
+// before producers sent structured state, so old status history still folds.
+var legacyStatusChange = regexp.MustCompile(`^Task status changed from "([^"]*)" to "([^"]*)"$`)
+
+// State is an entity rebuilt from its history as of a point in time.
+type State struct {
+	Entity   string                 `json:"entity"`
+	EntityID string                 `json:"entityId"`
+	AsOf     time.Time              `json:"asOf"`
+	Exists   bool                   `json:"exists"`
+	Deleted  bool                   `json:"deleted"`
+	Fields   map[string]interface{} `json:"fields"`
+
+	// Version counts the events folded into the state.
+	Version     int        `json:"version"`
+	LastEventAt *time.Time `json:"lastEventAt,omitempty"`
+	LastEvent   string     `json:"lastEvent,omitempty"`
+
+	// Unstructured counts events that carried no event_data; fields they
+	// changed may be missing or stale.
+	Unstructured int `json:"unstructured"`
+}
+
+// eventData is the before/after document stored by the consumer.
+type eventData struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+}
+
+// Rebuild reconstructs an entity ("Group", "Task" or "Comment") of a
+// workspace as of asOf by folding its events from todo_event_logs.
+func Rebuild(workspace, entity, entityID string, asOf time.Time) (*State, error) {
+	events, err := db.GetEntityEvents(workspace, entity, entityID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	return Fold(entity, entityID, asOf, events)
+}
+
+// Fold applies events, oldest first, to an empty state:
+//
+//	*_CREATED  starts the entity from the "after" document
+//	*_DELETED  marks it deleted (keeping the last known fields)
+//	otherwise  merges the "after" fields over the current state
+func Fold(entity, entityID string, asOf time.Time, events []db.EntityEvent) (*State, error) {
+	state := &State{
+		Entity:   entity,
+		EntityID: entityID,
+		AsOf:     asOf,
+		Fields:   map[string]interface{}{},
+	}
+
+	for _, e := range events {
+		var data eventData
+		if len(e.EventData) > 0 {
+			if err := json.Unmarshal(e.EventData, &data); err != nil {
+				return nil, fmt.Errorf("event %d: invalid event_data: %w", e.ID, err)
+			}
+		} else {
+			state.Unstructured++
+			data = legacyEventData(e)
+		}
+
+		switch {
+		case strings.HasSuffix(e.EventType, "_CREATED"):
+			state.Fields = map[string]interface{}{}
+			merge(state.Fields, data.After)
+			state.Exists = true
+			state.Deleted = false
+		case strings.HasSuffix(e.EventType, "_DELETED"):
+			merge(state.Fields, data.Before)
+			state.Exists = false
+			state.Deleted = true
+		default:
+			merge(state.Fields, data.After)
+			if !state.Deleted {
+				state.Exists = true
+			}
+		}
+
+		ts := e.Timestamp
+		state.Version++
+		state.LastEventAt = &ts
+		state.LastEvent = e.EventType
+	}
+	return state, nil
+}
+
+// legacyEventData recovers what little structure free-text events have.
+func legacyEventData(e db.EntityEvent) eventData {
+	if e.EventType == "STATUS_CHANGED" {
+		if m := legacyStatusChange.FindStringSubmatch(e.Changes); m != nil {
+			return eventData{
+				Before: map[string]interface{}{"status": m[1]},
+				After:  map[string]interface{}{"status": m[2]},
+			}
+		}
+	}
+	return eventData{}
+}
+
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// Kafka connection settings, read from the same KAFKA_* variables as the
+// todo-consumer service (see go-consumer/kafkaclient/kafkaclient.go).
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+type kafkaConfig struct {
+	Brokers []string
+	TLS     *tls.Config    // nil for plaintext
+	SASL    sasl.Mechanism // nil for no authentication
+}
+
+const kafkaDialTimeout = 10 * time.Second
+
+func kafkaConfigFromEnv() (*kafkaConfig, error) {
+	cfg := &kafkaConfig{Brokers: []string{"localhost:9092"}}
+	if raw := os.Getenv("KAFKA_BROKERS"); raw != "" {
+		cfg.Brokers = nil
+		for _, broker := range strings.Split(raw, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.Brokers = append(cfg.Brokers, broker)
+			}
+		}
+	}
+
+	if os.Getenv("KAFKA_TLS") == "true" {
+		tlsConfig, err := loadTLS(
+			os.Getenv("KAFKA_TLS_CA_FILE"),
+			os.Getenv("KAFKA_TLS_CERT_FILE"),
+			os.Getenv("KAFKA_TLS_KEY_FILE"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = os.Getenv("KAFKA_TLS_SERVER_NAME")
+		tlsConfig.InsecureSkipVerify = os.Getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY") == "true"
+		cfg.TLS = tlsConfig
+	}
+
+	if mechanism := os.Getenv("KAFKA_SASL_MECHANISM"); mechanism != "" {
+		m, err := saslMechanism(mechanism, os.Getenv("KAFKA_SASL_USERNAME"), os.Getenv("KAFKA_SASL_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.SASL = m
+	}
+
+	return cfg, nil
+}
+
+// loadTLS builds a TLS config trusting caFile (or the system roots) and
+// presenting the client certificate pair when both files are given.
+func loadTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka CA file error: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kafka CA file %s contains no certificates", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka client certificate error: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func saslMechanism(name, username, password string) (sasl.Mechanism, error) {
+	if username == "" {
+		return nil, fmt.Errorf("KAFKA_SASL_USERNAME is required for SASL %s", name)
+	}
+
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM %q (use PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512)", name)
+	}
+}
+
+func (c *kafkaConfig) describe() string {
+	security := "plaintext"
+	if c.TLS != nil {
+		security = "TLS"
+	}
+	if c.SASL != nil {
+		security += ", SASL " + c.SASL.Name()
+	}
+	return security
+}
+
+func (c *kafkaConfig) Dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       kafkaDialTimeout,
+		DualStack:     true,
+		TLS:           c.TLS,
+		SASLMechanism: c.SASL,
+	}
+}
+
+// snapshotMaxBytes returns the largest snapshot the todo-snapshots topic
+// accepts (KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES, default 10485760 as in
+// go-consumer/topics), which the reader must be able to fetch.
+func snapshotMaxBytes() (int, error) {
+	raw := os.Getenv("KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES")
+	if raw == "" {
+		return 10 * 1024 * 1024, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES %q", raw)
+	}
+	return n, nil
+}
+
+// newReader returns a reader of the snapshot topic in consumer group
+// groupID.
+func newReader(topic, groupID string) (*kafka.Reader, error) {
+	cfg, err := kafkaConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := snapshotMaxBytes()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("🔌 Kafka brokers %s (%s)\n", strings.Join(cfg.Brokers, ","), cfg.describe())
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  cfg.Brokers,
+		Topic:    topic,
+		GroupID:  groupID,
+		Dialer:   cfg.Dialer(),
+		MaxBytes: maxBytes,
+	}), nil
+}
+
+// envelope is a consumed message with the header convention of the
+// todo-consumer service parsed (see go-consumer/message/envelope.go).
+type envelope struct {
+	EventID         string
+	SchemaVersion   int
+	ContentType     string
+	ContentEncoding string
+	Traceparent     string
+	Source          string
+}
+
+func parseEnvelope(m kafka.Message) (envelope, error) {
+	env := envelope{
+		EventID:         fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset),
+		SchemaVersion:   1,
+		ContentType:     "application/json",
+		ContentEncoding: "identity",
+		Source:          "unknown",
+	}
+
+	for _, h := range m.Headers {
+		value := string(h.Value)
+		if value == "" {
+			continue
+		}
+		switch h.Key {
+		case "event-id":
+			env.EventID = value
+		case "schema-version":
+			version, err := strconv.Atoi(value)
+			if err != nil || version < 1 {
+				return env, fmt.Errorf("invalid schema-version header %q", value)
+			}
+			env.SchemaVersion = version
+		case "content-type":
+			env.ContentType = value
+		case "content-encoding":
+			env.ContentEncoding = value
+		case "traceparent":
+			env.Traceparent = value
+		case "source":
+			env.Source = value
+		}
+	}
+	return env, nil
+}
@@ -5,13 +5,17 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/joho/godotenv"
-	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
@@ -22,11 +26,27 @@ func main() {
 	fmt.Println("📦 Starting Snapshot Processor Service")
 	fmt.Println("📋 Role: Consume snapshot JSON → Upload to S3")
 
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "todo-snapshots",
-		GroupID: "snapshot-processor-group",
-	})
+	// Spans go to OTLP or stdout per OTEL_TRACES_EXPORTER, flushed before exit
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		fmt.Printf("❌ Tracing error: %v\n", err)
+		return
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := shutdownTracing(context.Background()); err != nil {
+			fmt.Printf("⚠️ Failed to flush traces: %v\n", err)
+		}
+		os.Exit(0)
+	}()
+
+	reader, err := newReader("todo-snapshots", "snapshot-processor-group")
+	if err != nil {
+		fmt.Printf("❌ Kafka config error: %v\n", err)
+		return
+	}
 
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
@@ -37,11 +57,15 @@ func main() {
 	}
 
 	svc := s3.New(sess)
+
+	// Snapshot catalog in TimescaleDB (optional - uploads continue without it)
+	catalog := connectCatalog()
 	bucketName := os.Getenv("S3_BUCKET_NAME")
 
 	fmt.Printf("🚀 Snapshot Processor started on topic: todo-snapshots\n")
 
 	for {
+		readStart := time.Now()
 		m, err := reader.ReadMessage(context.Background())
 		if err != nil {
 			fmt.Printf("❌ Read error: %v\n", err)
@@ -49,24 +73,60 @@ func main() {
 			continue
 		}
 
+		// Continues the trace of the snapshot publish
+		ctx, span := startReceive(m, readStart)
+		span.End()
+
+		env, err := parseEnvelope(m)
+		if err != nil {
+			fmt.Printf("❌ Snapshot header error: %v\n", err)
+			continue
+		}
+
 		snapshotID := string(m.Key)
 		s3Key := fmt.Sprintf("snapshots/%s.json", snapshotID)
 
-		_, err = svc.PutObject(&s3.PutObjectInput{
+		// Encrypted snapshots are stored as-is; the envelope headers
+		// (encryption-alg, encryption-key-id, encryption-wrapped-key) travel
+		// in object metadata so restore can unwrap the data key.
+		contentType := env.ContentType
+		if env.ContentEncoding != "identity" {
+			contentType = "application/octet-stream"
+		}
+		metadata := make(map[string]*string)
+		for _, h := range m.Headers {
+			if strings.HasPrefix(h.Key, "encryption-") {
+				metadata[h.Key] = aws.String(string(h.Value))
+			}
+		}
+		if len(metadata) > 0 {
+			contentType = "application/octet-stream"
+		}
+
+		_, putSpan := tracer.Start(ctx, "PutObject", trace.WithAttributes(
+			attribute.String("s3.bucket", bucketName),
+			attribute.String("s3.key", s3Key),
+		))
+		_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
 			Bucket:      aws.String(bucketName),
 			Key:         aws.String(s3Key),
 			Body:        bytes.NewReader(m.Value),
-			ContentType: aws.String("application/json"),
+			ContentType: aws.String(contentType),
+			Metadata:    metadata,
 		})
+		endSpan(putSpan, err)
 
 		if err != nil {
 			fmt.Printf("❌ S3 upload error: %v\n", err)
+			catalog.markFailed(snapshotID, err.Error())
 			continue
 		}
 
 		s3Path := fmt.Sprintf("s3://%s/%s", bucketName, s3Key)
 		fileSizeKB := len(m.Value) / 1024
 
+		catalog.markArchived(snapshotID, s3Path, m.Value)
+
 		fmt.Printf("☁️ Uploaded snapshot: %s (%d KB) -> %s\n", snapshotID, fileSizeKB, s3Path)
 	}
 }
\ No newline at end of file
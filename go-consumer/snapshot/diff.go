@@ -0,0 +1,461 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// diffCollections lists the collections compared by Diff, in report order.
+var diffCollections = []string{"groups", "tasks", "comments", "users"}
+
+// FieldChange is one field that differs between two versions of a document.
+// Nested documents are compared field by field using dotted paths. Changes
+// to redacted fields are reported without their values.
+type FieldChange struct {
+	Field    string      `json:"field"`
+	Before   interface{} `json:"before,omitempty"`
+	After    interface{} `json:"after,omitempty"`
+	Redacted bool        `json:"redacted,omitempty"`
+}
+
+// EntityChange identifies a document that was added, removed or modified.
+type EntityChange struct {
+	ID      string        `json:"id"`
+	Label   string        `json:"label,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// CollectionDiff holds the changes within one collection.
+type CollectionDiff struct {
+	Added    []EntityChange `json:"added"`
+	Removed  []EntityChange `json:"removed"`
+	Modified []EntityChange `json:"modified"`
+}
+
+// DiffReport describes what changes when moving from snapshot From to To.
+// Uncompared lists redacted fields ("collection.path") whose values could
+// not be compared and were left out: encrypted without SNAPSHOT_REDACT_KEY
+// set, or redacted differently in the two snapshots.
+type DiffReport struct {
+	From        string                    `json:"from"`
+	To          string                    `json:"to"`
+	Collections map[string]CollectionDiff `json:"collections"`
+	Uncompared  []string                  `json:"uncompared,omitempty"`
+}
+
+// redactedField is a field path redacted in at least one of two snapshots.
+type redactedField struct {
+	path   []string
+	action RedactAction
+	// comparable is set when both snapshots applied the same action and
+	// its values can be compared: encrypted values get a fresh nonce each
+	// time, so they are decrypted first, which needs the key
+	comparable bool
+}
+
+// Empty reports whether the two snapshots hold the same documents.
+func (r *DiffReport) Empty() bool {
+	for _, c := range r.Collections {
+		if len(c.Added)+len(c.Removed)+len(c.Modified) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff matches documents by _id across groups, tasks, comments and users and
+// reports what was added, removed or modified going from a to b. Redacted
+// fields are compared by their decrypted or hashed values and reported
+// without them.
+func Diff(a, b *SnapshotData) (*DiffReport, error) {
+	report := &DiffReport{
+		From:        a.SnapshotID,
+		To:          b.SnapshotID,
+		Collections: make(map[string]CollectionDiff, len(diffCollections)),
+	}
+
+	key, err := redactKey()
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := redactedFields(a, b, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range diffCollections {
+		for _, field := range redacted[name] {
+			if !field.comparable {
+				report.Uncompared = append(report.Uncompared, name+"."+strings.Join(field.path, "."))
+			}
+		}
+	}
+
+	for _, name := range diffCollections {
+		before, err := a.collection(name)
+		if err != nil {
+			return nil, err
+		}
+		after, err := b.collection(name)
+		if err != nil {
+			return nil, err
+		}
+
+		diff, err := diffDocuments(before, after, redacted[name], key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		report.Collections[name] = diff
+	}
+	return report, nil
+}
+
+// redactedFields returns the fields either snapshot redacted, per
+// collection.
+func redactedFields(a, b *SnapshotData, key []byte) (map[string][]redactedField, error) {
+	actions := func(s *SnapshotData) (map[string]RedactRule, error) {
+		rules, err := ParseRedactRules(strings.Join(s.Metadata.Redactions, ";"))
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", s.SnapshotID, err)
+		}
+		byField := make(map[string]RedactRule, len(rules))
+		for _, rule := range rules {
+			byField[rule.Collection+"."+strings.Join(rule.Path, ".")] = rule
+		}
+		return byField, nil
+	}
+	before, err := actions(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := actions(b)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]struct{}{}
+	for name := range before {
+		names[name] = struct{}{}
+	}
+	for name := range after {
+		names[name] = struct{}{}
+	}
+
+	fields := map[string][]redactedField{}
+	for _, name := range sortedKeys(names) {
+		ruleBefore, inBefore := before[name]
+		ruleAfter, inAfter := after[name]
+		rule := ruleBefore
+		if !inBefore {
+			rule = ruleAfter
+		}
+		fields[rule.Collection] = append(fields[rule.Collection], redactedField{
+			path:   rule.Path,
+			action: rule.Action,
+			comparable: inBefore && inAfter && ruleBefore.Action == ruleAfter.Action &&
+				(rule.Action != RedactEncrypt || key != nil),
+		})
+	}
+	return fields, nil
+}
+
+// prepareRedacted makes the redacted fields of normalised documents
+// comparable: encrypted values are decrypted and fields that cannot be
+// compared are removed.
+func prepareRedacted(docs map[string]map[string]interface{}, fields []redactedField, key []byte) error {
+	for _, field := range fields {
+		for id, doc := range docs {
+			parent, name, ok := lookupField(bson.M(doc), field.path)
+			if !ok {
+				continue
+			}
+			if !field.comparable {
+				delete(parent, name)
+				continue
+			}
+			if field.action != RedactEncrypt {
+				continue
+			}
+			sealed, isString := parent[name].(string)
+			if !isString {
+				continue
+			}
+			plain, err := decryptValue(sealed, key)
+			if err != nil {
+				return fmt.Errorf("document %s field %s: %w", id, strings.Join(field.path, "."), err)
+			}
+			parent[name] = plain
+		}
+	}
+	return nil
+}
+
+func diffDocuments(before, after []bson.M, redacted []redactedField, key []byte) (CollectionDiff, error) {
+	diff := CollectionDiff{
+		Added:    []EntityChange{},
+		Removed:  []EntityChange{},
+		Modified: []EntityChange{},
+	}
+
+	oldDocs, err := indexByID(before)
+	if err != nil {
+		return diff, err
+	}
+	newDocs, err := indexByID(after)
+	if err != nil {
+		return diff, err
+	}
+	if err := prepareRedacted(oldDocs, redacted, key); err != nil {
+		return diff, err
+	}
+	if err := prepareRedacted(newDocs, redacted, key); err != nil {
+		return diff, err
+	}
+
+	for _, id := range sortedKeys(newDocs) {
+		newDoc := newDocs[id]
+		oldDoc, ok := oldDocs[id]
+		if !ok {
+			diff.Added = append(diff.Added, EntityChange{ID: id, Label: documentLabel(newDoc)})
+			continue
+		}
+
+		var changes []FieldChange
+		compareFields("", oldDoc, newDoc, &changes)
+		for i, change := range changes {
+			if isRedacted(change.Field, redacted) {
+				changes[i] = FieldChange{Field: change.Field, Redacted: true}
+			}
+		}
+		if len(changes) > 0 {
+			diff.Modified = append(diff.Modified, EntityChange{ID: id, Label: documentLabel(newDoc), Changes: changes})
+		}
+	}
+
+	for _, id := range sortedKeys(oldDocs) {
+		if _, ok := newDocs[id]; !ok {
+			diff.Removed = append(diff.Removed, EntityChange{ID: id, Label: documentLabel(oldDocs[id])})
+		}
+	}
+	return diff, nil
+}
+
+// indexByID normalises documents through JSON, so snapshots read from Mongo
+// and from JSON files compare equal, and keys them by _id.
+func indexByID(docs []bson.M) (map[string]map[string]interface{}, error) {
+	index := make(map[string]map[string]interface{}, len(docs))
+	for _, doc := range docs {
+		id := documentID(doc["_id"])
+		if id == "" {
+			continue
+		}
+
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var normalised map[string]interface{}
+		if err := json.Unmarshal(raw, &normalised); err != nil {
+			return nil, err
+		}
+		index[id] = normalised
+	}
+	return index, nil
+}
+
+// isRedacted reports whether a changed field is, or is inside, a redacted
+// field.
+func isRedacted(field string, redacted []redactedField) bool {
+	for _, r := range redacted {
+		path := strings.Join(r.path, ".")
+		if field == path || strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func documentID(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case primitive.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	case map[string]interface{}:
+		// Extended JSON {"$oid": "..."}
+		if oid, ok := v["$oid"].(string); ok {
+			return oid
+		}
+	}
+	return fmt.Sprint(id)
+}
+
+func documentLabel(doc map[string]interface{}) string {
+	for _, key := range []string{"name", "title", "username", "text"} {
+		if label, ok := doc[key].(string); ok && label != "" {
+			return label
+		}
+	}
+	return ""
+}
+
+func compareFields(prefix string, before, after map[string]interface{}, changes *[]FieldChange) {
+	keys := make(map[string]struct{}, len(before)+len(after))
+	for k := range before {
+		keys[k] = struct{}{}
+	}
+	for k := range after {
+		keys[k] = struct{}{}
+	}
+
+	for _, k := range sortedKeys(keys) {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+
+		oldValue, newValue := before[k], after[k]
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			compareFields(path, oldMap, newMap, changes)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue, newValue) {
+			*changes = append(*changes, FieldChange{Field: path, Before: oldValue, After: newValue})
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Text renders the report for humans.
+func (r *DiffReport) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Snapshot diff: %s -> %s\n", r.From, r.To)
+	if len(r.Uncompared) > 0 {
+		fmt.Fprintf(&b, "Not compared (redacted): %s\n", strings.Join(r.Uncompared, ", "))
+	}
+	if r.Empty() {
+		b.WriteString("No differences.\n")
+		return b.String()
+	}
+
+	for _, name := range diffCollections {
+		c := r.Collections[name]
+		if len(c.Added)+len(c.Removed)+len(c.Modified) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n%s: %d added, %d removed, %d modified\n", name, len(c.Added), len(c.Removed), len(c.Modified))
+		for _, e := range c.Added {
+			fmt.Fprintf(&b, "  + %s\n", entityTitle(e))
+		}
+		for _, e := range c.Removed {
+			fmt.Fprintf(&b, "  - %s\n", entityTitle(e))
+		}
+		for _, e := range c.Modified {
+			fmt.Fprintf(&b, "  ~ %s\n", entityTitle(e))
+			for _, change := range e.Changes {
+				if change.Redacted {
+					fmt.Fprintf(&b, "      %s: changed (redacted)\n", change.Field)
+					continue
+				}
+				fmt.Fprintf(&b, "      %s: %s -> %s\n", change.Field, formatValue(change.Before), formatValue(change.After))
+			}
+		}
+	}
+	return b.String()
+}
+
+func entityTitle(e EntityChange) string {
+	if e.Label == "" {
+		return e.ID
+	}
+	return fmt.Sprintf("%s (%s)", e.ID, e.Label)
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(raw)
+}
+
+// ParseSnapshot decodes snapshot JSON, decrypting it first when metadata
+// describes an encryption envelope.
+func ParseSnapshot(payload []byte, metadata map[string]string) (*SnapshotData, error) {
+	plain, err := Open(payload, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var data SnapshotData
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("invalid snapshot JSON: %w", err)
+	}
+	return &data, nil
+}
+
+// LoadSnapshotFile reads a snapshot from a local JSON file.
+func LoadSnapshotFile(path string) (*SnapshotData, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSnapshot(raw, nil)
+}
+
+// LoadSnapshot downloads a snapshot by ID from the S3 bucket (S3_BUCKET_NAME).
+func LoadSnapshot(snapshotID string) (*SnapshotData, error) {
+	if snapshotID == "" || strings.ContainsAny(snapshotID, "/\\") {
+		return nil, fmt.Errorf("invalid snapshot ID %q", snapshotID)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AWS session error: %w", err)
+	}
+
+	out, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("S3_BUCKET_NAME")),
+		Key:    aws.String(fmt.Sprintf("snapshots/%s.json", snapshotID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("download snapshot %s: %w", snapshotID, err)
+	}
+	defer out.Body.Close()
+
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(out.Body); err != nil {
+		return nil, fmt.Errorf("download snapshot %s: %w", snapshotID, err)
+	}
+	return ParseSnapshot(body.Bytes(), aws.StringValueMap(out.Metadata))
+}
@@ -0,0 +1,98 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// redactedPair returns two snapshots of the same users, redacted with the
+// same rules; the second changes the password when changePassword is set.
+func redactedPair(t *testing.T, rules string, changePassword bool) (*SnapshotData, *SnapshotData) {
+	t.Helper()
+	parsed, err := ParseRedactRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := testSnapshot(), testSnapshot()
+	b.SnapshotID = "snapshot_next"
+	if changePassword {
+		b.Data.Users[0]["password"] = "a-new-password"
+	}
+	for _, s := range []*SnapshotData{a, b} {
+		if err := Redact(s, parsed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reparsed(t, a), reparsed(t, b)
+}
+
+func TestDiffComparesEncryptedFields(t *testing.T) {
+	testRedactKey(t)
+
+	a, b := redactedPair(t, "users.password=encrypt", false)
+	report, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Empty() {
+		t.Errorf("re-encrypted but unchanged password reported as modified:\n%s", report.Text())
+	}
+
+	a, b = redactedPair(t, "users.password=encrypt", true)
+	report, err = Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := report.Collections["users"].Modified
+	if len(modified) != 1 || len(modified[0].Changes) != 1 {
+		t.Fatalf("want one changed field, got %+v", modified)
+	}
+	change := modified[0].Changes[0]
+	if change.Field != "password" || !change.Redacted || change.Before != nil || change.After != nil {
+		t.Errorf("redacted change = %+v, want the field without values", change)
+	}
+	if text := report.Text(); strings.Contains(text, secretPassword) || strings.Contains(text, "a-new-password") {
+		t.Errorf("diff shows a redacted value:\n%s", text)
+	}
+}
+
+func TestDiffLeavesOutFieldsItCannotCompare(t *testing.T) {
+	testRedactKey(t)
+	a, b := redactedPair(t, "users.password=encrypt", true)
+
+	t.Setenv("SNAPSHOT_REDACT_KEY", "")
+	report, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Empty() {
+		t.Errorf("encrypted field compared without the key:\n%s", report.Text())
+	}
+	if len(report.Uncompared) != 1 || report.Uncompared[0] != "users.password" {
+		t.Errorf("uncompared = %v, want [users.password]", report.Uncompared)
+	}
+
+	// Redacted in only one snapshot: plaintext against a digest
+	plain := testSnapshot()
+	hashed := testSnapshot()
+	testRedactKey(t)
+	rules, _ := ParseRedactRules("users.password=hash")
+	if err := Redact(hashed, rules); err != nil {
+		t.Fatal(err)
+	}
+	hashed.Data.Groups = append(hashed.Data.Groups, bson.M{"_id": "g2", "name": "Later"})
+
+	report, err = Diff(reparsed(t, plain), reparsed(t, hashed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collections["users"].Modified) != 0 {
+		t.Errorf("differently redacted field reported as modified: %+v", report.Collections["users"].Modified)
+	}
+	if len(report.Collections["groups"].Added) != 1 {
+		t.Errorf("unrelated changes lost: %+v", report.Collections["groups"])
+	}
+}
@@ -0,0 +1,335 @@
+package snapshot
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/segmentio/kafka-go"
+)
+
+// EncryptionAlgorithm identifies the payload cipher in headers and metadata.
+const EncryptionAlgorithm = "AES-256-GCM"
+
+// Header (Kafka) and object metadata (S3) keys describing an encrypted
+// snapshot. The snapshot processor copies them from one to the other.
+const (
+	HeaderEncryptionAlg  = "encryption-alg"
+	HeaderEncryptionKey  = "encryption-key-id"
+	HeaderWrappedDataKey = "encryption-wrapped-key"
+)
+
+// KeyProvider wraps and unwraps per-snapshot data keys with a key-encryption
+// key it manages. keyID names the key-encryption key so old snapshots stay
+// readable after rotation.
+type KeyProvider interface {
+	WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error)
+	UnwrapKey(wrapped []byte, keyID string) ([]byte, error)
+}
+
+// Envelope carries what a reader needs to recover the data key.
+type Envelope struct {
+	Algorithm  string
+	KeyID      string
+	WrappedKey []byte
+}
+
+// Headers renders the envelope as Kafka message headers.
+func (e *Envelope) Headers() []kafka.Header {
+	return []kafka.Header{
+		{Key: HeaderEncryptionAlg, Value: []byte(e.Algorithm)},
+		{Key: HeaderEncryptionKey, Value: []byte(e.KeyID)},
+		{Key: HeaderWrappedDataKey, Value: []byte(base64.StdEncoding.EncodeToString(e.WrappedKey))},
+	}
+}
+
+// Metadata renders the envelope as S3 object metadata.
+func (e *Envelope) Metadata() map[string]string {
+	return map[string]string{
+		HeaderEncryptionAlg:  e.Algorithm,
+		HeaderEncryptionKey:  e.KeyID,
+		HeaderWrappedDataKey: base64.StdEncoding.EncodeToString(e.WrappedKey),
+	}
+}
+
+// EnvelopeFromMetadata reads an envelope back from header or metadata values.
+// It returns nil when the payload is not encrypted.
+func EnvelopeFromMetadata(values map[string]string) (*Envelope, error) {
+	lookup := func(key string) string {
+		for k, v := range values {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	alg := lookup(HeaderEncryptionAlg)
+	if alg == "" {
+		return nil, nil
+	}
+	if alg != EncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported snapshot encryption algorithm %q", alg)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(lookup(HeaderWrappedDataKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+
+	return &Envelope{Algorithm: alg, KeyID: lookup(HeaderEncryptionKey), WrappedKey: wrapped}, nil
+}
+
+// EnvelopeFromHeaders reads an envelope from Kafka message headers.
+func EnvelopeFromHeaders(headers []kafka.Header) (*Envelope, error) {
+	values := make(map[string]string, len(headers))
+	for _, h := range headers {
+		values[h.Key] = string(h.Value)
+	}
+	return EnvelopeFromMetadata(values)
+}
+
+// Encrypt seals plaintext with a fresh data key wrapped by provider. The
+// result is the GCM nonce followed by the ciphertext.
+func Encrypt(provider KeyProvider, plaintext []byte) ([]byte, *Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, keyID, err := provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrap data key: %w", err)
+	}
+
+	envelope := &Envelope{Algorithm: EncryptionAlgorithm, KeyID: keyID, WrappedKey: wrapped}
+	return gcm.Seal(nonce, nonce, plaintext, nil), envelope, nil
+}
+
+// Decrypt reverses Encrypt.
+func Decrypt(provider KeyProvider, ciphertext []byte, envelope *Envelope) ([]byte, error) {
+	dataKey, err := provider.UnwrapKey(envelope.WrappedKey, envelope.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key %s: %w", envelope.KeyID, err)
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted snapshot is truncated")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+// Open returns the plaintext snapshot JSON for a stored payload, decrypting it
+// when metadata describes an envelope and passing it through otherwise.
+func Open(payload []byte, metadata map[string]string) ([]byte, error) {
+	envelope, err := EnvelopeFromMetadata(metadata)
+	if err != nil || envelope == nil {
+		return payload, err
+	}
+
+	provider, err := LoadKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("snapshot is encrypted with key %s but SNAPSHOT_ENCRYPTION is not configured", envelope.KeyID)
+	}
+	return Decrypt(provider, payload, envelope)
+}
+
+// Rewrap re-encrypts an envelope's data key under the provider's active key
+// without touching the payload. Use it to retire a rotated-out key; the
+// snapshot rewrap command applies it to every stored snapshot.
+func Rewrap(provider KeyProvider, envelope *Envelope) (*Envelope, error) {
+	dataKey, err := provider.UnwrapKey(envelope.WrappedKey, envelope.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key %s: %w", envelope.KeyID, err)
+	}
+
+	wrapped, keyID, err := provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	return &Envelope{Algorithm: envelope.Algorithm, KeyID: keyID, WrappedKey: wrapped}, nil
+}
+
+// LoadKeyProvider builds the provider selected by SNAPSHOT_ENCRYPTION:
+//
+//	""/"none" - snapshots are published in plaintext (returns nil)
+//	"local"   - keyring JSON file at SNAPSHOT_KEYFILE
+//	"env"     - keyring in SNAPSHOT_KEKS ("id:base64,...") and SNAPSHOT_KEK_ACTIVE
+//	"kms"     - AWS KMS (or compatible) key SNAPSHOT_KMS_KEY_ID
+func LoadKeyProvider() (KeyProvider, error) {
+	switch mode := strings.ToLower(os.Getenv("SNAPSHOT_ENCRYPTION")); mode {
+	case "", "none":
+		return nil, nil
+	case "local":
+		return NewKeyfileProvider(os.Getenv("SNAPSHOT_KEYFILE"))
+	case "env":
+		return NewEnvKeyProvider(os.Getenv("SNAPSHOT_KEKS"), os.Getenv("SNAPSHOT_KEK_ACTIVE"))
+	case "kms":
+		return NewAWSKMSProvider(os.Getenv("SNAPSHOT_KMS_KEY_ID"))
+	default:
+		return nil, fmt.Errorf("unknown SNAPSHOT_ENCRYPTION provider %q", mode)
+	}
+}
+
+// KeyringProvider wraps data keys with locally held AES-256 key-encryption
+// keys. New snapshots use the active key; retired keys stay in the ring so
+// older snapshots can still be opened.
+type KeyringProvider struct {
+	Active string
+	Keys   map[string][]byte
+}
+
+// NewKeyfileProvider loads a keyring file of the form
+// {"activeKeyId": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}}.
+func NewKeyfileProvider(path string) (*KeyringProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("SNAPSHOT_KEYFILE is not set")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keyfile: %w", err)
+	}
+
+	var file struct {
+		ActiveKeyID string            `json:"activeKeyId"`
+		Keys        map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse keyfile: %w", err)
+	}
+	return newKeyringProvider(file.ActiveKeyID, file.Keys)
+}
+
+// NewEnvKeyProvider parses a keyring of the form "k1:<base64>,k2:<base64>".
+func NewEnvKeyProvider(keyring, active string) (*KeyringProvider, error) {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(keyring, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("SNAPSHOT_KEKS entry %q: expected id:base64key", entry)
+		}
+		keys[id] = key
+	}
+	return newKeyringProvider(active, keys)
+}
+
+func newKeyringProvider(active string, encoded map[string]string) (*KeyringProvider, error) {
+	p := &KeyringProvider{Active: active, Keys: make(map[string][]byte, len(encoded))}
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not valid base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must decode to 32 bytes, got %d", id, len(key))
+		}
+		p.Keys[id] = key
+	}
+	if _, ok := p.Keys[p.Active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", p.Active)
+	}
+	return p, nil
+}
+
+func (p *KeyringProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	gcm, err := newGCM(p.Keys[p.Active])
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, []byte(p.Active)), p.Active, nil
+}
+
+func (p *KeyringProvider) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	kek, ok := p.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q is not in the keyring", keyID)
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(keyID))
+}
+
+// KMSClient is the subset of the AWS KMS API used for wrapping data keys. Any
+// KMS-compatible service can be plugged in by implementing it.
+type KMSClient interface {
+	Encrypt(*kms.EncryptInput) (*kms.EncryptOutput, error)
+	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+// KMSProvider wraps data keys with a KMS-managed key. Rotation is handled by
+// KMS; the key ID recorded per snapshot is the one KMS reports.
+type KMSProvider struct {
+	Client KMSClient
+	KeyID  string
+}
+
+// NewAWSKMSProvider uses AWS KMS in AWS_REGION with the given key ID or alias.
+func NewAWSKMSProvider(keyID string) (*KMSProvider, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("SNAPSHOT_KMS_KEY_ID is not set")
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AWS session error: %w", err)
+	}
+	return &KMSProvider{Client: kms.New(sess), KeyID: keyID}, nil
+}
+
+func (p *KMSProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	out, err := p.Client.Encrypt(&kms.EncryptInput{
+		KeyId:     aws.String(p.KeyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return out.CiphertextBlob, aws.StringValue(out.KeyId), nil
+}
+
+func (p *KMSProvider) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	out, err := p.Client.Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,299 @@
+package snapshot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RedactAction says what happens to a sensitive field before a snapshot
+// leaves the service.
+type RedactAction string
+
+const (
+	RedactDrop    RedactAction = "drop"
+	RedactHash    RedactAction = "hash"
+	RedactEncrypt RedactAction = "encrypt"
+)
+
+// Prefixes that mark a value as rewritten by the redaction pipeline.
+// Encrypted values hold the field as JSON so its type survives a restore.
+const (
+	hmacPrefix      = "hmac-sha256:"
+	encryptedPrefix = "enc:v2:"
+)
+
+// defaultRedactRules applies when SNAPSHOT_REDACT is not set, so passwords
+// never leave the service, not even as a digest.
+const defaultRedactRules = "users.password=drop"
+
+// RedactRule targets a field path inside one snapshot collection.
+type RedactRule struct {
+	Collection string
+	Path       []string
+	Action     RedactAction
+}
+
+func (r RedactRule) String() string {
+	return fmt.Sprintf("%s.%s=%s", r.Collection, strings.Join(r.Path, "."), r.Action)
+}
+
+// ParseRedactRules parses rules of the form "collection.field.path=action"
+// separated by ";" or ",", e.g. "users.password=hash;users.email=drop".
+func ParseRedactRules(spec string) ([]RedactRule, error) {
+	var rules []RedactRule
+	for _, raw := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == ',' }) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		target, action, ok := strings.Cut(raw, "=")
+		if !ok {
+			return nil, fmt.Errorf("redaction rule %q: missing action", raw)
+		}
+
+		parts := strings.Split(strings.TrimSpace(target), ".")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("redaction rule %q: expected collection.field", raw)
+		}
+
+		rule := RedactRule{
+			Collection: parts[0],
+			Path:       parts[1:],
+			Action:     RedactAction(strings.ToLower(strings.TrimSpace(action))),
+		}
+		switch rule.Action {
+		case RedactDrop, RedactHash, RedactEncrypt:
+		default:
+			return nil, fmt.Errorf("redaction rule %q: unknown action %q", raw, rule.Action)
+		}
+		if _, err := (&SnapshotData{}).collection(rule.Collection); err != nil {
+			return nil, fmt.Errorf("redaction rule %q: %w", raw, err)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// LoadRedactRules reads rules from SNAPSHOT_REDACT, falling back to
+// defaultRedactRules, and checks SNAPSHOT_REDACT_KEY is set when a rule
+// needs it. Set SNAPSHOT_REDACT=none to disable redaction.
+func LoadRedactRules() ([]RedactRule, error) {
+	spec, ok := os.LookupEnv("SNAPSHOT_REDACT")
+	if !ok || strings.TrimSpace(spec) == "" {
+		spec = defaultRedactRules
+	}
+	if strings.EqualFold(strings.TrimSpace(spec), "none") {
+		return nil, nil
+	}
+	rules, err := ParseRedactRules(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := redactKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRedactKey(rules, key); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// checkRedactKey refuses hash and encrypt rules without a key. Hashes are
+// keyed (HMAC) so low-entropy values such as passwords cannot be
+// brute-forced offline from a published snapshot.
+func checkRedactKey(rules []RedactRule, key []byte) error {
+	if key != nil {
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.Action == RedactHash || rule.Action == RedactEncrypt {
+			return fmt.Errorf("redaction rule %s requires SNAPSHOT_REDACT_KEY", rule)
+		}
+	}
+	return nil
+}
+
+// redactKey returns the 32-byte key from SNAPSHOT_REDACT_KEY (base64), or
+// nil when it is not set. Hash and encrypt rules require it.
+func redactKey() ([]byte, error) {
+	encoded := os.Getenv("SNAPSHOT_REDACT_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("SNAPSHOT_REDACT_KEY is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("SNAPSHOT_REDACT_KEY must decode to 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Redact rewrites the snapshot in place according to rules and records the
+// applied rules in Metadata.Redactions so restore knows what was changed.
+func Redact(snapshot *SnapshotData, rules []RedactRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	key, err := redactKey()
+	if err != nil {
+		return err
+	}
+	if err := checkRedactKey(rules, key); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		docs, err := snapshot.collection(rule.Collection)
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			parent, field, ok := lookupField(doc, rule.Path)
+			if !ok {
+				continue
+			}
+
+			switch rule.Action {
+			case RedactDrop:
+				delete(parent, field)
+			case RedactHash:
+				parent[field] = hashValue(parent[field], key)
+			case RedactEncrypt:
+				sealed, err := encryptValue(parent[field], key)
+				if err != nil {
+					return fmt.Errorf("redaction rule %s: %w", rule, err)
+				}
+				parent[field] = sealed
+			}
+		}
+
+		snapshot.Metadata.Redactions = append(snapshot.Metadata.Redactions, rule.String())
+	}
+	return nil
+}
+
+// collection maps a snapshot collection name to its documents.
+func (s *SnapshotData) collection(name string) ([]bson.M, error) {
+	switch name {
+	case "groups":
+		return s.Data.Groups, nil
+	case "tasks":
+		return s.Data.Tasks, nil
+	case "comments":
+		return s.Data.Comments, nil
+	case "users":
+		return s.Data.Users, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot collection %q", name)
+}
+
+// lookupField walks a dotted path through nested documents and returns the
+// map holding the final field.
+func lookupField(doc bson.M, path []string) (map[string]interface{}, string, bool) {
+	current := map[string]interface{}(doc)
+	for _, key := range path[:len(path)-1] {
+		switch next := current[key].(type) {
+		case bson.M:
+			current = next
+		case map[string]interface{}:
+			current = next
+		case bson.D:
+			m := next.Map()
+			current[key] = m
+			current = m
+		default:
+			return nil, "", false
+		}
+	}
+
+	field := path[len(path)-1]
+	if _, ok := current[field]; !ok {
+		return nil, "", false
+	}
+	return current, field, true
+}
+
+func hashValue(value interface{}, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprint(value)))
+	return hmacPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptValue seals the field's JSON, the form it would have in the
+// published snapshot unredacted.
+func encryptValue(value interface{}, key []byte) (string, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue returns the field an encrypted value holds, decoded the way
+// ParseSnapshot decodes the rest of the snapshot.
+func decryptValue(value string, key []byte) (interface{}, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return nil, fmt.Errorf("value is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(plain, &v); err != nil {
+		return nil, fmt.Errorf("encrypted value is not JSON: %w", err)
+	}
+	return v, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
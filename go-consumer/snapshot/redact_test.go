@@ -0,0 +1,173 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Secrets planted in the test snapshot; none may appear in a published one.
+const (
+	secretPassword = "hunter2-correct-horse"
+	secretEmail    = "ada@example.test"
+	secretToken    = "tok-4f1c9e"
+)
+
+func testRedactKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("SNAPSHOT_REDACT_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+}
+
+func testSnapshot() *SnapshotData {
+	s := &SnapshotData{SnapshotID: "snapshot_test"}
+	s.Data.Users = []bson.M{
+		{
+			"_id":      "u1",
+			"username": "ada",
+			"password": secretPassword,
+			"email":    secretEmail,
+			"profile":  bson.M{"apiToken": secretToken, "age": 36.0, "admin": true},
+		},
+		{"_id": "u2", "username": "bob"},
+	}
+	s.Data.Groups = []bson.M{{"_id": "g1", "name": "Inbox"}}
+	return s
+}
+
+// published serializes the snapshot the way CreateSnapshot publishes it.
+func published(t *testing.T, s *SnapshotData) string {
+	t.Helper()
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// reparsed returns the snapshot as a consumer of the topic would read it.
+func reparsed(t *testing.T, s *SnapshotData) *SnapshotData {
+	t.Helper()
+	parsed, err := ParseSnapshot([]byte(published(t, s)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestRedactPublishesNoSecret(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		// what the redacted password field must look like, "" when dropped
+		prefix string
+	}{
+		{"drop", "users.password=drop;users.email=drop;users.profile.apiToken=drop", ""},
+		{"hash", "users.password=hash;users.email=hash;users.profile.apiToken=hash", hmacPrefix},
+		{"encrypt", "users.password=encrypt;users.email=encrypt;users.profile.apiToken=encrypt", encryptedPrefix},
+		{"mixed", "users.password=drop;users.email=hash;users.profile.apiToken=encrypt", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRedactKey(t)
+			rules, err := ParseRedactRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := testSnapshot()
+			if err := Redact(s, rules); err != nil {
+				t.Fatal(err)
+			}
+
+			out := published(t, s)
+			for _, secret := range []string{secretPassword, secretEmail, secretToken} {
+				if strings.Contains(out, secret) {
+					t.Errorf("published snapshot contains %q:\n%s", secret, out)
+				}
+			}
+
+			password, ok := s.Data.Users[0]["password"].(string)
+			if tt.prefix == "" && ok {
+				t.Errorf("password = %q, want it dropped", password)
+			}
+			if tt.prefix != "" && !strings.HasPrefix(password, tt.prefix) {
+				t.Errorf("password = %q, want prefix %q", password, tt.prefix)
+			}
+
+			if got := len(s.Metadata.Redactions); got != len(rules) {
+				t.Errorf("recorded %d redactions, want %d", got, len(rules))
+			}
+			if s.Data.Users[1]["username"] != "bob" || s.Data.Groups[0]["name"] != "Inbox" {
+				t.Errorf("unrelated fields changed: %v %v", s.Data.Users[1], s.Data.Groups[0])
+			}
+		})
+	}
+}
+
+func TestRedactRequiresKey(t *testing.T) {
+	for _, spec := range []string{"users.password=hash", "users.password=encrypt"} {
+		t.Run(spec, func(t *testing.T) {
+			t.Setenv("SNAPSHOT_REDACT_KEY", "")
+			t.Setenv("SNAPSHOT_REDACT", spec)
+
+			if _, err := LoadRedactRules(); err == nil {
+				t.Error("LoadRedactRules accepted a rule without SNAPSHOT_REDACT_KEY")
+			}
+
+			rules, err := ParseRedactRules(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := testSnapshot()
+			if err := Redact(s, rules); err == nil {
+				t.Error("Redact applied a rule without SNAPSHOT_REDACT_KEY")
+			}
+			if !strings.Contains(published(t, s), secretPassword) {
+				t.Error("snapshot changed although redaction failed")
+			}
+		})
+	}
+}
+
+func TestDefaultRedactRulesDropPasswords(t *testing.T) {
+	t.Setenv("SNAPSHOT_REDACT_KEY", "")
+	t.Setenv("SNAPSHOT_REDACT", "")
+
+	rules, err := LoadRedactRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSnapshot()
+	if err := Redact(s, rules); err != nil {
+		t.Fatal(err)
+	}
+	if out := published(t, s); strings.Contains(out, secretPassword) || strings.Contains(out, `"password"`) {
+		t.Errorf("default rules published the password:\n%s", out)
+	}
+}
+
+func TestDecryptValueKeepsType(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, value := range []interface{}{secretPassword, 36.0, true} {
+		sealed, err := encryptValue(value, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decryptValue(sealed, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Errorf("decrypted %#v, want %#v", got, value)
+		}
+	}
+
+	if _, err := decryptValue(hashValue(secretPassword, key), key); err == nil {
+		t.Error("decrypted a hashed value")
+	}
+}
@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RewrapResult reports what rotation did to one stored snapshot.
+type RewrapResult struct {
+	SnapshotID string `json:"snapshotId"`
+	FromKey    string `json:"fromKey,omitempty"`
+	ToKey      string `json:"toKey,omitempty"`
+	Skipped    string `json:"skipped,omitempty"` // why the object was left alone
+}
+
+// RewrapStored rotates the snapshots in the bucket (S3_BUCKET_NAME) to the
+// provider's active key by rewrapping their data keys. Only object metadata
+// is rewritten; payloads, and therefore catalog checksums, are unchanged.
+// A non-empty fromKey limits rotation to snapshots wrapped with that key.
+// With dryRun nothing is written. report is called for every snapshot.
+func RewrapStored(provider KeyProvider, fromKey string, dryRun bool, report func(RewrapResult)) error {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		return fmt.Errorf("AWS session error: %w", err)
+	}
+	svc := s3.New(sess)
+	bucket := os.Getenv("S3_BUCKET_NAME")
+
+	var failed int
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String("snapshots/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if !strings.HasSuffix(key, ".json") {
+				continue
+			}
+			result, err := rewrapObject(svc, bucket, key, provider, fromKey, dryRun)
+			if err != nil {
+				fmt.Printf("❌ %s: %v\n", key, err)
+				failed++
+				continue
+			}
+			report(result)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d snapshots could not be rewrapped", failed)
+	}
+	return nil
+}
+
+// rewrapObject rewraps one object's data key and replaces its metadata in
+// place with a copy onto itself.
+func rewrapObject(svc *s3.S3, bucket, key string, provider KeyProvider, fromKey string, dryRun bool) (RewrapResult, error) {
+	result := RewrapResult{SnapshotID: strings.TrimSuffix(strings.TrimPrefix(key, "snapshots/"), ".json")}
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return result, err
+	}
+	metadata := aws.StringValueMap(head.Metadata)
+	envelope, err := EnvelopeFromMetadata(metadata)
+	if err != nil {
+		return result, err
+	}
+	if envelope == nil {
+		result.Skipped = "not encrypted"
+		return result, nil
+	}
+	result.FromKey = envelope.KeyID
+
+	if fromKey != "" && envelope.KeyID != fromKey {
+		result.Skipped = "wrapped with another key"
+		return result, nil
+	}
+	if active, ok := provider.(*KeyringProvider); ok && envelope.KeyID == active.Active {
+		result.Skipped = "already under the active key"
+		return result, nil
+	}
+
+	rewrapped, err := Rewrap(provider, envelope)
+	if err != nil {
+		return result, err
+	}
+	result.ToKey = rewrapped.KeyID
+	if dryRun {
+		return result, nil
+	}
+
+	// Keep the other metadata; S3 returns keys in canonical case
+	replaced := map[string]*string{}
+	for k, v := range metadata {
+		switch strings.ToLower(k) {
+		case HeaderEncryptionAlg, HeaderEncryptionKey, HeaderWrappedDataKey:
+			continue
+		}
+		replaced[k] = aws.String(v)
+	}
+	for k, v := range rewrapped.Metadata() {
+		replaced[k] = aws.String(v)
+	}
+
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(bucket + "/" + key),
+		CopySourceIfMatch: head.ETag,
+		ContentType:       head.ContentType,
+		Metadata:          replaced,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	return result, err
+}
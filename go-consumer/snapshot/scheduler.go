@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"todo-consumer/db"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedulerLockKey is the Postgres advisory lock key that elects the single
+// replica allowed to fire scheduled snapshots.
+const schedulerLockKey int64 = 0x736e6170 // "snap"
+
+// scheduledUser is recorded as the creator of snapshots taken by the scheduler.
+const scheduledUser = "Scheduler"
+
+// Scheduler fires CreateSnapshot on cron expressions, independent of user
+// actions.
+type Scheduler struct {
+	cron   *cron.Cron
+	leader *db.Leader
+}
+
+// StartScheduler parses specs (standard 5-field cron expressions or
+// descriptors such as "@hourly", separated by ";") and starts firing
+// scheduled snapshots in the background.
+func StartScheduler(specs string) (*Scheduler, error) {
+	s := &Scheduler{cron: cron.New(), leader: db.NewLeader("Snapshot scheduler", schedulerLockKey)}
+
+	for _, spec := range strings.Split(specs, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		spec := spec
+		if _, err := s.cron.AddFunc(spec, func() { s.run(spec) }); err != nil {
+			return nil, fmt.Errorf("invalid snapshot cron expression %q: %w", spec, err)
+		}
+		fmt.Printf("⏰ Scheduled snapshots: %s\n", spec)
+	}
+
+	if len(s.cron.Entries()) == 0 {
+		return nil, fmt.Errorf("no snapshot cron expressions configured")
+	}
+
+	s.cron.Start()
+	return s, nil
+}
+
+// Stop halts the schedule, waits for a running snapshot and gives up
+// leadership.
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+	s.leader.Release()
+}
+
+func (s *Scheduler) run(spec string) {
+	if !s.leader.Acquire() {
+		return
+	}
+
+	reason := fmt.Sprintf("Scheduled (%s)", spec)
+	if !PerWorkspace() {
+		s.snapshot(spec, reason, "")
+		return
+	}
+
+	workspaces, err := db.ListWorkspaces()
+	if err != nil {
+		fmt.Printf("❌ Scheduled snapshot workspace lookup failed: %v\n", err)
+		return
+	}
+	for _, workspace := range workspaces {
+		s.snapshot(spec, reason, workspace)
+	}
+}
+
+// snapshot takes one scheduled snapshot of a workspace ("" for the whole
+// database) unless nothing changed since its last one.
+func (s *Scheduler) snapshot(spec, reason, workspace string) {
+	label := "all workspaces"
+	if workspace != "" {
+		label = "workspace " + workspace
+	}
+
+	changed, err := db.HasChangesSinceLastSnapshot(workspace)
+	if err != nil {
+		fmt.Printf("❌ Scheduled snapshot check failed (%s): %v\n", label, err)
+		return
+	}
+	if !changed {
+		fmt.Printf("⏭️ Skipping scheduled snapshot (%s) for %s - nothing changed since the last one\n", spec, label)
+		return
+	}
+
+	if err := CreateSnapshot(context.Background(), reason, scheduledUser, workspace); err != nil {
+		fmt.Printf("❌ Scheduled snapshot error (%s): %v\n", label, err)
+	}
+}
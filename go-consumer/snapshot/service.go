@@ -2,13 +2,19 @@ package snapshot
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 	"todo-consumer/db"
+	"todo-consumer/message"
+	"todo-consumer/producer"
+	"todo-consumer/tracing"
 
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -18,6 +24,7 @@ type SnapshotData struct {
 	SnapshotID string    `json:"snapshotId"`
 	CreatedAt  time.Time `json:"createdAt"`
 	CreatedBy  string    `json:"createdBy"`
+	Workspace  string    `json:"workspace,omitempty"`
 	Data       struct {
 		Groups   []bson.M `json:"groups"`
 		Tasks    []bson.M `json:"tasks"`
@@ -31,13 +38,39 @@ type SnapshotData struct {
 			Comments int `json:"comments"`
 			Users    int `json:"users"`
 		} `json:"counts"`
+		Redactions []string `json:"redactions,omitempty"`
+
+		// ChainHeads anchors the event log hash chains as they stood when
+		// the snapshot was taken (see the verify command).
+		ChainHeads []db.ChainHead `json:"chainHeads,omitempty"`
 	} `json:"metadata"`
 }
 
-func CreateSnapshot(triggerReason, user string) error {
+// CreateSnapshot captures the database and publishes it to the snapshot
+// topic. A non-empty workspace limits the snapshot to that workspace's groups
+// (as recorded in the event log), their tasks and comments; users are global
+// and always included.
+func CreateSnapshot(ctx context.Context, triggerReason, user, workspace string) error {
+	ctx, span := tracing.Start(ctx, "CreateSnapshot",
+		attribute.String("snapshot.trigger", triggerReason),
+		attribute.String("workspace", workspace),
+	)
+	err := createSnapshot(ctx, triggerReason, user, workspace)
+	tracing.End(span, err)
+	return err
+}
+
+func createSnapshot(ctx context.Context, triggerReason, user, workspace string) error {
 	now := time.Now()
 	snapshotID := fmt.Sprintf("snapshot_%d_%02d_%02d_%02d_%02d_%02d",
 		now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
+	if workspace != "" {
+		if err := validateWorkspace(workspace); err != nil {
+			return err
+		}
+		snapshotID = fmt.Sprintf("snapshot_%s_%d_%02d_%02d_%02d_%02d_%02d", workspace,
+			now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
+	}
 
 	mongoURI := os.Getenv("MONGODB_URI")
 	if mongoURI == "" {
@@ -45,16 +78,16 @@ func CreateSnapshot(triggerReason, user string) error {
 	}
 	fmt.Printf("Connecting to MongoDB: %s\n", mongoURI)
 
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
 	if err != nil {
 		return fmt.Errorf("MongoDB connection failed: %v", err)
 	}
-	defer client.Disconnect(context.Background())
+	defer client.Disconnect(ctx)
 
 	database := client.Database("todo_manager")
 	
 	// List collections to debug
-	collections, err := database.ListCollectionNames(context.Background(), bson.M{})
+	collections, err := database.ListCollectionNames(ctx, bson.M{})
 	if err == nil {
 		fmt.Printf("Available collections: %v\n", collections)
 	}
@@ -63,6 +96,7 @@ func CreateSnapshot(triggerReason, user string) error {
 	snapshot.SnapshotID = snapshotID
 	snapshot.CreatedAt = now
 	snapshot.CreatedBy = user
+	snapshot.Workspace = workspace
 
 	// Initialize slices to avoid null values
 	snapshot.Data.Groups = make([]bson.M, 0)
@@ -70,12 +104,21 @@ func CreateSnapshot(triggerReason, user string) error {
 	snapshot.Data.Comments = make([]bson.M, 0)
 	snapshot.Data.Users = make([]bson.M, 0)
 
-	groupsCursor, err := database.Collection("groups").Find(context.Background(), bson.M{})
+	groupFilter := bson.M{}
+	if workspace != "" {
+		ids, err := db.GetEntityIDs(workspace, "Group", now)
+		if err != nil {
+			return fmt.Errorf("workspace group lookup failed: %v", err)
+		}
+		groupFilter = bson.M{"_id": bson.M{"$in": objectIDs(ids)}}
+	}
+
+	groupsCursor, err := database.Collection("groups").Find(ctx, groupFilter)
 	if err != nil {
 		return err
 	}
 	var groups []bson.M
-	if err = groupsCursor.All(context.Background(), &groups); err != nil {
+	if err = groupsCursor.All(ctx, &groups); err != nil {
 		return err
 	}
 	if groups != nil {
@@ -83,12 +126,17 @@ func CreateSnapshot(triggerReason, user string) error {
 	}
 	fmt.Printf("Found %d groups\n", len(snapshot.Data.Groups))
 
-	tasksCursor, err := database.Collection("tasks").Find(context.Background(), bson.M{})
+	taskFilter := bson.M{}
+	if workspace != "" {
+		taskFilter = bson.M{"groupId": bson.M{"$in": docIDs(snapshot.Data.Groups)}}
+	}
+
+	tasksCursor, err := database.Collection("tasks").Find(ctx, taskFilter)
 	if err != nil {
 		return err
 	}
 	var tasks []bson.M
-	if err = tasksCursor.All(context.Background(), &tasks); err != nil {
+	if err = tasksCursor.All(ctx, &tasks); err != nil {
 		return err
 	}
 	if tasks != nil {
@@ -96,12 +144,17 @@ func CreateSnapshot(triggerReason, user string) error {
 	}
 	fmt.Printf("Found %d tasks\n", len(snapshot.Data.Tasks))
 
-	commentsCursor, err := database.Collection("comments").Find(context.Background(), bson.M{})
+	commentFilter := bson.M{}
+	if workspace != "" {
+		commentFilter = bson.M{"taskId": bson.M{"$in": docIDs(snapshot.Data.Tasks)}}
+	}
+
+	commentsCursor, err := database.Collection("comments").Find(ctx, commentFilter)
 	if err != nil {
 		return err
 	}
 	var comments []bson.M
-	if err = commentsCursor.All(context.Background(), &comments); err != nil {
+	if err = commentsCursor.All(ctx, &comments); err != nil {
 		return err
 	}
 	if comments != nil {
@@ -109,18 +162,22 @@ func CreateSnapshot(triggerReason, user string) error {
 	}
 	fmt.Printf("Found %d comments\n", len(snapshot.Data.Comments))
 
-	usersCursor, err := database.Collection("users").Find(context.Background(), bson.M{})
-	if err != nil {
-		return err
-	}
-	var users []bson.M
-	if err = usersCursor.All(context.Background(), &users); err != nil {
-		return err
-	}
-	if users != nil {
-		snapshot.Data.Users = users
+	// Users belong to no workspace, so only whole-database snapshots carry
+	// them; a workspace snapshot must not ship other tenants' accounts
+	if workspace == "" {
+		usersCursor, err := database.Collection("users").Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		var users []bson.M
+		if err = usersCursor.All(ctx, &users); err != nil {
+			return err
+		}
+		if users != nil {
+			snapshot.Data.Users = users
+		}
+		fmt.Printf("Found %d users\n", len(snapshot.Data.Users))
 	}
-	fmt.Printf("Found %d users\n", len(snapshot.Data.Users))
 
 	// Check if database has any meaningful data
 	totalRecords := len(snapshot.Data.Groups) + len(snapshot.Data.Tasks) + len(snapshot.Data.Comments)
@@ -135,17 +192,74 @@ func CreateSnapshot(triggerReason, user string) error {
 	snapshot.Metadata.Counts.Comments = len(snapshot.Data.Comments)
 	snapshot.Metadata.Counts.Users = len(snapshot.Data.Users)
 
+	heads, err := db.GetChainHeads(workspace)
+	if err != nil {
+		fmt.Printf("⚠️ Snapshot taken without hash chain anchors: %v\n", err)
+	}
+	snapshot.Metadata.ChainHeads = heads
+
+	// Strip or protect sensitive fields before the snapshot leaves the service
+	rules, err := LoadRedactRules()
+	if err != nil {
+		return fmt.Errorf("invalid redaction rules: %v", err)
+	}
+	if err := Redact(&snapshot, rules); err != nil {
+		return fmt.Errorf("snapshot redaction failed: %v", err)
+	}
+
 	jsonData, err := json.MarshalIndent(snapshot, "", "  ")
 	if err != nil {
 		return err
 	}
 
+	// Envelope-encrypt the payload when a key provider is configured
+	payload := jsonData
+	var headers []kafka.Header
+	provider, err := LoadKeyProvider()
+	if err != nil {
+		return fmt.Errorf("snapshot encryption config error: %v", err)
+	}
+	if provider != nil {
+		sealed, envelope, err := Encrypt(provider, jsonData)
+		if err != nil {
+			return fmt.Errorf("snapshot encryption failed: %v", err)
+		}
+		payload = sealed
+		headers = append(envelope.Headers(), kafka.Header{Key: message.HeaderContentEncoding, Value: []byte(envelope.Algorithm)})
+		fmt.Printf("🔐 Snapshot encrypted with key %s\n", envelope.KeyID)
+	}
+
+	record := db.SnapshotRecord{
+		SnapshotID:    snapshotID,
+		CreatedBy:     user,
+		TriggerReason: triggerReason,
+		Workspace:     workspace,
+		GroupCount:    snapshot.Metadata.Counts.Groups,
+		TaskCount:     snapshot.Metadata.Counts.Tasks,
+		CommentCount:  snapshot.Metadata.Counts.Comments,
+		UserCount:     snapshot.Metadata.Counts.Users,
+		SizeBytes:     int64(len(payload)),
+		Checksum:      Checksum(payload),
+		Status:        db.SnapshotPublished,
+		CreatedAt:     now,
+	}
+
 	// Publish snapshot JSON to separate Kafka topic
-	if err := publishSnapshotToKafka(snapshotID, jsonData); err != nil {
+	delivery, err := publishSnapshotToKafka(ctx, snapshotID, payload, headers)
+	if err != nil {
+		record.Status = db.SnapshotFailed
+		record.Error = err.Error()
+		if catalogErr := db.RecordSnapshot(record); catalogErr != nil {
+			fmt.Printf("⚠️ Failed to catalog snapshot %s: %v\n", snapshotID, catalogErr)
+		}
 		return fmt.Errorf("failed to publish snapshot to Kafka: %v", err)
 	}
 
-	fileSizeKB := len(jsonData) / 1024
+	if err := db.RecordSnapshot(record); err != nil {
+		fmt.Printf("⚠️ Failed to catalog snapshot %s: %v\n", snapshotID, err)
+	}
+
+	fileSizeKB := len(payload) / 1024
 
 	changes := fmt.Sprintf("Snapshot created with %d groups, %d tasks, %d comments, %d users - Reference: %s",
 		snapshot.Metadata.Counts.Groups,
@@ -154,6 +268,11 @@ func CreateSnapshot(triggerReason, user string) error {
 		snapshot.Metadata.Counts.Users,
 		snapshotID)
 
+	logWorkspace := workspace
+	if logWorkspace == "" {
+		logWorkspace = db.SystemWorkspace
+	}
+
 	err = db.InsertLog(
 		"SNAPSHOT_CREATED",
 		"SYSTEM",
@@ -164,7 +283,8 @@ func CreateSnapshot(triggerReason, user string) error {
 		"",
 		changes,
 		user,
-		"system",
+		logWorkspace,
+		nil,
 		now,
 	)
 
@@ -172,21 +292,36 @@ func CreateSnapshot(triggerReason, user string) error {
 		return err
 	}
 
-	fmt.Printf("📸 Snapshot created: %s (%d KB) -> Kafka topic\n", snapshotID, fileSizeKB)
+	fmt.Printf("📸 Snapshot created: %s (%d KB) -> %s [partition %d, offset %d]\n",
+		snapshotID, fileSizeKB, delivery.Topic, delivery.Partition, delivery.Offset)
 	return nil
 }
 
-func publishSnapshotToKafka(snapshotID string, jsonData []byte) error {
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "todo-snapshots",
-	})
-	defer writer.Close()
+// Checksum fingerprints a snapshot payload exactly as it was published.
+func Checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func publishSnapshotToKafka(ctx context.Context, snapshotID string, jsonData []byte, headers []kafka.Header) (producer.Delivery, error) {
+	ctx, span := tracing.Start(ctx, "publishSnapshotToKafka",
+		attribute.String("messaging.destination.name", "todo-snapshots"),
+		attribute.String("messaging.kafka.message.key", snapshotID),
+	)
 
-	message := kafka.Message{
-		Key:   []byte(snapshotID),
-		Value: jsonData,
+	msg := kafka.Message{
+		Topic:   "todo-snapshots",
+		Key:     []byte(snapshotID),
+		Value:   jsonData,
+		Headers: headers,
 	}
+	// The snapshot processor continues this trace for the S3 upload
+	tracing.Inject(ctx, &msg)
 
-	return writer.WriteMessages(context.Background(), message)
-}
\ No newline at end of file
+	deliveries, err := producer.Default.Publish(ctx, msg)
+	tracing.End(span, err)
+	if err != nil {
+		return producer.Delivery{}, err
+	}
+	return deliveries[0], nil
+}
@@ -0,0 +1,48 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// workspaceName restricts workspaces that can be snapshotted on their own,
+// since the name becomes part of the snapshot ID and object key.
+var workspaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// PerWorkspace reports whether snapshots are taken per workspace
+// (SNAPSHOT_PER_WORKSPACE=true) instead of for the whole database.
+func PerWorkspace() bool {
+	return os.Getenv("SNAPSHOT_PER_WORKSPACE") == "true"
+}
+
+func validateWorkspace(workspace string) error {
+	if !workspaceName.MatchString(workspace) {
+		return fmt.Errorf("workspace %q cannot be snapshotted: use letters, digits, '-' or '_'", workspace)
+	}
+	return nil
+}
+
+// objectIDs converts hex IDs from the event log into Mongo ObjectIDs,
+// skipping any that are not ObjectIDs.
+func objectIDs(ids []string) []primitive.ObjectID {
+	oids := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			oids = append(oids, oid)
+		}
+	}
+	return oids
+}
+
+// docIDs collects the _id of each document.
+func docIDs(docs []bson.M) []interface{} {
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	return ids
+}
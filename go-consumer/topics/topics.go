@@ -0,0 +1,387 @@
+// Package topics declares the Kafka topics the pipeline uses and brings the
+// cluster in line with them, instead of relying on broker auto-creation
+// (one partition, broker default retention). At startup missing topics are
+// created and settings that drifted from the spec are reported, or fixed in
+// reconcile mode.
+//
+// Only additive changes are reconciled: topic configs are altered and
+// partitions added. Adding partitions moves keys to other partitions, so
+// events of one entity may briefly be consumed out of order. Fewer
+// partitions or another replication factor need a manual migration and are
+// only reported.
+//
+// Configuration (environment):
+//
+//	KAFKA_TOPICS_MODE                off, create (default: create missing, report drift) or reconcile
+//	KAFKA_TOPIC_REPLICATION          replication factor of every topic, default 1
+//	KAFKA_HISTORY_PARTITIONS         partitions of todo-history-events, default 6
+//	KAFKA_HISTORY_RETENTION_MS       retention of todo-history-events, default -1 (forever; backfill rebuilds from it)
+//	KAFKA_SNAPSHOT_RETENTION_MS      retention of todo-snapshots, default 604800000 (7 days)
+//	KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES largest snapshot accepted, default 10485760
+//	KAFKA_DLQ_RETENTION_MS           retention of the dead-letter topic, default 2592000000 (30 days)
+package topics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/producer"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// historyMaxMessageBytes is the largest history event accepted.
+const historyMaxMessageBytes = 1024 * 1024
+
+// dlqHeaderMargin is the room dead-lettered events get on top of their
+// original size for the dlq-* headers, whose dlq-reason is an error message.
+const dlqHeaderMargin = 64 * 1024
+
+// Spec is the desired layout and configuration of a topic.
+type Spec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	Configs           map[string]string // e.g. retention.ms, max.message.bytes, cleanup.policy
+}
+
+// Drift is one setting of an existing topic that differs from its spec.
+// Fixable drift is corrected in reconcile mode.
+type Drift struct {
+	Topic   string
+	Setting string
+	Want    string
+	Have    string
+	Fixable bool
+}
+
+// Report is the result of comparing the cluster with the specs.
+type Report struct {
+	Missing []Spec
+	Drift   []Drift
+}
+
+// Specs returns the desired topics.
+func Specs() ([]Spec, error) {
+	values := map[string]int64{
+		"KAFKA_TOPIC_REPLICATION":          1,
+		"KAFKA_HISTORY_PARTITIONS":         6,
+		"KAFKA_HISTORY_RETENTION_MS":       -1,
+		"KAFKA_SNAPSHOT_RETENTION_MS":      7 * 24 * 60 * 60 * 1000,
+		"KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES": 10 * 1024 * 1024,
+		"KAFKA_DLQ_RETENTION_MS":           30 * 24 * 60 * 60 * 1000,
+	}
+	for name := range values {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		values[name] = n
+	}
+	if values["KAFKA_TOPIC_REPLICATION"] < 1 || values["KAFKA_HISTORY_PARTITIONS"] < 1 {
+		return nil, fmt.Errorf("KAFKA_TOPIC_REPLICATION and KAFKA_HISTORY_PARTITIONS must be at least 1")
+	}
+
+	replication := int(values["KAFKA_TOPIC_REPLICATION"])
+	str := func(name string) string { return strconv.FormatInt(values[name], 10) }
+
+	return []Spec{
+		{
+			// Keyed by entity ID, so partitions keep each entity's events in order
+			Name:              "todo-history-events",
+			Partitions:        int(values["KAFKA_HISTORY_PARTITIONS"]),
+			ReplicationFactor: replication,
+			Configs: map[string]string{
+				"cleanup.policy":    "delete",
+				"retention.ms":      str("KAFKA_HISTORY_RETENTION_MS"),
+				"max.message.bytes": strconv.Itoa(historyMaxMessageBytes),
+			},
+		},
+		{
+			Name:              "todo-snapshots",
+			Partitions:        1,
+			ReplicationFactor: replication,
+			Configs: map[string]string{
+				"cleanup.policy":    "delete",
+				"retention.ms":      str("KAFKA_SNAPSHOT_RETENTION_MS"),
+				"max.message.bytes": str("KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES"),
+			},
+		},
+		{
+			Name:              producer.DeadLetterTopic(),
+			Partitions:        1,
+			ReplicationFactor: replication,
+			Configs: map[string]string{
+				"cleanup.policy":    "delete",
+				"retention.ms":      str("KAFKA_DLQ_RETENTION_MS"),
+				"max.message.bytes": strconv.Itoa(historyMaxMessageBytes + dlqHeaderMargin),
+			},
+		},
+	}, nil
+}
+
+// Ensure runs at service startup: it creates missing topics and reports
+// drift, fixing it when KAFKA_TOPICS_MODE is reconcile.
+func Ensure(ctx context.Context) error {
+	mode := os.Getenv("KAFKA_TOPICS_MODE")
+	switch mode {
+	case "off":
+		return nil
+	case "":
+		mode = "create"
+	case "create", "reconcile":
+	default:
+		return fmt.Errorf("unsupported KAFKA_TOPICS_MODE %q (use off, create or reconcile)", mode)
+	}
+
+	specs, err := Specs()
+	if err != nil {
+		return err
+	}
+	client, err := kafkaclient.NewClient()
+	if err != nil {
+		return err
+	}
+
+	report, err := Check(ctx, client, specs)
+	if err != nil {
+		return err
+	}
+	for _, d := range report.Drift {
+		fmt.Printf("⚠️ Topic %s drifted: %s is %s, spec %s\n", d.Topic, d.Setting, d.Have, d.Want)
+	}
+
+	if err := Apply(ctx, client, report, mode == "reconcile"); err != nil {
+		return err
+	}
+	fmt.Printf("🧾 Kafka topics verified (%d topics, %d created, %d drifted)\n", len(specs), len(report.Missing), len(report.Drift))
+	return nil
+}
+
+// Check compares the topics on the cluster with specs.
+func Check(ctx context.Context, client *kafka.Client, specs []Spec) (Report, error) {
+	var report Report
+
+	names := make([]string, len(specs))
+	for i, s := range specs {
+		names[i] = s.Name
+	}
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		return report, err
+	}
+	found := map[string]kafka.Topic{}
+	for _, t := range meta.Topics {
+		if t.Error != nil {
+			if errors.Is(t.Error, kafka.UnknownTopicOrPartition) {
+				continue
+			}
+			return report, fmt.Errorf("metadata of %s: %w", t.Name, t.Error)
+		}
+		found[t.Name] = t
+	}
+
+	var resources []kafka.DescribeConfigRequestResource
+	for _, s := range specs {
+		t, ok := found[s.Name]
+		if !ok {
+			report.Missing = append(report.Missing, s)
+			continue
+		}
+
+		if have := len(t.Partitions); have != s.Partitions {
+			report.Drift = append(report.Drift, Drift{
+				Topic: s.Name, Setting: "partitions",
+				Want: strconv.Itoa(s.Partitions), Have: strconv.Itoa(have),
+				Fixable: have < s.Partitions,
+			})
+		}
+		if len(t.Partitions) > 0 {
+			if have := len(t.Partitions[0].Replicas); have != s.ReplicationFactor {
+				report.Drift = append(report.Drift, Drift{
+					Topic: s.Name, Setting: "replication factor",
+					Want: strconv.Itoa(s.ReplicationFactor), Have: strconv.Itoa(have),
+				})
+			}
+		}
+
+		resources = append(resources, kafka.DescribeConfigRequestResource{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: s.Name,
+			ConfigNames:  configNames(s),
+		})
+	}
+	if len(resources) == 0 {
+		return report, nil
+	}
+
+	described, err := client.DescribeConfigs(ctx, &kafka.DescribeConfigsRequest{Resources: resources})
+	if err != nil {
+		return report, err
+	}
+	bySpec := map[string]Spec{}
+	for _, s := range specs {
+		bySpec[s.Name] = s
+	}
+	for _, r := range described.Resources {
+		if r.Error != nil {
+			return report, fmt.Errorf("configs of %s: %w", r.ResourceName, r.Error)
+		}
+		have := map[string]string{}
+		for _, e := range r.ConfigEntries {
+			have[e.ConfigName] = e.ConfigValue
+		}
+		s := bySpec[r.ResourceName]
+		for _, name := range configNames(s) {
+			if have[name] != s.Configs[name] {
+				report.Drift = append(report.Drift, Drift{
+					Topic: s.Name, Setting: name,
+					Want: s.Configs[name], Have: have[name],
+					Fixable: true,
+				})
+			}
+		}
+	}
+	return report, nil
+}
+
+// Apply creates the missing topics of report and, with reconcile, fixes its
+// fixable drift.
+func Apply(ctx context.Context, client *kafka.Client, report Report, reconcile bool) error {
+	if len(report.Missing) > 0 {
+		var create []kafka.TopicConfig
+		for _, s := range report.Missing {
+			tc := kafka.TopicConfig{
+				Topic:             s.Name,
+				NumPartitions:     s.Partitions,
+				ReplicationFactor: s.ReplicationFactor,
+			}
+			for _, name := range configNames(s) {
+				tc.ConfigEntries = append(tc.ConfigEntries, kafka.ConfigEntry{ConfigName: name, ConfigValue: s.Configs[name]})
+			}
+			create = append(create, tc)
+		}
+
+		res, err := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: create})
+		if err != nil {
+			return err
+		}
+		for _, s := range report.Missing {
+			// Created meanwhile, e.g. by another service starting
+			if err := res.Errors[s.Name]; err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+				return fmt.Errorf("failed to create topic %s: %w", s.Name, err)
+			}
+			fmt.Printf("🆕 Created topic %s (%d partitions, replication %d)\n", s.Name, s.Partitions, s.ReplicationFactor)
+		}
+	}
+
+	if !reconcile {
+		return nil
+	}
+
+	configs := map[string][]kafka.IncrementalAlterConfigsRequestConfig{}
+	var partitions []kafka.TopicPartitionsConfig
+	for _, d := range report.Drift {
+		switch {
+		case !d.Fixable:
+			fmt.Printf("⚠️ Topic %s: %s cannot be changed in place (%s, spec %s)\n", d.Topic, d.Setting, d.Have, d.Want)
+		case d.Setting == "partitions":
+			want, _ := strconv.Atoi(d.Want)
+			partitions = append(partitions, kafka.TopicPartitionsConfig{Name: d.Topic, Count: int32(want)})
+		default:
+			configs[d.Topic] = append(configs[d.Topic], kafka.IncrementalAlterConfigsRequestConfig{
+				Name: d.Setting, Value: d.Want, ConfigOperation: kafka.ConfigOperationSet,
+			})
+		}
+	}
+
+	if len(configs) > 0 {
+		var resources []kafka.IncrementalAlterConfigsRequestResource
+		for topic, c := range configs {
+			resources = append(resources, kafka.IncrementalAlterConfigsRequestResource{
+				ResourceType: kafka.ResourceTypeTopic,
+				ResourceName: topic,
+				Configs:      c,
+			})
+		}
+		res, err := client.IncrementalAlterConfigs(ctx, &kafka.IncrementalAlterConfigsRequest{Resources: resources})
+		if err != nil {
+			return err
+		}
+		for _, r := range res.Resources {
+			if r.Error != nil {
+				return fmt.Errorf("failed to alter configs of %s: %w", r.ResourceName, r.Error)
+			}
+			fmt.Printf("🔧 Reconciled configs of topic %s\n", r.ResourceName)
+		}
+	}
+
+	if len(partitions) > 0 {
+		res, err := client.CreatePartitions(ctx, &kafka.CreatePartitionsRequest{Topics: partitions})
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			if err := res.Errors[p.Name]; err != nil {
+				return fmt.Errorf("failed to add partitions to %s: %w", p.Name, err)
+			}
+			fmt.Printf("🔧 Topic %s now has %d partitions\n", p.Name, p.Count)
+		}
+	}
+	return nil
+}
+
+// MaxMessageBytes returns the max.message.bytes the spec of topic sets, so
+// readers of the topic can fetch its largest message.
+func MaxMessageBytes(topic string) (int, error) {
+	specs, err := Specs()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range specs {
+		if s.Name == topic {
+			return strconv.Atoi(s.Configs["max.message.bytes"])
+		}
+	}
+	return 0, fmt.Errorf("no spec for topic %s", topic)
+}
+
+// CheckProducerLimit fails when the producer would refuse messages a topic
+// accepts (KAFKA_PRODUCER_MAX_MESSAGE_BYTES below
+// KAFKA_SNAPSHOT_MAX_MESSAGE_BYTES), so a snapshot that grows past the
+// producer's limit does not go unpublished until someone reads the logs.
+func CheckProducerLimit() error {
+	cfg, err := producer.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	specs, err := Specs()
+	if err != nil {
+		return err
+	}
+	for _, s := range specs {
+		limit, err := strconv.ParseInt(s.Configs["max.message.bytes"], 10, 64)
+		if err == nil && cfg.MaxMessageBytes < limit {
+			return fmt.Errorf("topic %s accepts messages up to %d bytes, but KAFKA_PRODUCER_MAX_MESSAGE_BYTES is %d", s.Name, limit, cfg.MaxMessageBytes)
+		}
+	}
+	return nil
+}
+
+// configNames returns the config names of s in a stable order.
+func configNames(s Spec) []string {
+	names := make([]string, 0, len(s.Configs))
+	for name := range s.Configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,155 @@
+// Package tracing sets up OpenTelemetry for the pipeline and carries W3C
+// trace context through Kafka headers, so a trace started by an Express
+// publish continues through the consumer, the database insert, snapshot
+// publishing and the S3 upload.
+//
+// Configuration (environment):
+//
+//	OTEL_TRACES_EXPORTER        otlp, stdout or none (default)
+//	OTEL_EXPORTER_OTLP_ENDPOINT OTLP/HTTP collector, default http://localhost:4318
+//	OTEL_SERVICE_NAME           service name, default the message source
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"todo-consumer/message"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "todo-consumer"
+
+// Init installs the exporter chosen by OTEL_TRACES_EXPORTER and the W3C
+// propagator. The returned function flushes pending spans on shutdown.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q (use otlp, stdout or none)", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter error: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME, read by WithFromEnv, wins over the message source
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(message.Source())),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	fmt.Printf("🔭 Tracing enabled (%s exporter)\n", os.Getenv("OTEL_TRACES_EXPORTER"))
+	return provider.Shutdown, nil
+}
+
+// Start opens a span named name as a child of ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err (if any) on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartReceive opens the consumer span of a message read by ReadMessage,
+// continuing the producer's trace from its headers. The span starts when
+// the read began, or when the message was produced if that was later, so
+// it covers the time this message spent being delivered and not time spent
+// idle waiting for it.
+func StartReceive(m kafka.Message, readStart time.Time) (context.Context, trace.Span) {
+	start := readStart
+	if m.Time.After(start) && m.Time.Before(time.Now()) {
+		start = m.Time
+	}
+
+	ctx := Extract(context.Background(), m.Headers)
+	return otel.Tracer(tracerName).Start(ctx, "receive "+m.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(m.Topic),
+			semconv.MessagingKafkaMessageOffset(int(m.Offset)),
+			semconv.MessagingDestinationPartitionID(fmt.Sprint(m.Partition)),
+			semconv.MessagingKafkaMessageKey(string(m.Key)),
+		),
+	)
+}
+
+// Inject writes the trace context of ctx into the headers of m.
+func Inject(ctx context.Context, m *kafka.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{headers: &m.Headers})
+}
+
+// Extract returns ctx carrying the trace context found in headers.
+func Extract(ctx context.Context, headers []kafka.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier{headers: &headers})
+}
+
+// headerCarrier adapts Kafka headers to propagation.TextMapCarrier.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, len(*c.headers))
+	for i, h := range *c.headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
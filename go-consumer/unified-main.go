@@ -3,18 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	"todo-consumer/archive"
+	"todo-consumer/cdc"
 	"todo-consumer/db"
+	consumer "todo-consumer/kafka"
+	"todo-consumer/kafkaclient"
+	"todo-consumer/message"
+	"todo-consumer/outbox"
+	"todo-consumer/producer"
 	"todo-consumer/snapshot"
+	"todo-consumer/topics"
+	"todo-consumer/tracing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/joho/godotenv"
-	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func main() {
@@ -31,102 +41,94 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Start main consumer in goroutine
-	go startMainConsumer()
-
-	// Start snapshot processor in goroutine
-	go startSnapshotProcessor()
+	// Spans go to OTLP or stdout per OTEL_TRACES_EXPORTER, flushed before exit
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		fmt.Println("❌ Failed to start tracing:", err)
+		os.Exit(1)
+	}
 
-	// Keep main thread alive
-	select {}
-}
+	// Snapshots the topic accepts must not be refused by the producer
+	if err := topics.CheckProducerLimit(); err != nil {
+		fmt.Println("❌ Invalid Kafka message size config:", err)
+		os.Exit(1)
+	}
 
-func startMainConsumer() {
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "todo-history-events",
-		GroupID: "todo-consumer-group-go",
-	})
+	// Create missing topics with their partitions, retention and size limits
+	// before anything publishes to them
+	if err := topics.Ensure(context.Background()); err != nil {
+		fmt.Println("⚠️ Kafka topic bootstrap failed:", err)
+	}
 
-	fmt.Println("🚀 Main Consumer started on topic: todo-history-events")
+	// One producer for the life of the service (snapshots, dead letters),
+	// flushed before exit
+	if err := producer.Init(); err != nil {
+		fmt.Println("❌ Failed to start Kafka producer:", err)
+		os.Exit(1)
+	}
+	go closeOnSignal(shutdownTracing)
 
-	for {
-		m, err := reader.ReadMessage(context.Background())
-		if err != nil {
-			fmt.Printf("❌ Read error: %v\n", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
+	// Snapshots are refused rather than published with rules that cannot
+	// be applied (hash or encrypt without SNAPSHOT_REDACT_KEY)
+	if _, err := snapshot.LoadRedactRules(); err != nil {
+		fmt.Println("❌ Invalid snapshot redaction config:", err)
+		os.Exit(1)
+	}
 
-		var e Event
-		if err := json.Unmarshal(m.Value, &e); err != nil {
-			fmt.Printf("⚠️ JSON parse error: %v\n", err)
-			continue
+	if specs := os.Getenv("SNAPSHOT_CRON"); specs != "" {
+		if _, err := snapshot.StartScheduler(specs); err != nil {
+			fmt.Println("❌ Failed to start snapshot scheduler:", err)
+			os.Exit(1)
 		}
+	}
 
-		ts, err := time.Parse(time.RFC3339, e.Timestamp)
-		if err != nil {
-			ts = time.Now().UTC()
-		}
+	// Archive expired event log chunks to S3 before dropping them
+	if os.Getenv("EVENT_LOG_ARCHIVE") == "true" {
+		go archive.StartArchiver()
+	}
 
-		if e.EventType == "SNAPSHOT_TRIGGER" {
-			fmt.Printf("📸 Snapshot trigger received: %s by %s\n", e.Payload.Changes, e.Payload.User)
-			// Snapshot creation should be handled by Express.js, not Go consumer
-			continue
-		}
+	// Log changes made in MongoDB itself (direct edits, restores) as history;
+	// only the replica holding the ingester lock watches
+	if os.Getenv("CDC_ENABLED") == "true" {
+		go cdc.Start()
+	}
 
-		groupId := e.Payload.GroupId
-		groupName := e.Payload.GroupName
-		taskId := e.Payload.TaskId
-		taskName := e.Payload.TaskName
+	// Publish history events the Express backend parked in the MongoDB
+	// outbox; only the replica holding the relay lock publishes
+	if os.Getenv("OUTBOX_RELAY") == "true" {
+		go outbox.StartRelay()
+	}
 
-		if e.Payload.Entity == "Group" {
-			groupId = e.Payload.EntityId
-		}
-		if e.Payload.Entity == "Task" {
-			taskId = e.Payload.EntityId
-		}
+	// Start main consumer in goroutine
+	go startMainConsumer()
 
-		if err := db.InsertLog(
-			e.EventType,
-			e.Payload.Entity,
-			e.Payload.EntityId,
-			groupId,
-			groupName,
-			taskId,
-			taskName,
-			e.Payload.Changes,
-			e.Payload.User,
-			e.Payload.Workspace,
-			ts,
-		); err != nil {
-			fmt.Printf("❌ DB insert error: %v\n", err)
-			continue
-		}
+	// Start snapshot processor in goroutine
+	go startSnapshotProcessor()
 
-		var displayMsg string
-		if e.Payload.Changes != "" {
-			displayMsg = e.Payload.Changes
-		} else {
-			displayMsg = fmt.Sprintf("%s operation on %s", e.EventType, e.Payload.Entity)
-		}
+	// Keep main thread alive
+	select {}
+}
 
-		fmt.Printf("📝 [%s] %s - %s (Group: %s, Task: %s)\n",
-			e.EventType,
-			ts.Format("15:04:05"),
-			displayMsg,
-			groupName,
-			taskName,
-		)
+// startMainConsumer writes history events to TimescaleDB through the same
+// group consumer as the standalone service. Snapshot triggers are only
+// logged; Express takes the snapshots.
+func startMainConsumer() {
+	if err := consumer.StartConsumer(false); err != nil {
+		fmt.Printf("❌ Kafka consumer failed: %v\n", err)
 	}
 }
 
 func startSnapshotProcessor() {
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "todo-snapshots",
-		GroupID: "snapshot-processor-group",
-	})
+	maxBytes, err := topics.MaxMessageBytes("todo-snapshots")
+	if err != nil {
+		fmt.Printf("❌ Kafka config error: %v\n", err)
+		return
+	}
+	reader, err := kafkaclient.NewReader("todo-snapshots", "snapshot-processor-group", maxBytes)
+	if err != nil {
+		fmt.Printf("❌ Kafka config error: %v\n", err)
+		return
+	}
 
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
@@ -142,6 +144,7 @@ func startSnapshotProcessor() {
 	fmt.Printf("📦 Snapshot Processor started on topic: todo-snapshots\n")
 
 	for {
+		readStart := time.Now()
 		m, err := reader.ReadMessage(context.Background())
 		if err != nil {
 			fmt.Printf("❌ Snapshot read error: %v\n", err)
@@ -149,48 +152,88 @@ func startSnapshotProcessor() {
 			continue
 		}
 
-		snapshotID := string(m.Key)
+		// Continues the trace of the snapshot publish
+		ctx, span := tracing.StartReceive(m, readStart)
+		span.End()
+
+		env, err := message.Parse(m)
+		if err != nil {
+			fmt.Printf("❌ Snapshot header error: %v\n", err)
+			continue
+		}
+
+		snapshotID := string(env.Key)
 		s3Key := fmt.Sprintf("snapshots/%s.json", snapshotID)
 
-		_, err = svc.PutObject(&s3.PutObjectInput{
+		// Encrypted snapshots are stored as-is; the envelope travels in object
+		// metadata so restore can unwrap the data key.
+		envelope, err := snapshot.EnvelopeFromHeaders(env.Headers)
+		if err != nil {
+			fmt.Printf("❌ Snapshot envelope error: %v\n", err)
+			continue
+		}
+		contentType := env.ContentType
+		if env.ContentEncoding != message.EncodingIdentity {
+			contentType = "application/octet-stream"
+		}
+		var metadata map[string]*string
+		if envelope != nil {
+			contentType = "application/octet-stream"
+			metadata = aws.StringMap(envelope.Metadata())
+		}
+
+		_, putSpan := tracing.Start(ctx, "PutObject",
+			attribute.String("s3.bucket", bucketName),
+			attribute.String("s3.key", s3Key),
+		)
+		_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
 			Bucket:      aws.String(bucketName),
 			Key:         aws.String(s3Key),
 			Body:        bytes.NewReader(m.Value),
-			ContentType: aws.String("application/json"),
+			ContentType: aws.String(contentType),
+			Metadata:    metadata,
 		})
+		tracing.End(putSpan, err)
 
 		if err != nil {
 			fmt.Printf("❌ S3 upload error: %v\n", err)
+			if err := db.MarkSnapshotFailed(snapshotID, err.Error()); err != nil {
+				fmt.Printf("⚠️ Failed to catalog snapshot %s: %v\n", snapshotID, err)
+			}
 			continue
 		}
 
 		s3Path := fmt.Sprintf("s3://%s/%s", bucketName, s3Key)
 		fileSizeKB := len(m.Value) / 1024
 
+		if err := db.MarkSnapshotArchived(snapshotID, s3Path, snapshot.Checksum(m.Value), int64(len(m.Value))); err != nil {
+			fmt.Printf("⚠️ Failed to catalog snapshot %s: %v\n", snapshotID, err)
+		}
+
 		fmt.Printf("☁️ Uploaded snapshot: %s (%d KB) -> %s\n", snapshotID, fileSizeKB, s3Path)
 	}
 }
 
-func handleSnapshotTrigger(payload Payload, ts time.Time) error {
-	fmt.Printf("📸 Snapshot trigger: %s by %s\n", payload.Changes, payload.User)
-	return snapshot.CreateSnapshot(payload.Changes, payload.User)
-}
+// closeOnSignal commits the consumer's offsets, flushes the Kafka producer
+// and pending spans and exits on SIGINT/SIGTERM.
+func closeOnSignal(shutdownTracing func(context.Context) error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	// Leaving the group revokes its partitions, which commits the offsets of
+	// events already written; dead letters still need the producer
+	fmt.Println("🛑 Shutting down, committing consumer offsets...")
+	if err := consumer.Close(); err != nil {
+		fmt.Println("⚠️ Failed to close Kafka consumer:", err)
+	}
 
-type Event struct {
-	EventType string  `json:"eventType"`
-	Payload   Payload `json:"payload"`
-	Timestamp string  `json:"timestamp"`
+	fmt.Println("🛑 Flushing Kafka producer...")
+	if err := producer.Close(); err != nil {
+		fmt.Println("⚠️ Failed to flush Kafka producer:", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		fmt.Println("⚠️ Failed to flush traces:", err)
+	}
+	os.Exit(0)
 }
-
-type Payload struct {
-	Entity    string `json:"entity"`
-	EntityId  string `json:"entityId"`
-	GroupId   string `json:"groupId,omitempty"`
-	GroupName string `json:"groupName,omitempty"`
-	TaskId    string `json:"taskId,omitempty"`
-	TaskName  string `json:"taskName,omitempty"`
-	Changes   string `json:"changes"`
-	User      string `json:"user"`
-	Workspace string `json:"workspace"`
-	Timestamp string `json:"timestamp"`
-}
\ No newline at end of file
@@ -1,4 +1,25 @@
+const crypto = require('crypto');
+const mongoose = require('mongoose');
 const { Kafka } = require('kafkajs');
+const Outbox = require('../models/Outbox');
+
+// Header convention shared with the Go services (go-consumer/message):
+// every message carries its event id, payload schema version, content
+// type/encoding, a W3C traceparent and the producing service.
+const SCHEMA_VERSION = '1';
+
+function messageHeaders() {
+  const traceId = crypto.randomBytes(16).toString('hex');
+  const spanId = crypto.randomBytes(8).toString('hex');
+  return {
+    'event-id': crypto.randomUUID(),
+    'schema-version': SCHEMA_VERSION,
+    'content-type': 'application/json',
+    'content-encoding': 'identity',
+    traceparent: `00-${traceId}-${spanId}-01`,
+    source: 'todo-backend'
+  };
+}
 
 class KafkaProducer {
   constructor() {
@@ -30,15 +51,8 @@ class KafkaProducer {
     }
   }
 
-  async publishEvent(eventType, payload) {
-    if (process.env.KAFKA_ENABLED === 'false') {
-      return;
-    }
-    if (!this.connected) {
-      console.warn('⚠️ Kafka not connected, skipping event:', eventType);
-      return;
-    }
-
+  // eventRecord builds the Kafka record of a history event
+  eventRecord(eventType, payload) {
     const message = {
       eventType,
       payload: {
@@ -46,14 +60,78 @@ class KafkaProducer {
         timestamp: new Date().toISOString()
       }
     };
+    return {
+      topic: process.env.KAFKA_TOPIC || 'todo-history-events',
+      key: payload.entityId || null,
+      value: JSON.stringify(message),
+      headers: messageHeaders()
+    };
+  }
+
+  // withEvents runs work(session, emit), the entity change of a request,
+  // and records the history events it emits with emit(eventType, payload).
+  // It resolves to what work returns.
+  //
+  // Outbox mode (OUTBOX_ENABLED=true): work runs in a MongoDB transaction and
+  // must pass session to every read and write; the events are stored in the
+  // outbox in the same transaction, for the Go relay to publish. Either the
+  // change and its events are stored or neither is, and a failure rejects so
+  // the route can report it. Transactions need MongoDB to run as a replica
+  // set.
+  //
+  // Otherwise session is null and the events are sent to Kafka in the
+  // background once work has finished, best effort: a change made while
+  // Kafka is down has no history.
+  async withEvents(work) {
+    const kafkaEnabled = process.env.KAFKA_ENABLED !== 'false';
+
+    if (kafkaEnabled && process.env.OUTBOX_ENABLED === 'true') {
+      const session = await mongoose.startSession();
+      try {
+        let result;
+        let eventTypes;
+        await session.withTransaction(async () => {
+          // withTransaction retries work on transient errors
+          const records = [];
+          result = await work(session, (eventType, payload) => {
+            records.push(this.eventRecord(eventType, payload));
+          });
+          if (records.length > 0) {
+            await Outbox.insertMany(records, { session });
+          }
+          eventTypes = records.map(record => JSON.parse(record.value).eventType);
+        });
+        eventTypes.forEach(eventType => console.log(`📥 Event stored in outbox: ${eventType}`));
+        return result;
+      } finally {
+        await session.endSession();
+      }
+    }
+
+    const records = [];
+    const result = await work(null, (eventType, payload) => {
+      records.push(this.eventRecord(eventType, payload));
+    });
+    if (kafkaEnabled) {
+      // Sent in the background; publish never rejects
+      records.forEach(record => this.publish(record));
+    }
+    return result;
+  }
+
+  // publish sends a history event record straight to Kafka, logging (not
+  // raising) failures
+  async publish(record) {
+    const eventType = JSON.parse(record.value).eventType;
+    if (!this.connected) {
+      console.warn('⚠️ Kafka not connected, skipping event:', eventType);
+      return;
+    }
 
     try {
       await this.producer.send({
-        topic: process.env.KAFKA_TOPIC || 'todo-history-events',
-        messages: [{
-          key: payload.entityId || null,
-          value: JSON.stringify(message)
-        }]
+        topic: record.topic,
+        messages: [{ key: record.key, value: record.value, headers: record.headers }]
       });
       console.log(`📤 Event published: ${eventType}`);
     } catch (error) {
@@ -61,7 +139,8 @@ class KafkaProducer {
     }
   }
 
-  async publishSnapshotToKafka(snapshotId, snapshotJson) {
+  // envelopeHeaders describe the encryption of an encrypted snapshot
+  async publishSnapshotToKafka(snapshotId, snapshotValue, envelopeHeaders = {}) {
     if (process.env.KAFKA_ENABLED === 'false') {
       return;
     }
@@ -75,7 +154,8 @@ class KafkaProducer {
         topic: 'todo-snapshots',
         messages: [{
           key: snapshotId,
-          value: snapshotJson
+          value: snapshotValue,
+          headers: { ...messageHeaders(), ...envelopeHeaders }
         }]
       });
       console.log(`📤 Snapshot published: ${snapshotId}`);
@@ -0,0 +1,20 @@
+const mongoose = require('mongoose');
+
+// A history event waiting to be published. With OUTBOX_ENABLED=true the
+// producer stores events here, in the same transaction as the entity change,
+// instead of sending them to Kafka, and the Go outbox relay
+// (go-consumer/outbox) publishes them and sets deliveredAt, or parks one it
+// cannot publish in the dead-letter queue and sets failedAt.
+// The value and headers are stored exactly as they will be sent, so a
+// redelivered event keeps its event-id.
+const outboxSchema = new mongoose.Schema({
+  topic: { type: String, required: true },
+  key: { type: String, default: null },
+  value: { type: String, required: true },
+  headers: { type: Map, of: String, default: {} },
+  createdAt: { type: Date, default: Date.now },
+  deliveredAt: { type: Date, default: null },
+  attempts: { type: Number, default: 0 }
+}, { collection: 'outbox', versionKey: false });
+
+module.exports = mongoose.model('Outbox', outboxSchema);
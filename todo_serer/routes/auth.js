@@ -13,7 +13,8 @@ router.post('/login', async (req, res) => {
       });
     }
     
-    const user = await User.findOne({ username, password });
+    // Users restored without their password have none to match until reset
+    const user = await User.findOne({ username, password, passwordResetRequired: { $ne: true } });
     if (!user) {
       return res.status(401).json({ 
         success: false, 
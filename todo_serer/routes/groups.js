@@ -4,6 +4,7 @@ const Task = require('../models/Task');
 const Comment = require('../models/Comment');
 const kafkaProducer = require('../kafka/producer');
 const { createAndSendSnapshot } = require('../services/snapshotCreator');
+const { groupState, taskState } = require('../services/eventState');
 const router = express.Router();
 
 // GET /groups - Get all groups with task counts
@@ -26,26 +27,32 @@ router.post('/', async (req, res) => {
         error: { code: 'VALIDATION_ERROR', message: 'Group name is required', details: { field: 'name', value: name || '' } }
       });
     }
-    const group = new Group({ name, discussion });
-    await group.save();
+    const group = await kafkaProducer.withEvents(async (session, emit) => {
+      const group = new Group({ name, discussion });
+      await group.save({ session });
 
-    res.json({ success: true, data: group });
-
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
-      kafkaProducer.publishEvent('GROUP_CREATED', {
+      emit('GROUP_CREATED', {
         entity: 'Group',
         entityId: group._id.toString(),
         groupName: name,
         changes: `Group "${name}" created with discussion: "${discussion || 'empty'}"`,
+        after: groupState(group),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      // Create and send snapshot directly
-      createAndSendSnapshot('GROUP_CREATED', user || 'system');
+      return group;
     });
+
+    res.json({ success: true, data: group });
+
+    // Create and send snapshot directly after successful response
+    setImmediate(() => createAndSendSnapshot('GROUP_CREATED', user || 'system'));
   } catch (error) {
-    res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    // A failed outbox write is ours, not the client's
+    if (error.name === 'ValidationError' || error.name === 'CastError') {
+      return res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    }
+    res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
 });
 
@@ -79,24 +86,17 @@ router.put('/:groupId', async (req, res) => {
       });
     }
 
-    const oldGroup = await Group.findById(req.params.groupId);
-    const group = await Group.findByIdAndUpdate(
-      req.params.groupId,
-      { name, discussion },
-      { new: true }
-    ).populate('tasks');
-
-    if (!group) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
-      });
-    }
-
-    res.json({ success: true, data: group });
+    const group = await kafkaProducer.withEvents(async (session, emit) => {
+      const oldGroup = await Group.findById(req.params.groupId).session(session);
+      if (!oldGroup) {
+        return null;
+      }
+      const group = await Group.findByIdAndUpdate(
+        req.params.groupId,
+        { name, discussion },
+        { new: true, session }
+      ).populate('tasks');
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
       const changes = [];
       if (oldGroup.name !== name) {
         changes.push(`Group name changed from "${oldGroup.name}" to "${name}"`);
@@ -105,16 +105,29 @@ router.put('/:groupId', async (req, res) => {
         changes.push(`Group discussion changed from "${oldGroup.discussion || 'empty'}" to "${discussion || 'empty'}"`);
       }
 
-      kafkaProducer.publishEvent('GROUP_UPDATED', {
+      emit('GROUP_UPDATED', {
         entity: 'Group',
         entityId: group._id.toString(),
         groupName: name,
         changes: changes.join(', '),
+        before: groupState(oldGroup),
+        after: groupState(group),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('GROUP_UPDATED', user || 'system');
+      return group;
     });
+
+    if (!group) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
+      });
+    }
+
+    res.json({ success: true, data: group });
+
+    setImmediate(() => createAndSendSnapshot('GROUP_UPDATED', user || 'system'));
   } catch (error) {
     res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
@@ -124,35 +137,41 @@ router.put('/:groupId', async (req, res) => {
 router.delete('/:groupId', async (req, res) => {
   try {
     const { user, workspace } = req.body;
-    const group = await Group.findById(req.params.groupId);
-    if (!group) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
-      });
-    }
-
-    // Delete all comments for tasks in this group
-    await Comment.deleteMany({ taskId: { $in: group.tasks } });
-    // Delete all tasks in this group
-    await Task.deleteMany({ groupId: req.params.groupId });
-    // Delete the group
-    await Group.findByIdAndDelete(req.params.groupId);
+    const group = await kafkaProducer.withEvents(async (session, emit) => {
+      const group = await Group.findById(req.params.groupId).session(session);
+      if (!group) {
+        return null;
+      }
 
-    res.json({ success: true, message: 'Group deleted successfully' });
+      // Delete all comments for tasks in this group
+      await Comment.deleteMany({ taskId: { $in: group.tasks } }, { session });
+      // Delete all tasks in this group
+      await Task.deleteMany({ groupId: req.params.groupId }, { session });
+      // Delete the group
+      await Group.findByIdAndDelete(req.params.groupId, { session });
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
-      kafkaProducer.publishEvent('GROUP_DELETED', {
+      emit('GROUP_DELETED', {
         entity: 'Group',
         entityId: req.params.groupId,
         groupName: group.name,
         changes: `Group "${group.name}" was deleted`,
+        before: groupState(group),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('GROUP_DELETED', user || 'system');
+      return group;
     });
+
+    if (!group) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
+      });
+    }
+
+    res.json({ success: true, message: 'Group deleted successfully' });
+
+    setImmediate(() => createAndSendSnapshot('GROUP_DELETED', user || 'system'));
   } catch (error) {
     res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
@@ -169,49 +188,59 @@ router.post('/:groupId/tasks', async (req, res) => {
       });
     }
 
-    const group = await Group.findById(req.params.groupId);
-    if (!group) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
-      });
-    }
-
-    const task = new Task({
-      groupId: req.params.groupId,
-      name,
-      description,
-      startDate,
-      endDate
-    });
-    await task.save();
+    const created = await kafkaProducer.withEvents(async (session, emit) => {
+      const group = await Group.findById(req.params.groupId).session(session);
+      if (!group) {
+        return null;
+      }
 
-    group.tasks.push(task._id);
-    await group.save();
+      const task = new Task({
+        groupId: req.params.groupId,
+        name,
+        description,
+        startDate,
+        endDate
+      });
+      await task.save({ session });
 
-    res.json({ success: true, data: task });
+      group.tasks.push(task._id);
+      await group.save({ session });
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
       const details = [];
       if (description) details.push(`description: "${description}"`);
       if (startDate) details.push(`start date: "${startDate}"`);
       if (endDate) details.push(`end date: "${endDate}"`);
 
-      kafkaProducer.publishEvent('TASK_CREATED', {
+      emit('TASK_CREATED', {
         entity: 'Task',
         entityId: task._id.toString(),
         groupId: req.params.groupId,
         groupName: group.name,
         taskName: name,
         changes: `Task "${name}" created in group "${group.name}" with status "New"${details.length > 0 ? ', ' + details.join(', ') : ''}`,
+        after: taskState(task),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('TASK_CREATED', user || 'system');
+      return task;
     });
+
+    if (!created) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Group not found', details: { groupId: req.params.groupId } }
+      });
+    }
+
+    res.json({ success: true, data: created });
+
+    setImmediate(() => createAndSendSnapshot('TASK_CREATED', user || 'system'));
   } catch (error) {
-    res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    // A failed outbox write is ours, not the client's
+    if (error.name === 'ValidationError' || error.name === 'CastError') {
+      return res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    }
+    res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
 });
 
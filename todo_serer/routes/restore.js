@@ -6,6 +6,8 @@ const Task = require('../models/Task');
 const Comment = require('../models/Comment');
 const User = require('../models/User');
 const kafkaProducer = require('../kafka/producer');
+const { unredactSnapshot } = require('../services/snapshotRedaction');
+const { openSnapshot } = require('../services/snapshotEncryption');
 const router = express.Router();
 
 const s3 = new AWS.S3({
@@ -63,7 +65,8 @@ router.post('/:snapshotId', async (req, res) => {
     
     console.log(`Successfully downloaded snapshot from S3`);
 
-    const snapshotData = JSON.parse(s3Object.Body.toString());
+    // Decrypts transparently when the snapshot was envelope-encrypted
+    const snapshotData = JSON.parse(await openSnapshot(s3Object));
     console.log(`Restoring snapshot: ${snapshotId}`);
     console.log(`Snapshot from S3: ${snapshotData.snapshotId}`);
     
@@ -71,10 +74,37 @@ router.post('/:snapshotId', async (req, res) => {
     if (snapshotData.snapshotId !== snapshotId) {
       throw new Error(`Snapshot ID mismatch: requested ${snapshotId}, got ${snapshotData.snapshotId}`);
     }
-    
+
+    // Restore replaces whole collections, so a snapshot of one workspace
+    // would wipe every other workspace's data
+    if (snapshotData.workspace) {
+      return res.status(400).json({
+        success: false,
+        error: `Snapshot ${snapshotId} only covers workspace "${snapshotData.workspace}" and cannot be restored over the whole database`
+      });
+    }
+
     console.log('Snapshot data structure:', Object.keys(snapshotData));
     console.log('Data section:', Object.keys(snapshotData.data || {}));
     
+    // Handle fields the snapshot pipeline redacted (e.g. user passwords)
+    // before anything is dropped, so current values can be carried over
+    const [currentGroups, currentTasks, currentComments, currentUsers] = await Promise.all([
+      Group.find({}).lean(),
+      Task.find({}).lean(),
+      Comment.find({}).lean(),
+      User.find({}).lean()
+    ]);
+    const unresolvedRedactions = unredactSnapshot(snapshotData, {
+      groups: currentGroups,
+      tasks: currentTasks,
+      comments: currentComments,
+      users: currentUsers
+    });
+    if (unresolvedRedactions.length > 0) {
+      console.warn('⚠️ Redacted fields restored without a value (users must reset their password):', unresolvedRedactions);
+    }
+
     const { groups, tasks, comments, users } = snapshotData.data || {};
     
     console.log('Arrays found:', {
@@ -120,7 +150,8 @@ router.post('/:snapshotId', async (req, res) => {
         tasks: Array.isArray(tasks) ? tasks.length : 0,
         comments: Array.isArray(comments) ? comments.length : 0,
         users: Array.isArray(users) ? users.length : 0
-      }
+      },
+      unresolvedRedactions
     });
 
     // Note: No logging for restore operations to avoid interfering with snapshot data
@@ -4,6 +4,7 @@ const Comment = require('../models/Comment');
 const Group = require('../models/Group');
 const kafkaProducer = require('../kafka/producer');
 const { createAndSendSnapshot } = require('../services/snapshotCreator');
+const { taskState, commentState } = require('../services/eventState');
 const router = express.Router();
 
 // PUT /tasks/:taskId - Update task name, description, and dates
@@ -17,24 +18,17 @@ router.put('/:taskId', async (req, res) => {
       });
     }
 
-    const oldTask = await Task.findById(req.params.taskId).populate('groupId');
-    const task = await Task.findByIdAndUpdate(
-      req.params.taskId,
-      { name, description, startDate, endDate },
-      { new: true }
-    ).populate('comments').populate('groupId');
-
-    if (!task) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
-      });
-    }
-
-    res.json({ success: true, data: task });
+    const task = await kafkaProducer.withEvents(async (session, emit) => {
+      const oldTask = await Task.findById(req.params.taskId).populate('groupId').session(session);
+      if (!oldTask) {
+        return null;
+      }
+      const task = await Task.findByIdAndUpdate(
+        req.params.taskId,
+        { name, description, startDate, endDate },
+        { new: true, session }
+      ).populate('comments').populate('groupId');
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
       const changes = [];
       if (oldTask.name !== name) {
         changes.push(`Task name changed from "${oldTask.name}" to "${name}"`);
@@ -49,18 +43,32 @@ router.put('/:taskId', async (req, res) => {
         changes.push(`End date changed from "${oldTask.endDate || 'empty'}" to "${endDate || 'empty'}"`);
       }
 
-      kafkaProducer.publishEvent('TASK_UPDATED', {
+      emit('TASK_UPDATED', {
         entity: 'Task',
         entityId: task._id.toString(),
         groupId: task.groupId?._id?.toString() || task.groupId?.toString(),
         groupName: task.groupId?.name || 'Unknown',
         taskName: name,
         changes: changes.join(', '),
+        before: taskState(oldTask),
+        after: taskState(task),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('TASK_UPDATED', user || 'system');
+      return task;
     });
+
+    if (!task) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
+      });
+    }
+
+    res.json({ success: true, data: task });
+
+    // Create and send snapshot directly after successful response
+    setImmediate(() => createAndSendSnapshot('TASK_UPDATED', user || 'system'));
   } catch (error) {
     res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
@@ -79,36 +87,42 @@ router.put('/:taskId/status', async (req, res) => {
       });
     }
 
-    const oldTask = await Task.findById(req.params.taskId).populate('groupId');
-    const task = await Task.findByIdAndUpdate(
-      req.params.taskId,
-      { status },
-      { new: true }
-    ).populate('comments').populate('groupId');
-
-    if (!task) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
-      });
-    }
-
-    res.json({ success: true, data: task });
+    const task = await kafkaProducer.withEvents(async (session, emit) => {
+      const oldTask = await Task.findById(req.params.taskId).populate('groupId').session(session);
+      if (!oldTask) {
+        return null;
+      }
+      const task = await Task.findByIdAndUpdate(
+        req.params.taskId,
+        { status },
+        { new: true, session }
+      ).populate('comments').populate('groupId');
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
-      kafkaProducer.publishEvent('STATUS_CHANGED', {
+      emit('STATUS_CHANGED', {
         entity: 'Task',
         entityId: task._id.toString(),
         groupId: task.groupId?._id?.toString() || task.groupId?.toString(),
         groupName: task.groupId?.name || 'Unknown',
         taskName: task.name,
         changes: `Task status changed from "${oldTask.status}" to "${status}"`,
+        before: taskState(oldTask),
+        after: taskState(task),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('STATUS_CHANGED', user || 'system');
+      return task;
     });
+
+    if (!task) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
+      });
+    }
+
+    res.json({ success: true, data: task });
+
+    setImmediate(() => createAndSendSnapshot('STATUS_CHANGED', user || 'system'));
   } catch (error) {
     res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
@@ -118,40 +132,46 @@ router.put('/:taskId/status', async (req, res) => {
 router.delete('/:taskId', async (req, res) => {
   try {
     const { user, workspace } = req.body;
-    const task = await Task.findById(req.params.taskId).populate('groupId');
-    if (!task) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
-      });
-    }
+    const task = await kafkaProducer.withEvents(async (session, emit) => {
+      const task = await Task.findById(req.params.taskId).populate('groupId').session(session);
+      if (!task) {
+        return null;
+      }
 
-    const groupId = task.groupId?._id?.toString() || task.groupId?.toString();
-    const groupName = task.groupId?.name || 'Unknown';
+      const groupId = task.groupId?._id?.toString() || task.groupId?.toString();
+      const groupName = task.groupId?.name || 'Unknown';
 
-    // Remove task from group
-    await Group.findByIdAndUpdate(groupId, { $pull: { tasks: task._id } });
-    // Delete all comments for this task
-    await Comment.deleteMany({ taskId: req.params.taskId });
-    // Delete the task
-    await Task.findByIdAndDelete(req.params.taskId);
+      // Remove task from group
+      await Group.findByIdAndUpdate(groupId, { $pull: { tasks: task._id } }, { session });
+      // Delete all comments for this task
+      await Comment.deleteMany({ taskId: req.params.taskId }, { session });
+      // Delete the task
+      await Task.findByIdAndDelete(req.params.taskId, { session });
 
-    res.json({ success: true, message: 'Task deleted successfully' });
-
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
-      kafkaProducer.publishEvent('TASK_DELETED', {
+      emit('TASK_DELETED', {
         entity: 'Task',
         entityId: req.params.taskId,
         groupId: groupId,
         groupName: groupName,
         taskName: task.name,
         changes: `Task "${task.name}" with status "${task.status}" was deleted`,
+        before: taskState(task),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('TASK_DELETED', user || 'system');
+      return task;
     });
+
+    if (!task) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
+      });
+    }
+
+    res.json({ success: true, message: 'Task deleted successfully' });
+
+    setImmediate(() => createAndSendSnapshot('TASK_DELETED', user || 'system'));
   } catch (error) {
     res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
@@ -184,25 +204,19 @@ router.post('/:taskId/comments', async (req, res) => {
       });
     }
 
-    const task = await Task.findById(req.params.taskId).populate('groupId');
-    if (!task) {
-      return res.status(404).json({
-        success: false,
-        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
-      });
-    }
-
-    const comment = new Comment({ taskId: req.params.taskId, text });
-    await comment.save();
+    const comment = await kafkaProducer.withEvents(async (session, emit) => {
+      const task = await Task.findById(req.params.taskId).populate('groupId').session(session);
+      if (!task) {
+        return null;
+      }
 
-    task.comments.push(comment._id);
-    await task.save();
+      const comment = new Comment({ taskId: req.params.taskId, text });
+      await comment.save({ session });
 
-    res.json({ success: true, data: comment });
+      task.comments.push(comment._id);
+      await task.save({ session });
 
-    // Publish events to Kafka after successful response
-    setImmediate(() => {
-      kafkaProducer.publishEvent('COMMENT_ADDED', {
+      emit('COMMENT_ADDED', {
         entity: 'Comment',
         entityId: comment._id.toString(),
         groupId: task.groupId?._id?.toString() || task.groupId?.toString(),
@@ -210,13 +224,29 @@ router.post('/:taskId/comments', async (req, res) => {
         taskId: task._id.toString(),
         taskName: task.name,
         changes: `Comment added to task "${task.name}": "${text}"`,
+        after: commentState(comment),
         user: user || 'system',
         workspace: workspace || 'default'
       });
-      createAndSendSnapshot('COMMENT_ADDED', user || 'system');
+      return comment;
     });
+
+    if (!comment) {
+      return res.status(404).json({
+        success: false,
+        error: { code: 'NOT_FOUND', message: 'Task not found', details: { taskId: req.params.taskId } }
+      });
+    }
+
+    res.json({ success: true, data: comment });
+
+    setImmediate(() => createAndSendSnapshot('COMMENT_ADDED', user || 'system'));
   } catch (error) {
-    res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    // A failed outbox write is ours, not the client's
+    if (error.name === 'ValidationError' || error.name === 'CastError') {
+      return res.status(400).json({ success: false, error: { code: 'VALIDATION_ERROR', message: error.message } });
+    }
+    res.status(500).json({ success: false, error: { code: 'INTERNAL_ERROR', message: error.message } });
   }
 });
 
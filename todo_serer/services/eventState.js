@@ -0,0 +1,38 @@
+// Structured entity state attached to history events as payload.before and
+// payload.after. The Go consumer stores them in todo_event_logs.event_data so
+// an entity can be rebuilt as of any point in time (go-consumer/projection).
+
+function refId(value) {
+  if (!value) return null;
+  return (value._id || value).toString();
+}
+
+function groupState(group) {
+  if (!group) return null;
+  return {
+    name: group.name,
+    discussion: group.discussion || ''
+  };
+}
+
+function taskState(task) {
+  if (!task) return null;
+  return {
+    groupId: refId(task.groupId),
+    name: task.name,
+    description: task.description || '',
+    status: task.status,
+    startDate: task.startDate || null,
+    endDate: task.endDate || null
+  };
+}
+
+function commentState(comment) {
+  if (!comment) return null;
+  return {
+    taskId: refId(comment.taskId),
+    text: comment.text
+  };
+}
+
+module.exports = { groupState, taskState, commentState };
@@ -3,6 +3,8 @@ const Task = require('../models/Task');
 const Comment = require('../models/Comment');
 const User = require('../models/User');
 const kafkaProducer = require('../kafka/producer');
+const { redactSnapshot } = require('./snapshotRedaction');
+const { sealSnapshot } = require('./snapshotEncryption');
 
 async function createAndSendSnapshot(triggerReason, user) {
   try {
@@ -38,8 +40,13 @@ async function createAndSendSnapshot(triggerReason, user) {
       }
     };
 
-    // Send snapshot to Kafka topic
-    await kafkaProducer.publishSnapshotToKafka(snapshotId, JSON.stringify(snapshot, null, 2));
+    // Never publish sensitive fields (e.g. user passwords) in plaintext
+    redactSnapshot(snapshot);
+
+    // Encrypt like the Go service when SNAPSHOT_ENCRYPTION is configured,
+    // then send the snapshot to the Kafka topic
+    const sealed = await sealSnapshot(JSON.stringify(snapshot, null, 2));
+    await kafkaProducer.publishSnapshotToKafka(snapshotId, sealed.value, sealed.headers);
     
     console.log(`📸 Snapshot created and sent to Kafka: ${snapshotId}`);
   } catch (error) {
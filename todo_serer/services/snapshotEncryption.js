@@ -0,0 +1,121 @@
+const crypto = require('crypto');
+const fs = require('fs');
+const AWS = require('aws-sdk');
+
+// Mirrors go-consumer/snapshot/encryption.go: encrypted snapshots carry their
+// envelope in S3 object metadata and the body is nonce || ciphertext || tag.
+const ALGORITHM = 'AES-256-GCM';
+
+function gcmSeal(key, plaintext, aad) {
+  const nonce = crypto.randomBytes(12);
+  const cipher = crypto.createCipheriv('aes-256-gcm', key, nonce);
+  if (aad) cipher.setAAD(aad);
+  const ciphertext = Buffer.concat([cipher.update(plaintext), cipher.final()]);
+  return Buffer.concat([nonce, ciphertext, cipher.getAuthTag()]);
+}
+
+function gcmOpen(key, sealed, aad) {
+  const nonce = sealed.subarray(0, 12);
+  const tag = sealed.subarray(sealed.length - 16);
+  const ciphertext = sealed.subarray(12, sealed.length - 16);
+  const decipher = crypto.createDecipheriv('aes-256-gcm', key, nonce);
+  if (aad) decipher.setAAD(aad);
+  decipher.setAuthTag(tag);
+  return Buffer.concat([decipher.update(ciphertext), decipher.final()]);
+}
+
+function loadKeyring() {
+  const mode = (process.env.SNAPSHOT_ENCRYPTION || '').toLowerCase();
+  if (mode === 'local') {
+    const file = JSON.parse(fs.readFileSync(process.env.SNAPSHOT_KEYFILE, 'utf8'));
+    return { active: file.activeKeyId, keys: file.keys || {} };
+  }
+  if (mode === 'env') {
+    const keys = {};
+    for (const entry of (process.env.SNAPSHOT_KEKS || '').split(',')) {
+      const [id, key] = entry.trim().split(':');
+      if (id && key) keys[id] = key;
+    }
+    return { active: process.env.SNAPSHOT_KEK_ACTIVE, keys };
+  }
+  return null;
+}
+
+async function wrapDataKey(dataKey) {
+  const mode = (process.env.SNAPSHOT_ENCRYPTION || '').toLowerCase();
+  if (mode === 'kms') {
+    const kms = new AWS.KMS({ region: process.env.AWS_REGION || 'us-east-1' });
+    const result = await kms.encrypt({ KeyId: process.env.SNAPSHOT_KMS_KEY_ID, Plaintext: dataKey }).promise();
+    return { wrapped: Buffer.from(result.CiphertextBlob), keyId: result.KeyId };
+  }
+
+  const keyring = loadKeyring();
+  if (!keyring.keys[keyring.active]) {
+    throw new Error(`Active snapshot key ${keyring.active} is not in the keyring`);
+  }
+  const kek = Buffer.from(keyring.keys[keyring.active], 'base64');
+  return { wrapped: gcmSeal(kek, dataKey, Buffer.from(keyring.active)), keyId: keyring.active };
+}
+
+async function unwrapDataKey(wrapped, keyId) {
+  const mode = (process.env.SNAPSHOT_ENCRYPTION || '').toLowerCase();
+  if (mode === 'kms') {
+    const kms = new AWS.KMS({ region: process.env.AWS_REGION || 'us-east-1' });
+    const result = await kms.decrypt({ KeyId: keyId, CiphertextBlob: wrapped }).promise();
+    return Buffer.from(result.Plaintext);
+  }
+
+  const keyring = loadKeyring();
+  if (!keyring) {
+    throw new Error(`Snapshot is encrypted with key ${keyId} but SNAPSHOT_ENCRYPTION is not configured`);
+  }
+  if (!keyring.keys[keyId]) {
+    throw new Error(`Snapshot key ${keyId} is not in the keyring`);
+  }
+  return gcmOpen(Buffer.from(keyring.keys[keyId], 'base64'), wrapped, Buffer.from(keyId));
+}
+
+// Envelope-encrypt snapshot JSON for publishing when SNAPSHOT_ENCRYPTION is
+// configured, like the Go service does. Returns the message value and the
+// envelope headers the snapshot processor copies to the S3 object.
+async function sealSnapshot(snapshotJson) {
+  const mode = (process.env.SNAPSHOT_ENCRYPTION || '').toLowerCase();
+  if (mode === '' || mode === 'none') {
+    return { value: snapshotJson, headers: {} };
+  }
+  if (!['local', 'env', 'kms'].includes(mode)) {
+    throw new Error(`Unknown SNAPSHOT_ENCRYPTION provider: ${mode}`);
+  }
+
+  const dataKey = crypto.randomBytes(32);
+  const { wrapped, keyId } = await wrapDataKey(dataKey);
+  return {
+    value: gcmSeal(dataKey, Buffer.from(snapshotJson, 'utf8')),
+    headers: {
+      'encryption-alg': ALGORITHM,
+      'encryption-key-id': keyId,
+      'encryption-wrapped-key': wrapped.toString('base64'),
+      'content-encoding': ALGORITHM
+    }
+  };
+}
+
+// Return the snapshot JSON text for an S3 object, decrypting it when the
+// object metadata describes an envelope.
+async function openSnapshot(s3Object) {
+  const metadata = s3Object.Metadata || {};
+  const algorithm = metadata['encryption-alg'];
+  if (!algorithm) {
+    return s3Object.Body.toString();
+  }
+  if (algorithm !== ALGORITHM) {
+    throw new Error(`Unsupported snapshot encryption algorithm: ${algorithm}`);
+  }
+
+  const keyId = metadata['encryption-key-id'];
+  const wrapped = Buffer.from(metadata['encryption-wrapped-key'], 'base64');
+  const dataKey = await unwrapDataKey(wrapped, keyId);
+  return gcmOpen(dataKey, Buffer.from(s3Object.Body)).toString('utf8');
+}
+
+module.exports = { openSnapshot, sealSnapshot };
@@ -0,0 +1,145 @@
+const crypto = require('crypto');
+
+// Mirrors go-consumer/snapshot/redact.go: snapshots record applied rules in
+// metadata.redactions as "collection.field.path=action".
+// Encrypted values hold the field as JSON so its type survives a restore.
+const ENCRYPTED_PREFIX = 'enc:v2:';
+const DEFAULT_REDACT_RULES = 'users.password=drop';
+
+function parseRules(spec) {
+  return spec.split(/[;,]/).map(rule => rule.trim()).filter(Boolean).map(rule => {
+    const [target, action] = rule.split('=');
+    const [collection, ...path] = target.trim().split('.');
+    if (!action || path.length === 0 || !['drop', 'hash', 'encrypt'].includes(action.trim())) {
+      throw new Error(`Invalid redaction rule: ${rule}`);
+    }
+    return { collection, path, action: action.trim() };
+  });
+}
+
+function parseRedactions(snapshotData) {
+  const redactions = (snapshotData.metadata && snapshotData.metadata.redactions) || [];
+  return parseRules(redactions.join(';'));
+}
+
+function redactKey() {
+  return process.env.SNAPSHOT_REDACT_KEY
+    ? Buffer.from(process.env.SNAPSHOT_REDACT_KEY, 'base64')
+    : null;
+}
+
+function getParent(doc, path) {
+  let current = doc;
+  for (const key of path.slice(0, -1)) {
+    if (!current || typeof current[key] !== 'object') return null;
+    current = current[key];
+  }
+  return current;
+}
+
+// Hashes are keyed so low-entropy values such as passwords cannot be
+// brute-forced offline from a published snapshot
+function hashValue(value, key) {
+  return 'hmac-sha256:' + crypto.createHmac('sha256', key).update(String(value)).digest('hex');
+}
+
+function encryptValue(value, key) {
+  const nonce = crypto.randomBytes(12);
+  const cipher = crypto.createCipheriv('aes-256-gcm', key, nonce);
+  const ciphertext = Buffer.concat([cipher.update(JSON.stringify(value), 'utf8'), cipher.final()]);
+  return ENCRYPTED_PREFIX + Buffer.concat([nonce, ciphertext, cipher.getAuthTag()]).toString('base64');
+}
+
+function isEncrypted(value) {
+  return typeof value === 'string' && value.startsWith(ENCRYPTED_PREFIX);
+}
+
+function decryptValue(value, key) {
+  const sealed = Buffer.from(value.slice(ENCRYPTED_PREFIX.length), 'base64');
+  const nonce = sealed.subarray(0, 12);
+  const tag = sealed.subarray(sealed.length - 16);
+  const ciphertext = sealed.subarray(12, sealed.length - 16);
+  const decipher = crypto.createDecipheriv('aes-256-gcm', key, nonce);
+  decipher.setAuthTag(tag);
+  const plain = Buffer.concat([decipher.update(ciphertext), decipher.final()]).toString('utf8');
+  return JSON.parse(plain);
+}
+
+// Apply SNAPSHOT_REDACT rules (default: drop user passwords) to a snapshot
+// before it is published, recording them in metadata.redactions.
+function redactSnapshot(snapshot) {
+  const spec = (process.env.SNAPSHOT_REDACT || '').trim() || DEFAULT_REDACT_RULES;
+  if (spec.toLowerCase() === 'none') return snapshot;
+
+  const key = redactKey();
+  const rules = parseRules(spec);
+  snapshot.metadata.redactions = [];
+
+  for (const rule of rules) {
+    if ((rule.action === 'hash' || rule.action === 'encrypt') && !key) {
+      throw new Error(`Redaction rule ${rule.collection}.${rule.path.join('.')} requires SNAPSHOT_REDACT_KEY`);
+    }
+    const field = rule.path[rule.path.length - 1];
+    for (const doc of snapshot.data[rule.collection] || []) {
+      const parent = getParent(doc, rule.path);
+      if (!parent || parent[field] === undefined) continue;
+
+      if (rule.action === 'drop') delete parent[field];
+      if (rule.action === 'hash') parent[field] = hashValue(parent[field], key);
+      if (rule.action === 'encrypt') parent[field] = encryptValue(parent[field], key);
+    }
+    snapshot.metadata.redactions.push(`${rule.collection}.${rule.path.join('.')}=${rule.action}`);
+  }
+  return snapshot;
+}
+
+// Prepare redacted snapshot collections for restore. Encrypted fields are
+// decrypted with SNAPSHOT_REDACT_KEY; dropped or hashed fields cannot be
+// recovered, so the value from the current document with the same _id is
+// kept. Documents with no current counterpart are restored without the
+// field and reported; a digest is never written back as the secret it
+// stands for. Users restored this way are flagged passwordResetRequired and
+// cannot log in until a new password is set.
+function unredactSnapshot(snapshotData, currentDocs) {
+  const rules = parseRedactions(snapshotData);
+  const unresolved = [];
+  if (rules.length === 0) return unresolved;
+
+  const key = redactKey();
+
+  for (const rule of rules) {
+    const docs = (snapshotData.data && snapshotData.data[rule.collection]) || [];
+    const field = rule.path[rule.path.length - 1];
+    const current = new Map(
+      (currentDocs[rule.collection] || []).map(doc => [String(doc._id), doc])
+    );
+
+    for (const doc of docs) {
+      const parent = getParent(doc, rule.path);
+      if (!parent) continue;
+
+      if (rule.action === 'encrypt') {
+        if (!isEncrypted(parent[field])) continue;
+        if (!key) {
+          throw new Error(`Snapshot field ${rule.collection}.${rule.path.join('.')} is encrypted and SNAPSHOT_REDACT_KEY is not set`);
+        }
+        parent[field] = decryptValue(parent[field], key);
+        continue;
+      }
+
+      const existing = current.get(String(doc._id));
+      const existingParent = existing && getParent(existing, rule.path);
+      if (existingParent && existingParent[field] !== undefined) {
+        parent[field] = existingParent[field];
+      } else {
+        delete parent[field];
+        if (rule.collection === 'users' && rule.path.join('.') === 'password') doc.passwordResetRequired = true;
+        unresolved.push(`${rule.collection}/${doc._id}: ${rule.path.join('.')} (${rule.action})`);
+      }
+    }
+  }
+
+  return unresolved;
+}
+
+module.exports = { redactSnapshot, unredactSnapshot };